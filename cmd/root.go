@@ -4,16 +4,51 @@ Copyright © 2023 NAME HERE <EMAIL ADDRESS>
 package cmd
 
 import (
+	"fmt"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/carantes/go-rate-limiter/lib"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
 	Use:   "go-rate-limiter",
 	Short: "Rate limit testing server",
-	Long:  `Run a rate limit testing server based on the algorithm of your choice`,
+	Long:  `Run a rate limit testing server based on the algorithm of your choice, or on the limits of a policy file with --config`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path := cmd.Flag("config").Value.String()
+
+		if path == "" {
+			return cmd.Help()
+		}
+
+		p, err := lib.LoadPolicy(path)
+
+		if err != nil {
+			return err
+		}
+
+		// servers running the same policy file share their in-flight limits
+		inFlight, err := newConcurrencyLimiter(cmd, strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)))
+
+		if err != nil {
+			return err
+		}
+
+		s, err := NewServerFromPolicy(p, inFlight)
+
+		if err != nil {
+			return err
+		}
+
+		return startServer(cmd, s)
+	},
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
@@ -25,103 +60,155 @@ func Execute() {
 	}
 }
 
-var tokenBucketCmd = &cobra.Command{
-	Use:   "tokenBucket",
-	Short: "Token bucket rate limit algorithm",
-	Long:  `Run a new server with the token bucket rate limit algorithm`,
-	Run: func(cmd *cobra.Command, args []string) {
-		NewServer(map[string]string{
-			"algorithm":  "token-bucket",
-			"capacity":   cmd.Flag("capacity").Value.String(),
-			"refillRate": cmd.Flag("refillRate").Value.String(),
-		}).Run(cmd.Flag("addr").Value.String())
-	},
+// runServer runs a server with the single limit given by the flags of an algorithm subcommand
+func runServer(cmd *cobra.Command, config map[string]string) error {
+	// the in-flight limits are named like the single limit of the server
+	inFlight, err := newConcurrencyLimiter(cmd, config["algorithm"])
+
+	if err != nil {
+		return err
+	}
+
+	s, err := NewServer(config, inFlight)
+
+	if err != nil {
+		return err
+	}
+
+	return startServer(cmd, s)
 }
 
-var fixedWindowCmd = &cobra.Command{
-	Use:   "fixedWindow",
-	Short: "Fixed window rate limit algorithm",
-	Long:  `Run a new server with the fixed window rate limit algorithm`,
-	Run: func(cmd *cobra.Command, args []string) {
-		NewServer(map[string]string{
-			"algorithm": "fixed-window",
-			"capacity":  cmd.Flag("capacity").Value.String(),
-			"duration":  cmd.Flag("duration").Value.String(),
-		}).Run(cmd.Flag("addr").Value.String())
-	},
+// startServer restores the state of the limits when --state-file is set and runs the server
+func startServer(cmd *cobra.Command, s *server) error {
+	stateFile, _ := cmd.Flags().GetString("state-file")
+	interval, _ := cmd.Flags().GetDuration("snapshot-interval")
+
+	if stateFile != "" {
+		if interval <= 0 {
+			s.Close()
+			return fmt.Errorf("--snapshot-interval must be positive")
+		}
+
+		if err := s.PersistState(stateFile, interval); err != nil {
+			s.Close()
+			return err
+		}
+	}
+
+	return s.Run(cmd.Flag("addr").Value.String())
 }
 
-var slidingWindowLogCmd = &cobra.Command{
-	Use:   "slidingWindowLog",
-	Short: "Sliding window log rate limit algorithm",
-	Long:  `Run a new server with the sliding window log rate limit algorithm`,
-	Run: func(cmd *cobra.Command, args []string) {
-		NewServer(map[string]string{
-			"algorithm": "sliding-window-log",
-			"capacity":  cmd.Flag("capacity").Value.String(),
-			"duration":  cmd.Flag("duration").Value.String(),
-		}).Run(cmd.Flag("addr").Value.String())
-	},
+// newConcurrencyLimiter creates the concurrency limiter given by the in-flight flags, nil when both maximums are zero.
+// With --adaptive, --maxInFlight is the upper bound of the learned limit. In Redis, the leases are kept under
+// --inFlightKeyPrefix, or under name when the flag is not set
+func newConcurrencyLimiter(cmd *cobra.Command, name string) (lib.ConcurrencyLimiter, error) {
+	flags := cmd.Flags()
+
+	maxTotal, _ := flags.GetInt("maxInFlight")
+	maxPerKey, _ := flags.GetInt("maxInFlightPerKey")
+	queueTimeout, _ := flags.GetDuration("queueTimeout")
+	redisURL, _ := flags.GetString("inFlightRedisURL")
+	keyPrefix, _ := flags.GetString("inFlightKeyPrefix")
+	leaseTTL, _ := flags.GetDuration("leaseTTL")
+	adaptive, _ := flags.GetString("adaptive")
+	minTotal, _ := flags.GetInt("minInFlight")
+	latencyThreshold, _ := flags.GetDuration("latencyThreshold")
+
+	if adaptive != "" {
+		if maxPerKey != 0 || redisURL != "" {
+			return nil, fmt.Errorf("adaptive in-flight limits are kept in memory for every client, --maxInFlightPerKey and --inFlightRedisURL are not supported")
+		}
+
+		return lib.NewAdaptiveLimiter(lib.AdaptiveArgs{
+			Algorithm: lib.AdaptiveAlgorithm(adaptive), MinLimit: minTotal, MaxLimit: maxTotal, QueueTimeout: queueTimeout, LatencyThreshold: latencyThreshold,
+		})
+	}
+
+	if maxTotal == 0 && maxPerKey == 0 {
+		return nil, nil
+	}
+
+	if redisURL != "" {
+		if keyPrefix == "" {
+			keyPrefix = name
+		}
+
+		return lib.NewRedisConcurrencyLimiter(lib.RedisConcurrencyArgs{
+			RedisURL: redisURL, KeyPrefix: keyPrefix, MaxPerKey: maxPerKey, MaxTotal: maxTotal, QueueTimeout: queueTimeout, LeaseTTL: leaseTTL,
+		})
+	}
+
+	return lib.NewConcurrencyLimiter(lib.ConcurrencyArgs{MaxPerKey: maxPerKey, MaxTotal: maxTotal, QueueTimeout: queueTimeout})
 }
 
-var slidingWindowCounterCmd = &cobra.Command{
-	Use:   "slidingWindowCounter",
-	Short: "Sliding window counter rate limit algorithm",
-	Long:  `Run a new server with the sliding window counter rate limit algorithm`,
-	Run: func(cmd *cobra.Command, args []string) {
-		NewServer(map[string]string{
-			"algorithm": "sliding-window-counter",
-			"capacity":  cmd.Flag("capacity").Value.String(),
-			"duration":  cmd.Flag("duration").Value.String(),
-			"weight":    cmd.Flag("weight").Value.String(),
-		}).Run(cmd.Flag("addr").Value.String())
-	},
+// algorithmCmd creates the subcommand of a registered algorithm, with one flag per config field
+func algorithmCmd(spec lib.AlgorithmSpec) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   spec.Command,
+		Short: spec.Description,
+		Long:  fmt.Sprintf("Run a new server with the %s rate limit algorithm", spec.Name),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runServer(cmd, flagConfig(cmd, spec))
+		},
+	}
+
+	for _, f := range spec.Fields {
+		addFlag(cmd.Flags(), f)
+	}
+
+	return cmd
 }
 
-var redisSlidingWindowCounterCmd = &cobra.Command{
-	Use:   "redisSlidingWindowCounter",
-	Short: "Sliding window counter rate limit algorithm using Redis",
-	Long:  `Run a new server with the sliding window counter rate limit algorithm using Redis to store the data`,
-	Run: func(cmd *cobra.Command, args []string) {
-		NewServer(map[string]string{
-			"algorithm": "redis-sliding-window-counter",
-			"capacity":  cmd.Flag("capacity").Value.String(),
-			"duration":  cmd.Flag("duration").Value.String(),
-			"weight":    cmd.Flag("weight").Value.String(),
-			"redisURL":  cmd.Flag("redisURL").Value.String(),
-		}).Run(cmd.Flag("addr").Value.String())
-	},
+// flagConfig returns the config of an algorithm subcommand, one key per field read from its flag
+func flagConfig(cmd *cobra.Command, spec lib.AlgorithmSpec) map[string]string {
+	config := map[string]string{"algorithm": spec.Name}
+
+	for _, f := range spec.Fields {
+		config[f.Name] = cmd.Flag(f.Name).Value.String()
+	}
+
+	return config
+}
+
+// addFlag adds a typed flag for a config field, invalid defaults fall back to the zero value.
+// Durations and rates are string flags checked with the config, a plain number of seconds is a valid duration
+func addFlag(flags *pflag.FlagSet, f lib.ConfigField) {
+	switch f.Type {
+	case lib.IntField:
+		n, _ := strconv.Atoi(f.Default)
+		flags.Int(f.Name, n, f.Usage)
+	case lib.FloatField:
+		n, _ := strconv.ParseFloat(f.Default, 64)
+		flags.Float64(f.Name, n, f.Usage)
+	default:
+		flags.String(f.Name, f.Default, f.Usage)
+	}
 }
 
 func init() {
 	// Server config
 	rootCmd.PersistentFlags().String("addr", ":8080", "The address to listen on")
+	rootCmd.Flags().String("config", "", "Policy file defining the limits (.yaml, .json or .toml)")
+
+	// State of the in-memory limits, kept across restarts when the state file is set
+	rootCmd.PersistentFlags().String("state-file", "", "File the in-memory limits save their users to and restore them from on startup, off when empty")
+	rootCmd.PersistentFlags().Duration("snapshot-interval", time.Minute, "How often the users of the in-memory limits are saved to the state file, they are also saved on shutdown")
 
-	// Token bucket rate limit algorithm
-	rootCmd.AddCommand(tokenBucketCmd)
-	tokenBucketCmd.Flags().Int32("capacity", 10, "The maximum number of requests allowed in the time window")
-	tokenBucketCmd.Flags().Int32("refillRate", 1, "The number of requests to add per second")
-
-	// Fixed window rate limit algorithm
-	rootCmd.AddCommand(fixedWindowCmd)
-	fixedWindowCmd.Flags().Int32("capacity", 60, "The maximum number of requests allowed in the time window")
-	fixedWindowCmd.Flags().Int32("duration", 60, "The duration of the window in seconds")
-
-	// Sliding window log rate limit algorithm
-	rootCmd.AddCommand(slidingWindowLogCmd)
-	slidingWindowLogCmd.Flags().Int32("capacity", 60, "The maximum number of requests allowed in the time window")
-	slidingWindowLogCmd.Flags().Int32("duration", 60, "The duration of the window in seconds")
-
-	// Sliding window counter rate limit algorithm
-	rootCmd.AddCommand(slidingWindowCounterCmd)
-	slidingWindowCounterCmd.Flags().Int32("capacity", 60, "The maximum number of requests allowed in the time window")
-	slidingWindowCounterCmd.Flags().Int32("duration", 60, "The duration of the window in seconds")
-	slidingWindowCounterCmd.Flags().Float64("weight", 0.4, "The weight of the current window in the average calculation")
-
-	// Sliding window counter rate limit algorithm using Redis
-	rootCmd.AddCommand(redisSlidingWindowCounterCmd)
-	redisSlidingWindowCounterCmd.Flags().Int32("capacity", 60, "The maximum number of requests allowed in the time window")
-	redisSlidingWindowCounterCmd.Flags().Int32("duration", 60, "The duration of the window in seconds")
-	redisSlidingWindowCounterCmd.Flags().Float64("weight", 0.4, "The weight of the current window in the average calculation")
-	redisSlidingWindowCounterCmd.Flags().String("redisURL", "redis://localhost:6379/0", "The URL of the Redis server")
+	// In-flight limits, off when both maximums are zero
+	rootCmd.PersistentFlags().Int("maxInFlight", 0, "The maximum number of requests in flight over every client")
+	rootCmd.PersistentFlags().Int("maxInFlightPerKey", 0, "The maximum number of requests in flight per client IP")
+	rootCmd.PersistentFlags().Duration("queueTimeout", 0, "How long a request waits for an in-flight slot, zero declines it right away")
+	rootCmd.PersistentFlags().String("inFlightRedisURL", "", "The URL of a Redis server to share the in-flight limits, kept in memory when empty")
+	rootCmd.PersistentFlags().String("inFlightKeyPrefix", "", "The prefix of the Redis keys of the in-flight limits, the policy file name or the algorithm when empty")
+	rootCmd.PersistentFlags().Duration("leaseTTL", 30*time.Second, "How long the in-flight slots of a stopped server are held in Redis")
+
+	// Adaptive in-flight limit, learned from the latency and the 5xx of the requests between --minInFlight and --maxInFlight
+	rootCmd.PersistentFlags().String("adaptive", "", `Adapt the in-flight limit with "aimd" or "gradient", off when empty`)
+	rootCmd.PersistentFlags().Int("minInFlight", 1, "The lower bound of the adaptive in-flight limit")
+	rootCmd.PersistentFlags().Duration("latencyThreshold", 0, "AIMD: requests slower than this shrink the adaptive limit like failures")
+
+	// One subcommand per registered rate limit algorithm
+	for _, spec := range lib.Algorithms() {
+		rootCmd.AddCommand(algorithmCmd(spec))
+	}
 }
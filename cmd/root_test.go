@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/carantes/go-rate-limiter/lib"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/suite"
+)
+
+type rootCmdSuite struct {
+	suite.Suite
+}
+
+// parse returns the config given by the flags of an algorithm subcommand
+func (s *rootCmdSuite) parse(algorithm lib.Algorithm, args ...string) map[string]string {
+	spec, ok := lib.LookupAlgorithm(algorithm.String())
+	s.Require().True(ok)
+
+	cmd := algorithmCmd(spec)
+	s.Require().NoError(cmd.ParseFlags(args))
+
+	return flagConfig(cmd, spec)
+}
+
+func (s *rootCmdSuite) TestDurationFlag() {
+	// a plain number is read as seconds
+	config := s.parse(lib.FixedWindow, "--capacity", "2", "--duration", "60")
+	s.Equal("60", config["duration"])
+
+	clock := lib.NewFakeClock(time.Now())
+	rl, err := lib.NewRateLimiterWithClock(config, clock)
+	s.Require().NoError(err)
+	defer rl.Close()
+
+	ctx := context.Background()
+
+	_, err = rl.AllowN(ctx, "user", 2)
+	s.NoError(err)
+
+	// the window lasts a minute
+	clock.Advance(59 * time.Second)
+	_, err = rl.Allow(ctx, "user")
+	s.ErrorIs(err, lib.ErrRateLimited)
+
+	clock.Advance(time.Second)
+	_, err = rl.Allow(ctx, "user")
+	s.NoError(err)
+
+	// units are still accepted, an invalid duration is rejected by the config
+	config = s.parse(lib.FixedWindow, "--duration", "1m30s")
+	s.Equal("1m30s", config["duration"])
+
+	_, err = lib.NewRateLimiter(s.parse(lib.FixedWindow, "--duration", "soon"))
+	s.ErrorIs(err, lib.ErrInvalidConfig)
+}
+
+func (s *rootCmdSuite) TestDefaultFlags() {
+	config := s.parse(lib.FixedWindow)
+	s.Equal("1m", config["duration"])
+
+	rl, err := lib.NewRateLimiter(config)
+	s.Require().NoError(err)
+	s.NoError(rl.Close())
+}
+
+// inFlightCmd returns a command with the in-flight flags of the root command set to args
+func (s *rootCmdSuite) inFlightCmd(args ...string) *cobra.Command {
+	cmd := &cobra.Command{}
+	cmd.Flags().AddFlagSet(rootCmd.PersistentFlags())
+
+	// the flags are shared with the root command, they are set back to their defaults
+	s.T().Cleanup(func() {
+		rootCmd.PersistentFlags().VisitAll(func(f *pflag.Flag) {
+			_ = f.Value.Set(f.DefValue)
+			f.Changed = false
+		})
+	})
+
+	s.Require().NoError(cmd.ParseFlags(args))
+
+	return cmd
+}
+
+func (s *rootCmdSuite) TestInFlightKeyPrefix() {
+	redis := miniredis.RunT(s.T())
+	ctx := context.Background()
+
+	// the leases are named after the policy or the algorithm of the server
+	cl, err := newConcurrencyLimiter(s.inFlightCmd("--maxInFlight", "1", "--inFlightRedisURL", "redis://"+redis.Addr()), "policy")
+	s.Require().NoError(err)
+	defer cl.Close()
+
+	_, err = cl.Acquire(ctx, "user")
+	s.NoError(err)
+	s.ElementsMatch([]string{"policy:inflight:user", "policy:inflight"}, redis.Keys())
+
+	// the flag overrides the name
+	redis.FlushAll()
+
+	cl, err = newConcurrencyLimiter(s.inFlightCmd("--maxInFlight", "1", "--inFlightRedisURL", "redis://"+redis.Addr(), "--inFlightKeyPrefix", "shared"), "policy")
+	s.Require().NoError(err)
+	defer cl.Close()
+
+	_, err = cl.Acquire(ctx, "user")
+	s.NoError(err)
+	s.ElementsMatch([]string{"shared:inflight:user", "shared:inflight"}, redis.Keys())
+}
+
+func TestRootCmdSuite(t *testing.T) {
+	suite.Run(t, new(rootCmdSuite))
+}
@@ -1,8 +1,16 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/carantes/go-rate-limiter/lib"
@@ -10,58 +18,318 @@ import (
 )
 
 type server struct {
-	e *gin.Engine
+	e             *gin.Engine
+	limits        []*serverLimit
+	inFlight      lib.ConcurrencyLimiter // caps the requests in flight per client IP and in total, nil when off
+	stopSnapshots func() error           // saves the last snapshot of the limits, nil when their state is not persisted
 }
 
-func rateLimitMiddleware(config map[string]string) gin.HandlerFunc {
+// serverLimit is a limit of the policy with its rate limiter
+type serverLimit struct {
+	lib.PolicyLimit
+	rl     lib.RateLimiter
+	header string       // request header holding the user key, the client IP is used when empty
+	parent *serverLimit // enclosing limit, its key prefixes the key of this limit
+}
 
-	rl, err := lib.NewRateLimiter(config)
+// key returns the user a request is counted for, requests without the header fall back to the client IP.
+// Nested limits count the user within its parent, e.g. "<tenant>/<user>"
+func (l *serverLimit) key(c *gin.Context) string {
+	key := c.ClientIP()
 
-	if err != nil {
-		panic(err)
+	switch {
+	case l.Global():
+		key = lib.GlobalKey(key)
+	case l.header != "" && c.GetHeader(l.header) != "":
+		key = c.GetHeader(l.header)
+	}
+
+	if l.parent != nil {
+		return l.parent.key(c) + "/" + key
 	}
 
+	return key
+}
+
+// Define rate limit headers
+func setRateLimitHeaders(c *gin.Context, stats lib.Stats) {
+	c.Header("X-RateLimit-Algorithm", stats.Algorithm)
+	c.Header("X-RateLimit-Limit", strconv.Itoa(stats.Capacity))
+	c.Header("X-RateLimit-Remaining", strconv.Itoa(stats.Remaining))
+
+	// TODO: Change this to be the number of seconds to reset, not the time
+	c.Header("X-RateLimit-Reset", stats.Reset.Format(time.RFC3339))
+}
+
+// rateLimitMiddleware checks the request against every limit of its route as one decision, in the policy order.
+// A denied request consumes no tokens, the X-RateLimit-Scope header names the limit that denied it.
+// The headers describe the limit with the fewest remaining tokens
+func rateLimitMiddleware(limits []*serverLimit) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		var keyed []lib.KeyedLimit
+
+		for _, l := range limits {
+			if l.Applies(c.FullPath()) {
+				keyed = append(keyed, lib.KeyedLimit{Name: l.Name, Limiter: l.rl, Key: l.key(c)})
+			}
+		}
+
+		if len(keyed) == 0 {
+			c.Next()
+			return
+		}
+
 		// Rate limit check
-		userID := c.ClientIP()
-		stats, err := rl.Allow(userID)
+		stats, err := lib.AllowAll(c.Request.Context(), keyed, 1)
+
+		var rlErr *lib.RateLimitError
 
-		if err != nil {
+		switch {
+		case errors.Is(err, lib.ErrRateLimited) && errors.As(err, &rlErr):
+			setRateLimitHeaders(c, rlErr.Stats)
+			c.Header("X-RateLimit-Scope", rlErr.LimitName)
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(rlErr.RetryAfter.Seconds()))))
 			c.AbortWithStatus(429)
 			return
+
+		// the client went away or the backend did not answer in time
+		case errors.Is(err, lib.ErrBackendUnavailable), errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+			c.AbortWithStatus(503)
+			return
+
+		case err != nil:
+			c.AbortWithStatus(500)
+			return
 		}
 
-		fmt.Printf("[user]: %s [algorithm]: %s, [capacity] %d, [remaining] %d \n", userID, stats.Algorithm, stats.Capacity, stats.Remaining)
+		fmt.Printf("[user]: %s [limits]: %d [algorithm]: %s, [capacity] %d, [remaining] %d \n", keyed[len(keyed)-1].Key, len(keyed), stats.Algorithm, stats.Capacity, stats.Remaining)
 
-		// Define rate limit headers
-		c.Header("X-RateLimit-Algorithm", stats.Algorithm)
-		c.Header("X-RateLimit-Limit", strconv.Itoa(stats.Capacity))
-		c.Header("X-RateLimit-Remaining", strconv.Itoa(stats.Remaining))
+		setRateLimitHeaders(c, stats)
 
-		// TODO: Change this to be the number of seconds to reset, not the time
-		c.Header("X-RateLimit-Reset", stats.Reset.Format(time.RFC3339))
+		c.Next()
+	}
+}
+
+// concurrencyMiddleware holds an in-flight slot of the client IP until the handler returns, even when it panics.
+// A request that finds every slot taken gets a 429, the X-RateLimit-Scope header names the full limit.
+// Adaptive limiters learn from the outcome: a handler that panics or answers with a 5xx counts as a failure
+func concurrencyMiddleware(cl lib.ConcurrencyLimiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		done, err := acquireSlot(c, cl)
+
+		var rlErr *lib.RateLimitError
+
+		switch {
+		case errors.Is(err, lib.ErrRateLimited) && errors.As(err, &rlErr):
+			c.Header("X-RateLimit-Scope", rlErr.LimitName)
+			c.AbortWithStatus(429)
+			return
+
+		// the client went away while queued or the backend did not answer in time
+		case errors.Is(err, lib.ErrBackendUnavailable), errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+			c.AbortWithStatus(503)
+			return
+
+		case err != nil:
+			c.AbortWithStatus(500)
+			return
+		}
+
+		finished := false
+
+		defer func() {
+			done(!finished || c.Writer.Status() >= 500)
+		}()
 
 		c.Next()
+
+		finished = true
+	}
+}
+
+// acquireSlot takes an in-flight slot for the client IP, the outcome of the request is only used by adaptive limiters
+func acquireSlot(c *gin.Context, cl lib.ConcurrencyLimiter) (done func(failed bool), err error) {
+	if al, ok := cl.(lib.AdaptiveLimiter); ok {
+		return al.AcquireTracked(c.Request.Context(), c.ClientIP())
+	}
+
+	release, err := cl.Acquire(c.Request.Context(), c.ClientIP())
+
+	if err != nil {
+		return nil, err
+	}
+
+	return func(bool) { release() }, nil
+}
+
+// Run serves until the process is interrupted, the rate limiters are closed once the requests in flight are done
+func (s *server) Run(addr string) error {
+	defer s.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	srv := &http.Server{Addr: addr, Handler: s.e}
+	errc := make(chan error, 1)
+
+	go func() {
+		errc <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	return srv.Shutdown(shutdownCtx)
+}
+
+// PersistState restores the users of the in-memory limits from the state file and saves them to it every interval.
+// Limits that keep their state elsewhere, e.g. in Redis, are not part of the file. The last snapshot is saved by Close
+func (s *server) PersistState(path string, interval time.Duration) error {
+	limiters := make(map[string]lib.Snapshotter, len(s.limits))
+
+	for _, l := range s.limits {
+		if sn, ok := l.rl.(lib.Snapshotter); ok {
+			limiters[l.Name] = sn
+		}
+	}
+
+	// a limit whose algorithm changed in the policy starts empty, its users are saved again by the next snapshot
+	group := lib.NewSnapshotGroup(limiters, func(err error) {
+		log.Printf("rate limiter snapshot not restored: %v", err)
+	})
+
+	if err := lib.LoadSnapshot(group, path); err != nil {
+		return err
 	}
+
+	s.stopSnapshots = lib.StartSnapshots(group, path, interval, func(err error) {
+		log.Printf("rate limiter snapshot failed: %v", err)
+	})
+
+	return nil
 }
 
-func (s *server) Run(addr string) {
-	s.e.Run(addr)
+// Close saves the last snapshot of the limits and releases the rate limiters of the server
+func (s *server) Close() {
+	if s.stopSnapshots != nil {
+		if err := s.stopSnapshots(); err != nil {
+			log.Printf("rate limiter snapshot failed: %v", err)
+		}
+	}
+
+	for _, l := range s.limits {
+		l.rl.Close()
+	}
+
+	if s.inFlight != nil {
+		s.inFlight.Close()
+	}
 }
 
-func NewServer(config map[string]string) *server {
+// NewServer creates a server with a single limit on /limited, built from the command line flags.
+// The concurrency limiter is optional, see NewServerFromPolicy
+func NewServer(config map[string]string, inFlight lib.ConcurrencyLimiter) (*server, error) {
+	params := make(map[string]any, len(config))
+
+	for key, value := range config {
+		if key != "algorithm" {
+			params[key] = value
+		}
+	}
+
+	p := &lib.Policy{
+		Limits: []lib.PolicyLimit{{
+			Name:      config["algorithm"],
+			Algorithm: config["algorithm"],
+			Routes:    []string{"/limited"},
+			Params:    params,
+		}},
+	}
+
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+
+	return NewServerFromPolicy(p, inFlight)
+}
+
+// NewServerFromPolicy creates a server that applies every limit of the policy to its routes.
+// When a concurrency limiter is given, it also caps the requests in flight on the same routes
+func NewServerFromPolicy(p *lib.Policy, inFlight lib.ConcurrencyLimiter) (*server, error) {
+	limiters, err := lib.NewPolicyLimiters(p, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	s := &server{inFlight: inFlight}
+	byName := make(map[string]*serverLimit, len(p.Limits))
+
+	// parents are defined before their children
+	for _, l := range p.Limits {
+		sl := &serverLimit{PolicyLimit: l, rl: limiters[l.Name], header: l.Header(), parent: byName[l.Parent]}
+		byName[l.Name] = sl
+		s.limits = append(s.limits, sl)
+	}
+
 	r := gin.Default()
 
-	// Unlimited requests, have fun
-	r.GET("/unlimited", func(c *gin.Context) {
+	// Remaining quota of the caller for every limit, does not consume tokens
+	r.GET("/status", func(c *gin.Context) {
+		status := make(map[string]lib.Stats, len(s.limits))
+
+		for _, l := range s.limits {
+			stats, err := l.rl.Peek(c.Request.Context(), l.key(c))
+
+			if err != nil {
+				c.AbortWithStatus(503)
+				return
+			}
+
+			status[l.Name] = stats
+		}
+
+		c.IndentedJSON(200, status)
+	})
+
+	// Current limit of an adaptive concurrency limiter and the latencies it is based on
+	if al, ok := inFlight.(lib.AdaptiveLimiter); ok {
+		r.GET("/concurrency", func(c *gin.Context) {
+			c.IndentedJSON(200, al.Stats())
+		})
+	}
+
+	limited := r.Group("/", rateLimitMiddleware(s.limits))
+
+	if inFlight != nil {
+		limited.Use(concurrencyMiddleware(inFlight))
+	}
+
+	// Unlimited requests unless a limit of the policy applies to every route, have fun
+	limited.GET("/unlimited", func(c *gin.Context) {
 		c.IndentedJSON(200, gin.H{"message": "Unlimited, have fun!"})
 	})
 
-	r.GET("/limited", rateLimitMiddleware(config), func(c *gin.Context) {
+	limited.GET("/limited", func(c *gin.Context) {
 		c.IndentedJSON(200, gin.H{"message": "Limited, dont over use me!"})
 	})
 
-	return &server{
-		e: r,
-	}
+	// Slow requests, to see the in-flight limits at work
+	limited.GET("/slow", func(c *gin.Context) {
+		select {
+		case <-time.After(2 * time.Second):
+			c.IndentedJSON(200, gin.H{"message": "Slow, sorry for the wait!"})
+		case <-c.Request.Context().Done():
+		}
+	})
+
+	s.e = r
+
+	return s, nil
 }
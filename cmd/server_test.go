@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/carantes/go-rate-limiter/lib"
+	"github.com/stretchr/testify/suite"
+)
+
+type serverSuite struct {
+	suite.Suite
+	stateFile string
+}
+
+func (s *serverSuite) SetupTest() {
+	s.stateFile = filepath.Join(s.T().TempDir(), "state.json")
+}
+
+// newServer creates a server with a single limit named api
+func (s *serverSuite) newServer(algorithm string, params string) *server {
+	p, err := lib.ParsePolicy([]byte(`{"limits": [{"name": "api", "algorithm": "`+algorithm+`", "routes": ["/limited"], "params": `+params+`}]}`), "json")
+	s.Require().NoError(err)
+
+	srv, err := NewServerFromPolicy(p, nil)
+	s.Require().NoError(err)
+
+	return srv
+}
+
+func (s *serverSuite) TestPersistStateAlgorithmChanged() {
+	srv := s.newServer(lib.TokenBucket.String(), `{"capacity": 10, "refillRate": 1}`)
+	s.Require().NoError(srv.PersistState(s.stateFile, time.Hour))
+	srv.Close()
+
+	// the limit changed algorithm in the policy, the server still starts
+	srv = s.newServer(lib.FixedWindow.String(), `{"capacity": 10, "duration": "1m"}`)
+	defer srv.Close()
+
+	s.NoError(srv.PersistState(s.stateFile, time.Hour))
+}
+
+func (s *serverSuite) TestPersistStateUnreadable() {
+	s.Require().NoError(os.WriteFile(s.stateFile, []byte("not json"), 0o600))
+
+	srv := s.newServer(lib.TokenBucket.String(), `{"capacity": 10, "refillRate": 1}`)
+	defer srv.Close()
+
+	s.ErrorIs(srv.PersistState(s.stateFile, time.Hour), lib.ErrInvalidSnapshot)
+}
+
+func TestServerSuite(t *testing.T) {
+	suite.Run(t, new(serverSuite))
+}
@@ -0,0 +1,197 @@
+package lib
+
+import (
+	"context"
+	"time"
+
+	"github.com/carantes/go-rate-limiter/lib/internal/algorithms"
+)
+
+// Config is the typed configuration of a rate limiter, see NewRateLimiterFromConfig.
+// Args holds the typed arguments of the algorithm, e.g. TokenBucketArgs
+type Config = algorithms.Config
+
+// Args are the typed arguments of a built-in algorithm, every XArgs type below
+type Args = algorithms.Args
+
+// Typed arguments of each algorithm, each one has a Validate method
+type (
+	TokenBucketArgs                = algorithms.TokenBucketArgs
+	FixedWindowArgs                = algorithms.FixedWindowArgs
+	SlidingWindowLogArgs           = algorithms.SlidingWindowLogArgs
+	SlidingWindowCounterArgs       = algorithms.SlidingWindowCounterArgs
+	RedisSlidingWindowCounterArgs  = algorithms.RedisSlidingWindowCounterArgs
+	LeakyBucketArgs                = algorithms.LeakyBucketArgs
+	GCRAArgs                       = algorithms.GCRAArgs
+	RedisGCRAArgs                  = algorithms.RedisGCRAArgs
+	BucketedSlidingWindowArgs      = algorithms.BucketedSlidingWindowArgs
+	RedisBucketedSlidingWindowArgs = algorithms.RedisBucketedSlidingWindowArgs
+	MemoryArgs                     = algorithms.MemoryArgs
+	MultiLimiterArgs               = algorithms.MultiLimiterArgs
+	NamedLimiter                   = algorithms.NamedLimiter
+	KeyedLimit                     = algorithms.KeyedLimit
+	ConcurrencyArgs                = algorithms.ConcurrencyArgs
+	RedisConcurrencyArgs           = algorithms.RedisConcurrencyArgs
+	AdaptiveArgs                   = algorithms.AdaptiveArgs
+)
+
+// NewTokenBucketLimiter creates a token bucket rate limiter
+func NewTokenBucketLimiter(args TokenBucketArgs) RateLimiter {
+	return algorithms.NewTokenBucketLimiter(args)
+}
+
+// NewFixedWindowLimiter creates a fixed window rate limiter
+func NewFixedWindowLimiter(args FixedWindowArgs) RateLimiter {
+	return algorithms.NewFixedWindowLimiter(args)
+}
+
+// NewSlidingWindowLogLimiter creates a sliding window log rate limiter
+func NewSlidingWindowLogLimiter(args SlidingWindowLogArgs) RateLimiter {
+	return algorithms.NewSlidingWindowLogLimiter(args)
+}
+
+// NewSlidingWindowCounterLimiter creates an in-memory sliding window counter rate limiter
+func NewSlidingWindowCounterLimiter(args SlidingWindowCounterArgs) RateLimiter {
+	return algorithms.NewSlidingWindowCounterLimiter(args)
+}
+
+// NewRedisSlidingWindowCounterLimiter creates a sliding window counter rate limiter that stores its data in Redis
+func NewRedisSlidingWindowCounterLimiter(args RedisSlidingWindowCounterArgs) RateLimiter {
+	return algorithms.NewRedisSlidingWindowCounterLimiter(args)
+}
+
+// NewLeakyBucketLimiter creates a leaky bucket rate limiter, as a meter or as a queue that releases requests at a constant rate
+func NewLeakyBucketLimiter(args LeakyBucketArgs) RateLimiter {
+	return algorithms.NewLeakyBucketLimiter(args)
+}
+
+// NewGCRALimiter creates a GCRA rate limiter, a token bucket that keeps one timestamp per user
+func NewGCRALimiter(args GCRAArgs) RateLimiter {
+	return algorithms.NewGCRALimiter(args)
+}
+
+// NewRedisGCRALimiter creates a GCRA rate limiter that stores its data in Redis
+func NewRedisGCRALimiter(args RedisGCRAArgs) RateLimiter {
+	return algorithms.NewRedisGCRALimiter(args)
+}
+
+// NewBucketedSlidingWindowLimiter creates a sliding window rate limiter that counts the requests in buckets
+func NewBucketedSlidingWindowLimiter(args BucketedSlidingWindowArgs) RateLimiter {
+	return algorithms.NewBucketedSlidingWindowLimiter(args)
+}
+
+// NewRedisBucketedSlidingWindowLimiter creates a bucketed sliding window rate limiter that stores its data in Redis
+func NewRedisBucketedSlidingWindowLimiter(args RedisBucketedSlidingWindowArgs) RateLimiter {
+	return algorithms.NewRedisBucketedSlidingWindowLimiter(args)
+}
+
+// SlidingWindowCounterMode is how a sliding window counter weights the previous window
+type SlidingWindowCounterMode = algorithms.SlidingWindowCounterMode
+
+const (
+	SlidingWindowWeighted     = algorithms.SlidingWindowWeighted
+	SlidingWindowInterpolated = algorithms.SlidingWindowInterpolated
+)
+
+// RejectedPolicy is whether the declined requests count against the window of a sliding window log
+type RejectedPolicy = algorithms.RejectedPolicy
+
+const (
+	RejectedIgnored = algorithms.RejectedIgnored
+	RejectedCounted = algorithms.RejectedCounted
+)
+
+// LeakyBucketMode is the form of the leaky bucket
+type LeakyBucketMode = algorithms.LeakyBucketMode
+
+const (
+	LeakyBucketMeter = algorithms.LeakyBucketMeter
+	LeakyBucketQueue = algorithms.LeakyBucketQueue
+)
+
+// NewMultiLimiter creates a rate limiter that checks every limit as one all or nothing decision.
+// A denied request consumes no tokens and the error names the limit that denied it in LimitName.
+// The stats of an allowed request are the ones of the most restrictive limit
+func NewMultiLimiter(args MultiLimiterArgs) (RateLimiter, error) {
+	if err := args.Validate(); err != nil {
+		return nil, err
+	}
+
+	return algorithms.NewMultiLimiter(args), nil
+}
+
+// AllowAll checks a request against limits that count it under their own key, e.g. the user, its tenant
+// and the whole server. It is all or nothing like the multi limiter, the error names the limit that denied it
+func AllowAll(ctx context.Context, limits []KeyedLimit, n int) (Stats, error) {
+	return algorithms.AllowAll(ctx, limits, n)
+}
+
+// GlobalKey counts every user under the same key, use it as the Key of a limit shared by the whole server
+func GlobalKey(user string) string {
+	return algorithms.GlobalKey(user)
+}
+
+// ParentKey counts a user under the part of its key before the last "/", e.g. the tenant "acme" of "acme/alice"
+func ParentKey(user string) string {
+	return algorithms.ParentKey(user)
+}
+
+// NewConcurrencyLimiter creates an in-memory concurrency limiter, it caps the requests in flight per key and in total
+func NewConcurrencyLimiter(args ConcurrencyArgs) (ConcurrencyLimiter, error) {
+	if err := args.Validate(); err != nil {
+		return nil, err
+	}
+
+	return algorithms.NewConcurrencyLimiter(args), nil
+}
+
+// NewRedisConcurrencyLimiter creates a concurrency limiter shared by several servers through Redis.
+// Each slot is a lease renewed while the request is in flight, the slots of a crashed server expire after the lease TTL
+func NewRedisConcurrencyLimiter(args RedisConcurrencyArgs) (ConcurrencyLimiter, error) {
+	if err := args.Validate(); err != nil {
+		return nil, err
+	}
+
+	return algorithms.NewRedisConcurrencyLimiter(args), nil
+}
+
+// AdaptiveAlgorithm is the algorithm that moves the limit of an adaptive limiter
+type AdaptiveAlgorithm = algorithms.AdaptiveAlgorithm
+
+const (
+	AdaptiveAIMD     = algorithms.AdaptiveAIMD
+	AdaptiveGradient = algorithms.AdaptiveGradient
+)
+
+// NewAdaptiveLimiter creates a concurrency limiter that learns its limit from the latency and the failures of the requests.
+// Take slots with AcquireTracked and report how each request ended, Stats shows the current limit
+func NewAdaptiveLimiter(args AdaptiveArgs) (AdaptiveLimiter, error) {
+	if err := args.Validate(); err != nil {
+		return nil, err
+	}
+
+	return algorithms.NewAdaptiveLimiter(args), nil
+}
+
+// NewSnapshotGroup returns a Snapshotter that saves several rate limiters in one snapshot, by name, e.g. the limits of a policy.
+// Limits that cannot be restored start empty and their errors are passed to onError when it is not nil
+func NewSnapshotGroup(limiters map[string]Snapshotter, onError func(error)) Snapshotter {
+	return algorithms.NewSnapshotGroup(limiters, onError)
+}
+
+// SaveSnapshot writes the users of a rate limiter to a file, the previous file is replaced at once
+func SaveSnapshot(s Snapshotter, path string) error {
+	return algorithms.SaveSnapshot(s, path)
+}
+
+// LoadSnapshot restores the users of a rate limiter from a file, users back to full by now are discarded.
+// A missing file restores nothing, a snapshot of another algorithm or format version fails with ErrInvalidSnapshot
+func LoadSnapshot(s Snapshotter, path string) error {
+	return algorithms.LoadSnapshot(s, path)
+}
+
+// StartSnapshots saves the users of a rate limiter to a file every interval.
+// Call the returned stop on shutdown, it ends the periodic saves and saves a last snapshot
+func StartSnapshots(s Snapshotter, path string, interval time.Duration, onError func(error)) (stop func() error) {
+	return algorithms.StartSnapshots(s, path, interval, onError)
+}
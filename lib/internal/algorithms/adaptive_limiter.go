@@ -0,0 +1,306 @@
+package algorithms
+
+/*
+Adaptive Concurrency Limiter
+A concurrency limiter whose limit on the requests in flight is not configured but learned from the requests, in the
+style of Netflix concurrency-limits. Each request reports its latency and whether it failed when it ends, and the
+limit moves between a minimum and a maximum:
+
+- AIMD (additive increase, multiplicative decrease) adds one to the limit after each successful request while
+the limit is in use, and multiplies it by the backoff ratio after a failure or a request slower than the latency threshold.
+- Gradient compares the latency of each request to the long-term average latency. While they stay close the limit
+grows by its square root, when requests get slower than the tolerance allows the limit shrinks in proportion.
+
+The limit applies to the requests in flight over every key, it only grows while at least half of it is in use.
+*/
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/carantes/go-rate-limiter/lib/internal/interfaces"
+)
+
+// AdaptiveAlgorithm is the algorithm that moves the limit of an adaptive limiter
+type AdaptiveAlgorithm string
+
+const (
+	AdaptiveAIMD     AdaptiveAlgorithm = "aimd"     // additive increase, multiplicative decrease, the default
+	AdaptiveGradient AdaptiveAlgorithm = "gradient" // follows the ratio between the long-term and the current latency
+)
+
+// default settings of the adaptive algorithms
+const (
+	defaultBackoffRatio = 0.9
+	defaultTolerance    = 1.5
+	defaultSmoothing    = 0.2
+)
+
+// number of requests averaged by the long-term latency of the gradient algorithm, the default of Netflix concurrency-limits
+const baselineWindow = 600
+
+// weight of each request in the long-term average latency
+const baselineWeight = 2.0 / (baselineWindow + 1)
+
+// bounds of the gradient, a slow request at most halves the limit
+const (
+	minGradient = 0.5
+	maxGradient = 1.0
+)
+
+// adaptiveLimiter implements the AdaptiveLimiter interface
+type adaptiveLimiter struct {
+	clock            interfaces.Clock
+	algorithm        AdaptiveAlgorithm
+	minLimit         int
+	maxLimit         int
+	queueTimeout     time.Duration
+	latencyThreshold time.Duration
+	backoffRatio     float64
+	tolerance        float64
+	smoothing        float64
+
+	mu       sync.Mutex
+	limit    float64 // kept fractional so that small changes add up, the integer part is enforced
+	perKey   map[string]int
+	total    int
+	latency  time.Duration
+	baseline float64       // long-term average latency in nanoseconds, zero before the first request
+	changed  chan struct{} // closed and replaced when a slot is released or the limit changes, wakes up the waiters
+}
+
+type AdaptiveArgs struct {
+	Algorithm        AdaptiveAlgorithm // aimd or gradient, defaults to aimd
+	InitialLimit     int               // limit before the first request ends, defaults to MinLimit
+	MinLimit         int               // the limit never goes below, defaults to one
+	MaxLimit         int               // the limit never goes above
+	QueueTimeout     time.Duration     // how long Acquire waits for a free slot, zero declines the request right away
+	LatencyThreshold time.Duration     // AIMD: slower requests count as failures, zero only counts the reported failures
+	BackoffRatio     float64           // AIMD: the limit is multiplied by it after a failure, defaults to 0.9
+	Tolerance        float64           // Gradient: how much slower than the long-term latency requests can be before the limit shrinks, defaults to 1.5
+	Smoothing        float64           // Gradient: how fast the limit moves towards its new value, between 0 and 1, defaults to 0.2
+	Clock            interfaces.Clock  // source of time of the latencies, defaults to the system clock
+}
+
+func (a AdaptiveArgs) Validate() error {
+	switch a.Algorithm {
+	case "", AdaptiveAIMD, AdaptiveGradient:
+	default:
+		return interfaces.NewFieldError("algorithm", fmt.Sprintf(`Invalid adaptive limit config "algorithm", %q is not "aimd" or "gradient"`, a.Algorithm))
+	}
+
+	if err := validatePositive("maxLimit", a.MaxLimit); err != nil {
+		return err
+	}
+
+	if err := validateNotNegative("minLimit", a.MinLimit); err != nil {
+		return err
+	}
+
+	if a.MinLimit > a.MaxLimit {
+		return interfaces.NewFieldError("minLimit", `Invalid adaptive limit config "minLimit", must not be greater than "maxLimit"`)
+	}
+
+	if a.InitialLimit != 0 && (a.InitialLimit < a.MinLimit || a.InitialLimit > a.MaxLimit) {
+		return interfaces.NewFieldError("initialLimit", `Invalid adaptive limit config "initialLimit", must be between "minLimit" and "maxLimit"`)
+	}
+
+	if err := validateNotNegative("queueTimeout", a.QueueTimeout); err != nil {
+		return err
+	}
+
+	if err := validateNotNegative("latencyThreshold", a.LatencyThreshold); err != nil {
+		return err
+	}
+
+	if !(a.BackoffRatio >= 0 && a.BackoffRatio < 1) {
+		return interfaces.NewFieldError("backoffRatio", `Invalid adaptive limit config "backoffRatio", must be between 0 and 1`)
+	}
+
+	if !(a.Tolerance == 0 || a.Tolerance >= 1) {
+		return interfaces.NewFieldError("tolerance", `Invalid adaptive limit config "tolerance", must be 1 or more`)
+	}
+
+	if !(a.Smoothing >= 0 && a.Smoothing <= 1) {
+		return interfaces.NewFieldError("smoothing", `Invalid adaptive limit config "smoothing", must be between 0 and 1`)
+	}
+
+	return nil
+}
+
+// Concurrency Limiter Constructor
+func NewAdaptiveLimiter(args AdaptiveArgs) interfaces.AdaptiveLimiter {
+	l := &adaptiveLimiter{
+		clock:            interfaces.ClockOrDefault(args.Clock),
+		algorithm:        args.Algorithm,
+		minLimit:         max(args.MinLimit, 1),
+		maxLimit:         args.MaxLimit,
+		queueTimeout:     args.QueueTimeout,
+		latencyThreshold: args.LatencyThreshold,
+		backoffRatio:     args.BackoffRatio,
+		tolerance:        args.Tolerance,
+		smoothing:        args.Smoothing,
+		perKey:           make(map[string]int),
+		changed:          make(chan struct{}),
+	}
+
+	if l.algorithm == "" {
+		l.algorithm = AdaptiveAIMD
+	}
+
+	if l.backoffRatio == 0 {
+		l.backoffRatio = defaultBackoffRatio
+	}
+
+	if l.tolerance == 0 {
+		l.tolerance = defaultTolerance
+	}
+
+	if l.smoothing == 0 {
+		l.smoothing = defaultSmoothing
+	}
+
+	l.limit = float64(max(args.InitialLimit, l.minLimit))
+
+	return l
+}
+
+func (l *adaptiveLimiter) Acquire(ctx context.Context, key string) (func(), error) {
+	done, err := l.AcquireTracked(ctx, key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return func() { done(false) }, nil
+}
+
+func (l *adaptiveLimiter) AcquireTracked(ctx context.Context, key string) (func(failed bool), error) {
+	var done func(failed bool)
+
+	_, err := acquireSlot(ctx, l.clock, l.queueTimeout, func() (func(), <-chan struct{}, error) {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		if err := concurrencyError(string(l.algorithm), 0, l.total, 0, int(l.limit)); err != nil {
+			return nil, l.changed, err
+		}
+
+		l.perKey[key]++
+		l.total++
+
+		start := l.clock.Now()
+		var once sync.Once
+
+		done = func(failed bool) {
+			once.Do(func() { l.release(key, l.clock.Now().Sub(start), failed) })
+		}
+
+		return func() {}, nil, nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return done, nil
+}
+
+func (l *adaptiveLimiter) InFlight(ctx context.Context, key string) (int, int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.perKey[key], l.total, nil
+}
+
+func (l *adaptiveLimiter) Stats() interfaces.AdaptiveLimiterStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return interfaces.AdaptiveLimiterStats{
+		Algorithm:       string(l.algorithm),
+		Limit:           int(l.limit),
+		MinLimit:        l.minLimit,
+		MaxLimit:        l.maxLimit,
+		InFlight:        l.total,
+		Latency:         l.latency,
+		BaselineLatency: time.Duration(l.baseline),
+	}
+}
+
+func (l *adaptiveLimiter) Close() error {
+	return nil
+}
+
+// release gives a slot of the key back, moves the limit with the outcome of the request and wakes up the waiters
+func (l *adaptiveLimiter) release(key string, latency time.Duration, failed bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// the request is still counted, the limit is in use when the requests in flight fill at least half of it
+	inUse := float64(l.total)*2 >= l.limit
+
+	switch l.algorithm {
+	case AdaptiveGradient:
+		l.limit = l.gradientLimit(latency, failed, inUse)
+	default:
+		l.limit = l.aimdLimit(latency, failed, inUse)
+	}
+
+	l.limit = min(max(l.limit, float64(l.minLimit)), float64(l.maxLimit))
+	l.latency = latency
+
+	if l.perKey[key]--; l.perKey[key] <= 0 {
+		delete(l.perKey, key)
+	}
+
+	l.total--
+
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// aimdLimit adds one to the limit after a success while it is in use, and backs off after a failure
+func (l *adaptiveLimiter) aimdLimit(latency time.Duration, failed bool, inUse bool) float64 {
+	if failed || (l.latencyThreshold > 0 && latency > l.latencyThreshold) {
+		return math.Floor(l.limit * l.backoffRatio)
+	}
+
+	if inUse {
+		return l.limit + 1
+	}
+
+	return l.limit
+}
+
+// gradientLimit moves the limit towards limit * gradient + sqrt(limit), where the gradient is the ratio between
+// the tolerated long-term latency and the latency of the request. A failure counts as the smallest gradient
+func (l *adaptiveLimiter) gradientLimit(latency time.Duration, failed bool, inUse bool) float64 {
+	if l.baseline == 0 {
+		l.baseline = float64(latency)
+	}
+
+	l.baseline = l.baseline*(1-baselineWeight) + float64(latency)*baselineWeight
+
+	// the latency says nothing about the limit when it is not in use
+	if !failed && !inUse {
+		return l.limit
+	}
+
+	gradient := minGradient
+
+	if !failed && latency > 0 {
+		gradient = min(max(l.tolerance*l.baseline/float64(latency), minGradient), maxGradient)
+	}
+
+	target := l.limit*gradient + math.Sqrt(l.limit)
+
+	return l.limit*(1-l.smoothing) + target*l.smoothing
+}
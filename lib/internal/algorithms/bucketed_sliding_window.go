@@ -0,0 +1,794 @@
+package algorithms
+
+/*
+Bucketed Sliding Window
+The window is split into a number of buckets of equal width, aligned to multiples of the width, e.g. 60 buckets of
+one second for a window of one minute. Each bucket counts the requests made during its time and the window sums the
+current bucket and the ones before it. A request leaves the window with its bucket, between duration - width and
+duration after it was made, so the number of buckets trades memory for precision: one bucket is a fixed window and
+more buckets get closer to the sliding window log, at one counter per bucket instead of one timestamp per request.
+Reserved requests are counted in the bucket of the time they are ready, even when it is ahead of the current one.
+*/
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/carantes/go-rate-limiter/lib/internal/interfaces"
+	"github.com/carantes/go-rate-limiter/lib/internal/utils"
+)
+
+// bucketedWindowLimiter implements the RateLimiter interface
+type bucketedWindowLimiter struct {
+	clock           interfaces.Clock
+	usersMap        *utils.ShardedMap[*userBucketedWindow] // users state, safe for concurrent use
+	defaultCapacity int
+	defaultWidth    time.Duration
+	buckets         int
+	stopJanitor     func() // stops the background cleanup
+}
+
+// redisBucketedWindowLimiter implements the RateLimiter interface, users are stored in Redis
+type redisBucketedWindowLimiter struct {
+	clock           interfaces.Clock
+	redisClient     *utils.RedisClient
+	keyPrefix       string // prefix of the Redis keys of the users
+	defaultCapacity int
+	defaultWidth    time.Duration
+	buckets         int
+}
+
+// userBucketedWindow is the state of a user, shared by the in-memory and the Redis limiters
+type userBucketedWindow struct {
+	Counts   []int         // requests per bucket, indexed by bucket number modulo the number of buckets
+	Reserved map[int64]int `json:",omitempty"` // requests reserved in the buckets after the current one, by bucket number
+	Bucket   int64         // number of the current bucket, its start time divided by the width
+	Total    int           // requests counted in the window, reserved ones included
+	Capacity int           // maximum number of requests in the window
+	Width    time.Duration // width of a bucket, the duration divided by the number of buckets
+
+	algorithm interfaces.Algorithm // variant reported in the stats, not stored
+}
+
+type BucketedSlidingWindowArgs struct {
+	MemoryArgs
+	Capacity int
+	Duration time.Duration    // window size, e.g. 1 * time.Minute
+	Buckets  int              // number of buckets the window is split into, more buckets are more precise
+	Clock    interfaces.Clock // source of time, defaults to the system clock
+}
+
+type RedisBucketedSlidingWindowArgs struct {
+	RedisURL  string
+	KeyPrefix string // prefix of the Redis keys, limits sharing a Redis server need different prefixes
+	Capacity  int
+	Duration  time.Duration    // window size, e.g. 1 * time.Minute
+	Buckets   int              // number of buckets the window is split into, more buckets are more precise
+	Clock     interfaces.Clock // source of time, defaults to the system clock
+}
+
+func (a BucketedSlidingWindowArgs) Validate() error {
+	if err := validateBucketedWindow(a.Capacity, a.Duration, a.Buckets); err != nil {
+		return err
+	}
+
+	return a.MemoryArgs.Validate()
+}
+
+func (a BucketedSlidingWindowArgs) algorithm() interfaces.Algorithm {
+	return interfaces.BucketedSlidingWindow
+}
+
+func (a BucketedSlidingWindowArgs) newLimiter(clock interfaces.Clock) interfaces.RateLimiter {
+	a.Clock = clockOr(a.Clock, clock)
+
+	return NewBucketedSlidingWindowLimiter(a)
+}
+
+func (a RedisBucketedSlidingWindowArgs) Validate() error {
+	if err := validateBucketedWindow(a.Capacity, a.Duration, a.Buckets); err != nil {
+		return err
+	}
+
+	if err := utils.ValidateRedisURL(a.RedisURL); err != nil {
+		return interfaces.NewFieldError("redisURL", `Invalid rate limit config "redisURL", `+err.Error())
+	}
+
+	return nil
+}
+
+func (a RedisBucketedSlidingWindowArgs) algorithm() interfaces.Algorithm {
+	return interfaces.RedisBucketedSlidingWindow
+}
+
+func (a RedisBucketedSlidingWindowArgs) newLimiter(clock interfaces.Clock) interfaces.RateLimiter {
+	a.Clock = clockOr(a.Clock, clock)
+
+	return NewRedisBucketedSlidingWindowLimiter(a)
+}
+
+func validateBucketedWindow(capacity int, duration time.Duration, buckets int) error {
+	if err := validatePositive("capacity", capacity); err != nil {
+		return err
+	}
+
+	if err := validatePositive("duration", duration); err != nil {
+		return err
+	}
+
+	if err := validatePositive("buckets", buckets); err != nil {
+		return err
+	}
+
+	if duration/time.Duration(buckets) == 0 {
+		return interfaces.NewFieldError("buckets", fmt.Sprintf(`Invalid rate limit config "buckets", a bucket of %s is shorter than a nanosecond`, duration))
+	}
+
+	return nil
+}
+
+// config fields shared by both variants
+var bucketedWindowFields = []interfaces.ConfigField{
+	{Name: "capacity", Type: interfaces.IntField, Required: true, Default: "60", Usage: "The maximum number of requests allowed in the time window"},
+	{Name: "duration", Type: interfaces.DurationField, Required: true, Default: "1m", Usage: "The duration of the window, e.g. 250ms or 1m30s"},
+	{Name: "buckets", Type: interfaces.IntField, Required: true, Default: "60", Usage: "The number of buckets the window is split into, more buckets are more precise and use more memory"},
+}
+
+func init() {
+	registerAlgorithm(interfaces.AlgorithmSpec{
+		Name:        interfaces.BucketedSlidingWindow.String(),
+		Command:     "bucketedSlidingWindow",
+		Description: "Sliding window rate limit algorithm counting the requests in buckets",
+		Fields:      append(append([]interfaces.ConfigField{}, bucketedWindowFields...), memoryFields...),
+	}, parseBucketedSlidingWindowArgs)
+
+	registerAlgorithm(interfaces.AlgorithmSpec{
+		Name:        interfaces.RedisBucketedSlidingWindow.String(),
+		Command:     "redisBucketedSlidingWindow",
+		Description: "Sliding window rate limit algorithm counting the requests in buckets using Redis",
+		Fields:      append(append([]interfaces.ConfigField{}, bucketedWindowFields...), redisFields...),
+	}, parseRedisBucketedSlidingWindowArgs)
+}
+
+// Rate Limiter Constructor
+func NewBucketedSlidingWindowLimiter(args BucketedSlidingWindowArgs) interfaces.RateLimiter {
+	l := &bucketedWindowLimiter{
+		clock:           interfaces.ClockOrDefault(args.Clock),
+		usersMap:        utils.NewShardedMap[*userBucketedWindow](utils.DefaultShards, args.MaxKeys),
+		defaultCapacity: args.Capacity,
+		defaultWidth:    args.Duration / time.Duration(args.Buckets),
+		buckets:         args.Buckets,
+	}
+
+	l.stopJanitor = utils.StartJanitor(args.CleanupInterval, l.cleanup)
+
+	return l
+}
+
+// Rate Limiter Constructor
+func NewRedisBucketedSlidingWindowLimiter(args RedisBucketedSlidingWindowArgs) interfaces.RateLimiter {
+	return &redisBucketedWindowLimiter{
+		clock:           interfaces.ClockOrDefault(args.Clock),
+		redisClient:     utils.NewRedisClient(args.RedisURL),
+		keyPrefix:       redisKeyPrefix(args.KeyPrefix, interfaces.RedisBucketedSlidingWindow),
+		defaultCapacity: args.Capacity,
+		defaultWidth:    args.Duration / time.Duration(args.Buckets),
+		buckets:         args.Buckets,
+	}
+}
+
+// parseBucketedSlidingWindowArgs reads the arguments of the algorithm from a string config
+func parseBucketedSlidingWindowArgs(config map[string]string) (BucketedSlidingWindowArgs, error) {
+	r := newConfigReader(config)
+
+	args := BucketedSlidingWindowArgs{
+		MemoryArgs: r.memoryArgs(),
+		Capacity:   r.int("capacity"),
+		Duration:   r.duration("duration"),
+		Buckets:    r.int("buckets"),
+	}
+
+	return args, r.err
+}
+
+// parseRedisBucketedSlidingWindowArgs reads the arguments of the algorithm from a string config
+func parseRedisBucketedSlidingWindowArgs(config map[string]string) (RedisBucketedSlidingWindowArgs, error) {
+	r := newConfigReader(config)
+
+	args := RedisBucketedSlidingWindowArgs{
+		RedisURL:  r.string("redisURL"),
+		KeyPrefix: config["keyPrefix"],
+		Capacity:  r.int("capacity"),
+		Duration:  r.duration("duration"),
+		Buckets:   r.int("buckets"),
+	}
+
+	return args, r.err
+}
+
+func (l *bucketedWindowLimiter) Allow(ctx context.Context, user string) (interfaces.RateLimiterStats, error) {
+	return l.AllowN(ctx, user, 1)
+}
+
+func (l *bucketedWindowLimiter) AllowN(ctx context.Context, user string, n int) (interfaces.RateLimiterStats, error) {
+	// do not count requests whose context is already done
+	if err := ctx.Err(); err != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
+
+	if err := validateTokens(n); err != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
+
+	users, unlock := l.usersMap.Lock(user)
+	defer unlock()
+
+	now := l.clock.Now()
+
+	bw := l.userWindow(users, user)
+
+	if err := bw.checkTokens(now, n); err != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
+
+	return bw.stats(now), nil
+}
+
+func (l *bucketedWindowLimiter) Reserve(ctx context.Context, user string, n int) (*interfaces.Reservation, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := validateTokens(n); err != nil {
+		return nil, err
+	}
+
+	users, unlock := l.usersMap.Lock(user)
+	defer unlock()
+
+	now := l.clock.Now()
+
+	bw := l.userWindow(users, user)
+
+	readyAt, err := bw.reserveTokens(now, n)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return interfaces.NewReservation(true, readyAt.Sub(now), bw.stats(now), func() {
+		_, unlock := l.usersMap.Lock(user)
+		defer unlock()
+
+		bw.cancelTokens(l.clock.Now(), n, readyAt)
+	}), nil
+}
+
+func (l *bucketedWindowLimiter) Wait(ctx context.Context, user string) error {
+	return waitN(ctx, l, l.clock, user, 1)
+}
+
+func (l *bucketedWindowLimiter) Peek(ctx context.Context, user string) (interfaces.RateLimiterStats, error) {
+	if err := ctx.Err(); err != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
+
+	users, unlock := l.usersMap.Lock(user)
+	defer unlock()
+
+	now := l.clock.Now()
+
+	bw := users.Get(user)
+
+	if bw == nil {
+		return l.newUserWindow().stats(now), nil
+	}
+
+	return bw.peek(now), nil
+}
+
+func (l *bucketedWindowLimiter) Reset(ctx context.Context, user string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	users, unlock := l.usersMap.Lock(user)
+	defer unlock()
+
+	users.Delete(user)
+
+	return nil
+}
+
+func (l *bucketedWindowLimiter) Refund(ctx context.Context, user string, n int) (interfaces.RateLimiterStats, error) {
+	if err := ctx.Err(); err != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
+
+	if err := validateTokens(n); err != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
+
+	users, unlock := l.usersMap.Lock(user)
+	defer unlock()
+
+	now := l.clock.Now()
+
+	bw := l.userWindow(users, user)
+	bw.refundTokens(now, n)
+
+	return bw.stats(now), nil
+}
+
+func (l *bucketedWindowLimiter) SetRemaining(ctx context.Context, user string, n int) (interfaces.RateLimiterStats, error) {
+	if err := ctx.Err(); err != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
+
+	if err := validateTokens(n); err != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
+
+	users, unlock := l.usersMap.Lock(user)
+	defer unlock()
+
+	now := l.clock.Now()
+
+	bw := l.userWindow(users, user)
+	bw.setRemaining(now, n)
+
+	return bw.stats(now), nil
+}
+
+func (l *bucketedWindowLimiter) TrackedKeys() int {
+	return l.usersMap.Len()
+}
+
+func (l *bucketedWindowLimiter) Close() error {
+	l.stopJanitor()
+
+	return nil
+}
+
+// cleanup removes the users without requests in the window, they are created again on their next request
+func (l *bucketedWindowLimiter) cleanup() {
+	now := l.clock.Now()
+
+	l.usersMap.DeleteFunc(func(_ string, bw *userBucketedWindow) bool {
+		return bw.full(now)
+	})
+}
+
+// read user from the map, first request for this user creates a new window
+func (l *bucketedWindowLimiter) userWindow(users *utils.MapShard[*userBucketedWindow], user string) *userBucketedWindow {
+	bw := users.Get(user)
+
+	if bw == nil {
+		bw = l.newUserWindow()
+
+		users.Set(user, bw)
+	}
+
+	return bw
+}
+
+// create the initial state of a user
+func (l *bucketedWindowLimiter) newUserWindow() *userBucketedWindow {
+	return newUserBucketedWindow(l.defaultCapacity, l.defaultWidth, l.buckets, interfaces.BucketedSlidingWindow)
+}
+
+func (l *redisBucketedWindowLimiter) Allow(ctx context.Context, user string) (interfaces.RateLimiterStats, error) {
+	return l.AllowN(ctx, user, 1)
+}
+
+func (l *redisBucketedWindowLimiter) AllowN(ctx context.Context, user string, n int) (interfaces.RateLimiterStats, error) {
+	if err := validateTokens(n); err != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
+
+	var stats interfaces.RateLimiterStats
+
+	// read, check and write the buckets atomically. If the context expires before the write the request is not counted
+	err := l.update(ctx, user, func(now time.Time, bw *userBucketedWindow) error {
+		if err := bw.checkTokens(now, n); err != nil {
+			return err
+		}
+
+		stats = bw.stats(now)
+
+		return nil
+	})
+
+	if err != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
+
+	return stats, nil
+}
+
+func (l *redisBucketedWindowLimiter) Reserve(ctx context.Context, user string, n int) (*interfaces.Reservation, error) {
+	if err := validateTokens(n); err != nil {
+		return nil, err
+	}
+
+	var (
+		stats   interfaces.RateLimiterStats
+		readyAt time.Time
+	)
+
+	err := l.update(ctx, user, func(now time.Time, bw *userBucketedWindow) error {
+		var err error
+
+		readyAt, err = bw.reserveTokens(now, n)
+		stats = bw.stats(now)
+
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return interfaces.NewReservation(true, readyAt.Sub(l.clock.Now()), stats, func() {
+		// best effort, the reservation has no context of its own
+		_ = l.update(context.Background(), user, func(now time.Time, bw *userBucketedWindow) error {
+			bw.cancelTokens(now, n, readyAt)
+			return nil
+		})
+	}), nil
+}
+
+func (l *redisBucketedWindowLimiter) Wait(ctx context.Context, user string) error {
+	return waitN(ctx, l, l.clock, user, 1)
+}
+
+func (l *redisBucketedWindowLimiter) Peek(ctx context.Context, user string) (interfaces.RateLimiterStats, error) {
+	var bw *userBucketedWindow
+
+	now := l.clock.Now()
+
+	err := l.redisClient.Get(ctx, l.key(user), &bw)
+
+	if errors.Is(err, utils.ErrKeyNotFound) {
+		return l.newUserWindow().stats(now), nil
+	}
+
+	if err != nil {
+		return interfaces.RateLimiterStats{}, interfaces.NewBackendError(err)
+	}
+
+	// the state moves to the current bucket locally, nothing is written
+	bw.algorithm = interfaces.RedisBucketedSlidingWindow
+	bw.advance(now)
+
+	return bw.stats(now), nil
+}
+
+func (l *redisBucketedWindowLimiter) Reset(ctx context.Context, user string) error {
+	return interfaces.NewBackendError(l.redisClient.Del(ctx, l.key(user)))
+}
+
+func (l *redisBucketedWindowLimiter) Refund(ctx context.Context, user string, n int) (interfaces.RateLimiterStats, error) {
+	if err := validateTokens(n); err != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
+
+	var stats interfaces.RateLimiterStats
+
+	err := l.update(ctx, user, func(now time.Time, bw *userBucketedWindow) error {
+		bw.refundTokens(now, n)
+		stats = bw.stats(now)
+
+		return nil
+	})
+
+	return stats, err
+}
+
+func (l *redisBucketedWindowLimiter) SetRemaining(ctx context.Context, user string, n int) (interfaces.RateLimiterStats, error) {
+	if err := validateTokens(n); err != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
+
+	var stats interfaces.RateLimiterStats
+
+	err := l.update(ctx, user, func(now time.Time, bw *userBucketedWindow) error {
+		bw.setRemaining(now, n)
+		stats = bw.stats(now)
+
+		return nil
+	})
+
+	return stats, err
+}
+
+// key returns the Redis key of the user
+func (l *redisBucketedWindowLimiter) key(user string) string {
+	return l.keyPrefix + user
+}
+
+func (l *redisBucketedWindowLimiter) Close() error {
+	return l.redisClient.Close()
+}
+
+// update runs fn on the user state inside a Redis transaction, a new state is created for unknown users.
+// Redis failures are returned as ErrBackendUnavailable
+func (l *redisBucketedWindowLimiter) update(ctx context.Context, user string, fn func(now time.Time, bw *userBucketedWindow) error) error {
+	var now time.Time
+
+	// the key outlives the window of its last request, reserved ones included
+	ttl := func(bw *userBucketedWindow) time.Duration {
+		return max(bw.reset(now).Sub(now), time.Duration(l.buckets)*l.defaultWidth)
+	}
+
+	err := utils.UpdateTTL(ctx, l.redisClient, l.key(user), ttl, func(bw *userBucketedWindow, found bool) error {
+		now = l.clock.Now()
+
+		if !found {
+			*bw = *l.newUserWindow()
+		}
+
+		bw.algorithm = interfaces.RedisBucketedSlidingWindow
+
+		return fn(now, bw)
+	})
+
+	// rate limit errors returned by fn are kept, anything else comes from redis
+	return interfaces.NewBackendError(err)
+}
+
+// create the initial state of a user
+func (l *redisBucketedWindowLimiter) newUserWindow() *userBucketedWindow {
+	return newUserBucketedWindow(l.defaultCapacity, l.defaultWidth, l.buckets, interfaces.RedisBucketedSlidingWindow)
+}
+
+func newUserBucketedWindow(capacity int, width time.Duration, buckets int, algorithm interfaces.Algorithm) *userBucketedWindow {
+	return &userBucketedWindow{Counts: make([]int, buckets), Capacity: capacity, Width: width, algorithm: algorithm}
+}
+
+// bucketOf returns the number of the bucket holding t
+func (bw *userBucketedWindow) bucketOf(t time.Time) int64 {
+	return t.UnixNano() / int64(bw.Width)
+}
+
+// index returns the position of a bucket of the window in the counts
+func (bw *userBucketedWindow) index(bucket int64) int {
+	return int(bucket % int64(len(bw.Counts)))
+}
+
+// expiry returns the time the requests of a bucket leave the window, when the bucket a whole window later starts
+func (bw *userBucketedWindow) expiry(bucket int64) time.Time {
+	return time.Unix(0, (bucket+int64(len(bw.Counts)))*int64(bw.Width))
+}
+
+// advance moves to the bucket of now, the buckets that left the window are emptied and the reserved ones become counts
+func (bw *userBucketedWindow) advance(now time.Time) {
+	bucket := bw.bucketOf(now)
+
+	// the clock went back, the current bucket is kept
+	if bucket <= bw.Bucket {
+		return
+	}
+
+	buckets := int64(len(bw.Counts))
+
+	for b := bw.Bucket + 1; b <= bucket && b <= bw.Bucket+buckets; b++ {
+		bw.Total -= bw.Counts[bw.index(b)]
+		bw.Counts[bw.index(b)] = 0
+	}
+
+	for b, n := range bw.Reserved {
+		switch {
+		case b > bucket:
+			continue
+		case b > bucket-buckets:
+			bw.Counts[bw.index(b)] += n
+		default:
+			bw.Total -= n
+		}
+
+		delete(bw.Reserved, b)
+	}
+
+	bw.Bucket = bucket
+}
+
+// reservedBuckets returns the numbers of the reserved buckets, from the oldest
+func (bw *userBucketedWindow) reservedBuckets() []int64 {
+	buckets := make([]int64, 0, len(bw.Reserved))
+
+	for b := range bw.Reserved {
+		buckets = append(buckets, b)
+	}
+
+	slices.Sort(buckets)
+
+	return buckets
+}
+
+// nextFit returns the first time n more requests fit in the window, when the oldest buckets have left it
+func (bw *userBucketedWindow) nextFit(now time.Time, n int) (time.Time, bool) {
+	if n > bw.Capacity {
+		return time.Time{}, false
+	}
+
+	// number of counted requests that must leave the window first
+	expire := bw.Total + n - bw.Capacity
+
+	if expire <= 0 {
+		return now, true
+	}
+
+	for b := bw.Bucket - int64(len(bw.Counts)) + 1; b <= bw.Bucket; b++ {
+		if expire -= bw.Counts[bw.index(b)]; expire <= 0 {
+			return bw.expiry(b), true
+		}
+	}
+
+	for _, b := range bw.reservedBuckets() {
+		if expire -= bw.Reserved[b]; expire <= 0 {
+			return bw.expiry(b), true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+func (bw *userBucketedWindow) checkTokens(now time.Time, n int) error {
+	bw.advance(now)
+
+	if bw.Total+n > bw.Capacity {
+		return bw.limitError(now, n)
+	}
+
+	bw.Counts[bw.index(bw.Bucket)] += n
+	bw.Total += n
+
+	return nil
+}
+
+// reserveTokens counts n requests in the bucket of the first time they fit and returns that time.
+// Reserved requests count against the window from now on
+func (bw *userBucketedWindow) reserveTokens(now time.Time, n int) (time.Time, error) {
+	bw.advance(now)
+
+	readyAt, ok := bw.nextFit(now, n)
+
+	if !ok {
+		return time.Time{}, bw.limitError(now, n)
+	}
+
+	if bucket := bw.bucketOf(readyAt); bucket > bw.Bucket {
+		if bw.Reserved == nil {
+			bw.Reserved = make(map[int64]int)
+		}
+
+		bw.Reserved[bucket] += n
+	} else {
+		bw.Counts[bw.index(bw.Bucket)] += n
+	}
+
+	bw.Total += n
+
+	return readyAt, nil
+}
+
+// cancelTokens gives back n requests counted for readyAt, requests that already left the window are not restored
+func (bw *userBucketedWindow) cancelTokens(now time.Time, n int, readyAt time.Time) {
+	bw.advance(now)
+
+	bw.remove(bw.bucketOf(readyAt), n)
+}
+
+// remove takes up to n requests out of a bucket and returns how many were removed
+func (bw *userBucketedWindow) remove(bucket int64, n int) int {
+	removed := 0
+
+	switch {
+	case bucket > bw.Bucket:
+		if removed = min(bw.Reserved[bucket], n); removed > 0 {
+			if bw.Reserved[bucket] -= removed; bw.Reserved[bucket] == 0 {
+				delete(bw.Reserved, bucket)
+			}
+		}
+	case bucket > bw.Bucket-int64(len(bw.Counts)):
+		removed = min(bw.Counts[bw.index(bucket)], n)
+		bw.Counts[bw.index(bucket)] -= removed
+	}
+
+	bw.Total -= removed
+
+	return removed
+}
+
+// limitError returns the error of a denied request with the time until the oldest buckets leave room for n requests
+func (bw *userBucketedWindow) limitError(now time.Time, n int) error {
+	var retryAfter time.Duration
+
+	if readyAt, ok := bw.nextFit(now, n); ok {
+		retryAfter = readyAt.Sub(now)
+	}
+
+	return interfaces.NewRateLimitedError(bw.stats(now), retryAfter)
+}
+
+// refundTokens removes the n most recent requests from the window
+func (bw *userBucketedWindow) refundTokens(now time.Time, n int) {
+	bw.advance(now)
+
+	reserved := bw.reservedBuckets()
+
+	for i := len(reserved) - 1; i >= 0 && n > 0; i-- {
+		n -= bw.remove(reserved[i], n)
+	}
+
+	for b := bw.Bucket; b > bw.Bucket-int64(len(bw.Counts)) && n > 0; b-- {
+		n -= bw.remove(b, n)
+	}
+}
+
+// setRemaining counts or removes requests until n are left in the window
+func (bw *userBucketedWindow) setRemaining(now time.Time, n int) {
+	bw.advance(now)
+
+	requests := bw.Capacity - min(n, bw.Capacity)
+
+	if bw.Total > requests {
+		bw.refundTokens(now, bw.Total-requests)
+		return
+	}
+
+	bw.Counts[bw.index(bw.Bucket)] += requests - bw.Total
+	bw.Total = requests
+}
+
+// full reports whether every request has left the window, the same state as a new user
+func (bw *userBucketedWindow) full(now time.Time) bool {
+	bw.advance(now)
+
+	return bw.Total == 0
+}
+
+// reset returns the time every counted request has left the window, when the most recent bucket does
+func (bw *userBucketedWindow) reset(now time.Time) time.Time {
+	if bw.Total == 0 {
+		return now
+	}
+
+	if reserved := bw.reservedBuckets(); len(reserved) > 0 {
+		return bw.expiry(reserved[len(reserved)-1])
+	}
+
+	for b := bw.Bucket; b > bw.Bucket-int64(len(bw.Counts)); b-- {
+		if bw.Counts[bw.index(b)] > 0 {
+			return bw.expiry(b)
+		}
+	}
+
+	return now
+}
+
+// peek returns the stats of an up to date copy of the window, the window itself is not changed
+func (bw *userBucketedWindow) peek(now time.Time) interfaces.RateLimiterStats {
+	window := *bw
+	window.Counts = slices.Clone(bw.Counts)
+	window.Reserved = maps.Clone(bw.Reserved)
+	window.advance(now)
+
+	return window.stats(now)
+}
+
+// Return the rate limit stats of the user, the window must be at the bucket of now
+func (bw *userBucketedWindow) stats(now time.Time) interfaces.RateLimiterStats {
+	return interfaces.RateLimiterStats{
+		Algorithm:   bw.algorithm.String(),
+		Capacity:    bw.Capacity,
+		Remaining:   max(bw.Capacity-bw.Total, 0),
+		Reset:       bw.reset(now),
+		CurrentTime: now,
+	}
+}
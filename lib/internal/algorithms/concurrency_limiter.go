@@ -0,0 +1,205 @@
+package algorithms
+
+/*
+Concurrency Limiter
+Limits how many requests are in flight at once, per key and over every key, instead of how many are made over time.
+A request takes a slot with Acquire and gives it back with the returned release when it ends. When every slot is taken
+the request is declined right away or, with a queue timeout, waits for a slot to be released. Waiters are not served
+in arrival order.
+*/
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/carantes/go-rate-limiter/lib/internal/interfaces"
+)
+
+// name of the concurrency limiters in the stats of their errors
+const concurrencyAlgorithm = "concurrency"
+
+// names of the limits of a concurrency limiter, reported in the LimitName of their errors
+const (
+	perKeyLimitName = "per-key"
+	totalLimitName  = "total"
+)
+
+// concurrencyLimiter implements the ConcurrencyLimiter interface
+type concurrencyLimiter struct {
+	clock        interfaces.Clock
+	maxPerKey    int
+	maxTotal     int
+	queueTimeout time.Duration
+
+	mu      sync.Mutex
+	perKey  map[string]int // requests in flight per key, keys without requests are removed
+	total   int
+	changed chan struct{} // closed and replaced when a slot is released, wakes up the waiters
+}
+
+type ConcurrencyArgs struct {
+	MaxPerKey    int              // maximum number of requests in flight per key, zero means unbounded
+	MaxTotal     int              // maximum number of requests in flight over every key, zero means unbounded
+	QueueTimeout time.Duration    // how long Acquire waits for a free slot, zero declines the request right away
+	Clock        interfaces.Clock // source of time of the queue timeout, defaults to the system clock
+}
+
+func (a ConcurrencyArgs) Validate() error {
+	return validateConcurrency(a.MaxPerKey, a.MaxTotal, a.QueueTimeout)
+}
+
+func validateConcurrency(maxPerKey int, maxTotal int, queueTimeout time.Duration) error {
+	if err := validateNotNegative("maxPerKey", maxPerKey); err != nil {
+		return err
+	}
+
+	if err := validateNotNegative("maxTotal", maxTotal); err != nil {
+		return err
+	}
+
+	if maxPerKey == 0 && maxTotal == 0 {
+		return interfaces.NewFieldError("maxPerKey", `Invalid concurrency limit, "maxPerKey" or "maxTotal" must be greater than zero`)
+	}
+
+	return validateNotNegative("queueTimeout", queueTimeout)
+}
+
+// Concurrency Limiter Constructor
+func NewConcurrencyLimiter(args ConcurrencyArgs) interfaces.ConcurrencyLimiter {
+	return &concurrencyLimiter{
+		clock:        interfaces.ClockOrDefault(args.Clock),
+		maxPerKey:    args.MaxPerKey,
+		maxTotal:     args.MaxTotal,
+		queueTimeout: args.QueueTimeout,
+		perKey:       make(map[string]int),
+		changed:      make(chan struct{}),
+	}
+}
+
+func (l *concurrencyLimiter) Acquire(ctx context.Context, key string) (func(), error) {
+	return acquireSlot(ctx, l.clock, l.queueTimeout, func() (func(), <-chan struct{}, error) {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		if err := concurrencyError(concurrencyAlgorithm, l.perKey[key], l.total, l.maxPerKey, l.maxTotal); err != nil {
+			return nil, l.changed, err
+		}
+
+		l.perKey[key]++
+		l.total++
+
+		var once sync.Once
+
+		return func() {
+			once.Do(func() { l.release(key) })
+		}, nil, nil
+	})
+}
+
+func (l *concurrencyLimiter) InFlight(ctx context.Context, key string) (int, int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.perKey[key], l.total, nil
+}
+
+func (l *concurrencyLimiter) Close() error {
+	return nil
+}
+
+// release gives a slot of the key back and wakes up the waiters
+func (l *concurrencyLimiter) release(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.perKey[key]--; l.perKey[key] <= 0 {
+		delete(l.perKey, key)
+	}
+
+	l.total--
+
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// acquireSlot calls try until it takes a slot. try returns the release of the slot or the error of a full limiter,
+// with a channel closed when a slot may be free again, nil to poll. The wait ends after the queue timeout
+func acquireSlot(ctx context.Context, clock interfaces.Clock, queueTimeout time.Duration, try func() (func(), <-chan struct{}, error)) (func(), error) {
+	var timeout <-chan time.Time
+
+	if queueTimeout > 0 {
+		timeout = clock.After(queueTimeout)
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		release, changed, err := try()
+
+		if err == nil || queueTimeout <= 0 {
+			return release, err
+		}
+
+		if !errors.Is(err, interfaces.ErrRateLimited) {
+			return nil, err
+		}
+
+		if changed == nil {
+			changed = poll(clock)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timeout:
+			return nil, err
+		case <-changed:
+		}
+	}
+}
+
+// poll returns a channel closed after the retry delay, for the limiters that cannot tell when a slot is released
+func poll(clock interfaces.Clock) <-chan struct{} {
+	ch := make(chan struct{})
+	after := clock.After(minRetryDelay)
+
+	go func() {
+		<-after
+		close(ch)
+	}()
+
+	return ch
+}
+
+// concurrencyError returns the error of a request that finds every slot taken, nil when a slot is free
+func concurrencyError(algorithm string, perKey int, total int, maxPerKey int, maxTotal int) error {
+	limit, inFlight, name := maxPerKey, perKey, perKeyLimitName
+
+	switch {
+	case maxPerKey > 0 && perKey >= maxPerKey:
+	case maxTotal > 0 && total >= maxTotal:
+		limit, inFlight, name = maxTotal, total, totalLimitName
+	default:
+		return nil
+	}
+
+	return &interfaces.RateLimitError{
+		Message:   "Too many requests in flight",
+		Err:       interfaces.ErrRateLimited,
+		Limit:     limit,
+		LimitName: name,
+		Stats: interfaces.RateLimiterStats{
+			Algorithm: algorithm,
+			Capacity:  limit,
+			Remaining: max(limit-inFlight, 0),
+		},
+	}
+}
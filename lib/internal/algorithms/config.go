@@ -0,0 +1,275 @@
+package algorithms
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/carantes/go-rate-limiter/lib/internal/interfaces"
+	"github.com/carantes/go-rate-limiter/lib/internal/utils"
+)
+
+// Args are the typed arguments of a built-in algorithm, e.g. TokenBucketArgs
+type Args interface {
+	// Validate checks the arguments, the returned error names the invalid field
+	Validate() error
+
+	algorithm() interfaces.Algorithm
+
+	// newLimiter creates the rate limiter, the clock is used when the arguments have none
+	newLimiter(clock interfaces.Clock) interfaces.RateLimiter
+}
+
+// Config is the typed configuration of a rate limiter, the arguments of its algorithm and a clock
+type Config struct {
+	Algorithm interfaces.Algorithm // optional, it must match the arguments when set
+	Clock     interfaces.Clock     // source of time of the arguments without their own clock
+	Args      Args                 // arguments of the algorithm, e.g. TokenBucketArgs
+}
+
+// Validate checks the arguments of the config, the returned error names the invalid field
+func (c Config) Validate() error {
+	if c.Args == nil {
+		return interfaces.NewFieldError("args", "Missing rate limit config arguments")
+	}
+
+	if c.Algorithm != "" && c.Algorithm != c.Args.algorithm() {
+		return interfaces.NewFieldError("algorithm", fmt.Sprintf("Rate limit config arguments of %q do not match the algorithm %q", c.Args.algorithm(), c.Algorithm))
+	}
+
+	return c.Args.Validate()
+}
+
+// parsers of the string configs of the built-in algorithms, by algorithm name
+var parsers = make(map[string]func(config map[string]string) (Args, error))
+
+// registerAlgorithm registers a built-in algorithm, parse reads its typed arguments out of a string config.
+// The factory and the validation of the registry go through the typed arguments
+func registerAlgorithm[A Args](spec interfaces.AlgorithmSpec, parse func(config map[string]string) (A, error)) {
+	parsers[spec.Name] = func(config map[string]string) (Args, error) {
+		return parse(config)
+	}
+
+	spec.Factory = func(config map[string]string, clock interfaces.Clock) (interfaces.RateLimiter, error) {
+		args, err := parse(config)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return New(Config{Clock: clock, Args: args})
+	}
+
+	spec.Validate = func(config map[string]string) error {
+		args, err := parse(config)
+
+		if err != nil {
+			return err
+		}
+
+		return args.Validate()
+	}
+
+	interfaces.MustRegisterAlgorithm(spec)
+}
+
+// ParseConfig reads a string config, e.g. built from command line flags, into a typed Config.
+// The config is checked against the fields of its algorithm, only the built-in algorithms have a typed config
+func ParseConfig(config map[string]string) (Config, error) {
+	spec, ok := interfaces.LookupAlgorithm(config["algorithm"])
+
+	if !ok {
+		return Config{}, interfaces.NewFieldError("algorithm", "Missing rate limit algorithm")
+	}
+
+	if err := spec.CheckConfig(config); err != nil {
+		return Config{}, err
+	}
+
+	parse, ok := parsers[spec.Name]
+
+	if !ok {
+		return Config{}, interfaces.NewFieldError("algorithm", fmt.Sprintf("Algorithm %q has no typed config", spec.Name))
+	}
+
+	args, err := parse(config)
+
+	return Config{Algorithm: interfaces.Algorithm(spec.Name), Args: args}, err
+}
+
+// New validates the typed config and creates the rate limiter of its algorithm
+func New(config Config) (interfaces.RateLimiter, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	return config.Args.newLimiter(config.Clock), nil
+}
+
+// clockOr returns the clock of the algorithm section or, when it has none, the clock of the config
+func clockOr(clock interfaces.Clock, fallback interfaces.Clock) interfaces.Clock {
+	if clock != nil {
+		return clock
+	}
+
+	return fallback
+}
+
+// configReader reads typed values out of a string config, only the first error is kept
+type configReader struct {
+	config map[string]string
+	err    error
+}
+
+func newConfigReader(config map[string]string) *configReader {
+	return &configReader{config: config}
+}
+
+func (r *configReader) fail(key string, message string) {
+	if r.err == nil {
+		r.err = interfaces.NewFieldError(key, message)
+	}
+}
+
+// string returns the value of a required key
+func (r *configReader) string(key string) string {
+	value, ok := r.config[key]
+
+	if !ok {
+		r.fail(key, fmt.Sprintf("Missing rate limit config %q", key))
+	}
+
+	return value
+}
+
+// int returns the value of a required integer key
+func (r *configReader) int(key string) int {
+	value, ok := r.config[key]
+
+	if !ok {
+		r.fail(key, fmt.Sprintf("Missing rate limit config %q", key))
+		return 0
+	}
+
+	n, err := utils.ParseInt(value)
+
+	if err != nil {
+		r.fail(key, fmt.Sprintf("Invalid rate limit config %q, %q is not an integer", key, value))
+	}
+
+	return n
+}
+
+// float returns the value of a required number key
+func (r *configReader) float(key string) float64 {
+	value, ok := r.config[key]
+
+	if !ok {
+		r.fail(key, fmt.Sprintf("Missing rate limit config %q", key))
+		return 0
+	}
+
+	f, err := utils.ParseFloat(value)
+
+	if err != nil {
+		r.fail(key, fmt.Sprintf("Invalid rate limit config %q, %q is not a number", key, value))
+	}
+
+	return f
+}
+
+// optionalInt returns the value of an integer key, zero when it is missing or empty
+func (r *configReader) optionalInt(key string) int {
+	if r.config[key] == "" {
+		return 0
+	}
+
+	return r.int(key)
+}
+
+// rate returns the value of a required rate key, e.g. "0.5" or "5/100ms". The period is zero when the rate has none
+func (r *configReader) rate(key string) (float64, time.Duration) {
+	value, ok := r.config[key]
+
+	if !ok {
+		r.fail(key, fmt.Sprintf("Missing rate limit config %q", key))
+		return 0, 0
+	}
+
+	n, period, err := utils.ParseRate(value)
+
+	if err != nil {
+		r.fail(key, fmt.Sprintf("Invalid rate limit config %q, %q is not a rate", key, value))
+	}
+
+	return n, period
+}
+
+// refillRate reads the refill rate and its period, the period can be given with the rate, e.g. "5/100ms"
+func (r *configReader) refillRate() (float64, time.Duration) {
+	period := r.optionalDuration("refillPeriod")
+	rate, ratePeriod := r.rate("refillRate")
+
+	if ratePeriod > 0 {
+		if period > 0 {
+			r.fail("refillPeriod", `Invalid rate limit config "refillPeriod", the refill rate already has a period`)
+		}
+
+		period = ratePeriod
+	}
+
+	return rate, period
+}
+
+// duration returns the value of a required duration key, e.g. "250ms" or "1m30s". A plain number is read as seconds
+func (r *configReader) duration(key string) time.Duration {
+	value, ok := r.config[key]
+
+	if !ok {
+		r.fail(key, fmt.Sprintf("Missing rate limit config %q", key))
+		return 0
+	}
+
+	d, err := utils.ParseDuration(value)
+
+	if err != nil {
+		r.fail(key, fmt.Sprintf("Invalid rate limit config %q, %q is not a duration", key, value))
+	}
+
+	return d
+}
+
+// optionalDuration returns the value of a duration key, zero when it is missing or empty
+func (r *configReader) optionalDuration(key string) time.Duration {
+	if r.config[key] == "" {
+		return 0
+	}
+
+	return r.duration(key)
+}
+
+// validatePositive checks that a config value is greater than zero
+func validatePositive[T int | float64 | time.Duration](field string, value T) error {
+	if !(value > 0) {
+		return interfaces.NewFieldError(field, fmt.Sprintf("Invalid rate limit config %q, must be greater than zero", field))
+	}
+
+	return nil
+}
+
+// validateNotNegative checks that a config value is zero or more
+func validateNotNegative[T int | float64 | time.Duration](field string, value T) error {
+	if !(value >= 0) {
+		return interfaces.NewFieldError(field, fmt.Sprintf("Invalid rate limit config %q, must not be negative", field))
+	}
+
+	return nil
+}
+
+// validateWeight checks that the weight of a sliding window counter is in [0, 1]
+func validateWeight(weight float64) error {
+	if !(weight >= 0 && weight <= 1) {
+		return interfaces.NewFieldError("weight", `Invalid rate limit config "weight", must be between 0 and 1`)
+	}
+
+	return nil
+}
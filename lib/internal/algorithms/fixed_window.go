@@ -1,10 +1,11 @@
 package algorithms
 
 import (
+	"context"
+	"io"
 	"time"
 
 	"github.com/carantes/go-rate-limiter/lib/internal/interfaces"
-	"github.com/carantes/go-rate-limiter/lib/internal/mocks"
 	"github.com/carantes/go-rate-limiter/lib/internal/utils"
 )
 
@@ -17,9 +18,11 @@ The downside of this algorithm is that it allows bursts of requests at the end a
 
 // FixedWindowLimiter implements the RateLimiter interface
 type fixedWindowLimiter struct {
-	usersMap              map[string]*userFixedWindow
+	clock                 interfaces.Clock
+	usersMap              *utils.ShardedMap[*userFixedWindow] // users state, safe for concurrent use
 	defaultWindowCapacity int
 	defaultWindowDuration time.Duration
+	stopJanitor           func() // stops the background cleanup
 }
 
 // userFixedWindow represents a fixed window for a specific user
@@ -31,88 +34,393 @@ type userFixedWindow struct {
 }
 
 type FixedWindowArgs struct {
+	MemoryArgs
 	Capacity int
-	Duration time.Duration
+	Duration time.Duration    // window size, e.g. 100 * time.Millisecond
+	Clock    interfaces.Clock // source of time, defaults to the system clock
+}
+
+func (a FixedWindowArgs) Validate() error {
+	if err := validatePositive("capacity", a.Capacity); err != nil {
+		return err
+	}
+
+	if err := validatePositive("duration", a.Duration); err != nil {
+		return err
+	}
+
+	return a.MemoryArgs.Validate()
+}
+
+func (a FixedWindowArgs) algorithm() interfaces.Algorithm {
+	return interfaces.FixedWindow
+}
+
+func (a FixedWindowArgs) newLimiter(clock interfaces.Clock) interfaces.RateLimiter {
+	a.Clock = clockOr(a.Clock, clock)
+
+	return NewFixedWindowLimiter(a)
+}
+
+func init() {
+	registerAlgorithm(interfaces.AlgorithmSpec{
+		Name:        interfaces.FixedWindow.String(),
+		Command:     "fixedWindow",
+		Description: "Fixed window rate limit algorithm",
+		Fields: append([]interfaces.ConfigField{
+			{Name: "capacity", Type: interfaces.IntField, Required: true, Default: "60", Usage: "The maximum number of requests allowed in the time window"},
+			{Name: "duration", Type: interfaces.DurationField, Required: true, Default: "1m", Usage: "The duration of the window, e.g. 250ms or 1m30s"},
+		}, memoryFields...),
+	}, parseFixedWindowArgs)
 }
 
 // Rate Limiter Constructor
 func NewFixedWindowLimiter(args FixedWindowArgs) interfaces.RateLimiter {
-	return &fixedWindowLimiter{
-		usersMap:              make(map[string]*userFixedWindow),
+	l := &fixedWindowLimiter{
+		clock:                 interfaces.ClockOrDefault(args.Clock),
+		usersMap:              utils.NewShardedMap[*userFixedWindow](utils.DefaultShards, args.MaxKeys),
 		defaultWindowCapacity: args.Capacity,
-		defaultWindowDuration: args.Duration * time.Second,
+		defaultWindowDuration: args.Duration,
 	}
+
+	l.stopJanitor = utils.StartJanitor(args.CleanupInterval, l.cleanup)
+
+	return l
 }
 
-func NewFixedWindowLimiterFromConfig(config map[string]string) (interfaces.RateLimiter, error) {
-	capacity, ok := config["capacity"]
+// parseFixedWindowArgs reads the arguments of the algorithm from a string config
+func parseFixedWindowArgs(config map[string]string) (FixedWindowArgs, error) {
+	r := newConfigReader(config)
 
-	if !ok {
-		return nil, &interfaces.RateLimitError{Message: "Missing rate limit capacity"}
+	args := FixedWindowArgs{
+		MemoryArgs: r.memoryArgs(),
+		Capacity:   r.int("capacity"),
+		Duration:   r.duration("duration"),
 	}
 
-	duration, ok := config["duration"]
+	return args, r.err
+}
+
+func (l *fixedWindowLimiter) Allow(ctx context.Context, user string) (interfaces.RateLimiterStats, error) {
+	return l.AllowN(ctx, user, 1)
+}
+
+func (l *fixedWindowLimiter) AllowN(ctx context.Context, user string, n int) (interfaces.RateLimiterStats, error) {
+	// do not count requests whose context is already done
+	if err := ctx.Err(); err != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
+
+	if err := validateTokens(n); err != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
+
+	users, unlock := l.usersMap.Lock(user)
+	defer unlock()
+
+	now := l.clock.Now()
+
+	userWindow := l.userWindow(users, now, user)
+
+	// if user exists, check if there are enough tokens to allow the request
+	err := userWindow.checkTokens(now, n)
+
+	if (err) != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
+
+	return userWindow.stats(now), nil
+}
+
+func (l *fixedWindowLimiter) Reserve(ctx context.Context, user string, n int) (*interfaces.Reservation, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
-	if !ok {
-		return nil, &interfaces.RateLimitError{Message: "Missing rate limit duration"}
+	if err := validateTokens(n); err != nil {
+		return nil, err
 	}
 
-	return NewFixedWindowLimiter(FixedWindowArgs{
-		Capacity: utils.ParseInt(capacity),
-		Duration: time.Duration(utils.ParseInt(duration)),
+	users, unlock := l.usersMap.Lock(user)
+	defer unlock()
+
+	now := l.clock.Now()
+
+	userWindow := l.userWindow(users, now, user)
+
+	readyAt, err := userWindow.reserveTokens(now, n)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return interfaces.NewReservation(true, readyAt.Sub(now), userWindow.stats(now), func() {
+		_, unlock := l.usersMap.Lock(user)
+		defer unlock()
+
+		now := l.clock.Now()
+
+		userWindow.cancelTokens(now, n, readyAt)
 	}), nil
 }
 
-func (l *fixedWindowLimiter) Allow(user string) (interfaces.RateLimiterStats, error) {
-	// read user from the map
-	userWindow := l.usersMap[user]
+func (l *fixedWindowLimiter) Wait(ctx context.Context, user string) error {
+	return waitN(ctx, l, l.clock, user, 1)
+}
+
+func (l *fixedWindowLimiter) Peek(ctx context.Context, user string) (interfaces.RateLimiterStats, error) {
+	if err := ctx.Err(); err != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
+
+	users, unlock := l.usersMap.Lock(user)
+	defer unlock()
+
+	now := l.clock.Now()
+
+	userWindow := users.Get(user)
 
 	if userWindow == nil {
-		userWindow = &userFixedWindow{
-			startTime: mocks.Now(),
-			duration:  l.defaultWindowDuration,
-			capacity:  l.defaultWindowCapacity,
-			current:   0,
-		}
+		return l.newUserWindow(now).stats(now), nil
+	}
+
+	return userWindow.peek(now), nil
+}
 
-		l.usersMap[user] = userWindow
+func (l *fixedWindowLimiter) Reset(ctx context.Context, user string) error {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
-	// if user exists, check if there are enough tokens to allow the request
-	err := userWindow.checkTokens()
+	users, unlock := l.usersMap.Lock(user)
+	defer unlock()
 
-	if (err) != nil {
+	users.Delete(user)
+
+	return nil
+}
+
+func (l *fixedWindowLimiter) Refund(ctx context.Context, user string, n int) (interfaces.RateLimiterStats, error) {
+	if err := ctx.Err(); err != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
+
+	if err := validateTokens(n); err != nil {
 		return interfaces.RateLimiterStats{}, err
 	}
 
-	return userWindow.stats(), nil
+	users, unlock := l.usersMap.Lock(user)
+	defer unlock()
+
+	now := l.clock.Now()
+
+	userWindow := l.userWindow(users, now, user)
+	userWindow.refundTokens(now, n)
+
+	return userWindow.stats(now), nil
 }
 
-func (fw *userFixedWindow) checkTokens() error {
-	// check if the window has expired
-	if time.Since(fw.startTime) > fw.duration {
-		fw.startTime = mocks.Now()
-		fw.current = 0
+func (l *fixedWindowLimiter) SetRemaining(ctx context.Context, user string, n int) (interfaces.RateLimiterStats, error) {
+	if err := ctx.Err(); err != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
+
+	if err := validateTokens(n); err != nil {
+		return interfaces.RateLimiterStats{}, err
 	}
 
+	users, unlock := l.usersMap.Lock(user)
+	defer unlock()
+
+	now := l.clock.Now()
+
+	userWindow := l.userWindow(users, now, user)
+	userWindow.setRemaining(now, n)
+
+	return userWindow.stats(now), nil
+}
+
+func (l *fixedWindowLimiter) TrackedKeys() int {
+	return l.usersMap.Len()
+}
+
+// fixedWindowEntry is the snapshot of a user window
+type fixedWindowEntry struct {
+	Start time.Time
+	Count int // above the capacity when tokens are reserved in the following windows
+}
+
+func (l *fixedWindowLimiter) Snapshot(w io.Writer) error {
+	now := l.clock.Now()
+
+	return writeSnapshot(w, interfaces.FixedWindow, now, l.usersMap, func(fw *userFixedWindow) (fixedWindowEntry, bool) {
+		return fixedWindowEntry{Start: fw.startTime, Count: fw.current}, !fw.full(now)
+	})
+}
+
+func (l *fixedWindowLimiter) Restore(r io.Reader) error {
+	now := l.clock.Now()
+
+	return readSnapshot(r, interfaces.FixedWindow, l.usersMap, func(e fixedWindowEntry) (*userFixedWindow, bool) {
+		// the window takes the capacity and duration of this limiter
+		fw := l.newUserWindow(now)
+		fw.current = max(e.Count, 0)
+
+		if e.Start.Before(now) {
+			fw.startTime = e.Start
+		}
+
+		return fw, !fw.full(now)
+	})
+}
+
+func (l *fixedWindowLimiter) Close() error {
+	l.stopJanitor()
+
+	return nil
+}
+
+// cleanup removes the users whose state is back to full, they are created again on their next request
+func (l *fixedWindowLimiter) cleanup() {
+	now := l.clock.Now()
+
+	l.usersMap.DeleteFunc(func(_ string, fw *userFixedWindow) bool {
+		return fw.full(now)
+	})
+}
+
+// read user from the map, first request for this user creates a new window
+func (l *fixedWindowLimiter) userWindow(users *utils.MapShard[*userFixedWindow], now time.Time, user string) *userFixedWindow {
+	userWindow := users.Get(user)
+
+	if userWindow == nil {
+		userWindow = l.newUserWindow(now)
+
+		users.Set(user, userWindow)
+	}
+
+	return userWindow
+}
+
+// create the initial state of a user
+func (l *fixedWindowLimiter) newUserWindow(now time.Time) *userFixedWindow {
+	return &userFixedWindow{
+		startTime: now,
+		duration:  l.defaultWindowDuration,
+		capacity:  l.defaultWindowCapacity,
+		current:   0,
+	}
+}
+
+// advance starts a new window when the current one has expired.
+// Windows start at whole multiples of the duration from the first one, so tokens reserved beyond the capacity
+// are carried over to the windows their reservations were given
+func (fw *userFixedWindow) advance(now time.Time) {
+	elapsed := now.Sub(fw.startTime)
+
+	if elapsed >= fw.duration {
+		windows := int(elapsed / fw.duration)
+		fw.startTime = fw.startTime.Add(time.Duration(windows) * fw.duration)
+		fw.current = max(fw.current-windows*fw.capacity, 0)
+	}
+}
+
+func (fw *userFixedWindow) checkTokens(now time.Time, n int) error {
+	// check if the window has expired
+	fw.advance(now)
+
 	// check if there are enough tokens to fulfill the request
-	if fw.current >= fw.capacity {
-		return &interfaces.RateLimitError{Message: "Rate limit exceeded"}
+	if fw.current+n > fw.capacity {
+		return fw.limitError(now, n)
 	}
 
 	// increment the counter
-	fw.current++
+	fw.current += n
 
 	return nil
 }
 
+// reserveTokens counts n tokens in the first window where they fit and returns when that window starts
+func (fw *userFixedWindow) reserveTokens(now time.Time, n int) (time.Time, error) {
+	fw.advance(now)
+
+	// the request can never be fulfilled
+	if n > fw.capacity {
+		return time.Time{}, fw.limitError(now, n)
+	}
+
+	fw.current += n
+
+	if fw.current <= fw.capacity {
+		return now, nil
+	}
+
+	// index of the window that holds the last reserved token
+	window := (fw.current - 1) / fw.capacity
+
+	return fw.startTime.Add(time.Duration(window) * fw.duration), nil
+}
+
+// cancelTokens gives back n tokens reserved for the window starting at readyAt, if it is still running
+func (fw *userFixedWindow) cancelTokens(now time.Time, n int, readyAt time.Time) {
+	fw.advance(now)
+
+	if readyAt.Add(fw.duration).Before(now) {
+		return
+	}
+
+	fw.current = max(fw.current-n, 0)
+}
+
+// limitError returns the error of a denied request with the time until the window where n tokens fit starts
+func (fw *userFixedWindow) limitError(now time.Time, n int) error {
+	var retryAfter time.Duration
+
+	if n <= fw.capacity {
+		window := (fw.current + n - 1) / fw.capacity
+		retryAfter = fw.startTime.Add(time.Duration(window) * fw.duration).Sub(now)
+	}
+
+	return interfaces.NewRateLimitedError(fw.stats(now), retryAfter)
+}
+
+// refundTokens gives n tokens back to the current window
+func (fw *userFixedWindow) refundTokens(now time.Time, n int) {
+	fw.advance(now)
+
+	fw.current = max(fw.current-n, 0)
+}
+
+// setRemaining overrides the number of tokens left in the current window
+func (fw *userFixedWindow) setRemaining(now time.Time, n int) {
+	fw.advance(now)
+
+	fw.current = fw.capacity - min(n, fw.capacity)
+}
+
+// full reports whether the window has no requests left to count, the same state as a new window
+func (fw *userFixedWindow) full(now time.Time) bool {
+	window := *fw
+	window.advance(now)
+
+	return window.current == 0
+}
+
+// peek returns the stats of an up to date copy of the window, the window itself is not changed
+func (fw *userFixedWindow) peek(now time.Time) interfaces.RateLimiterStats {
+	window := *fw
+	window.advance(now)
+
+	return window.stats(now)
+}
+
 // Return the rate limit stats for the user
-func (fw *userFixedWindow) stats() interfaces.RateLimiterStats {
+func (fw *userFixedWindow) stats(now time.Time) interfaces.RateLimiterStats {
 	return interfaces.RateLimiterStats{
 		Algorithm:   interfaces.FixedWindow.String(),
 		Capacity:    fw.capacity,
-		Remaining:   fw.capacity - fw.current,
+		Remaining:   max(fw.capacity-fw.current, 0),
 		Reset:       fw.startTime.Add(fw.duration),
-		CurrentTime: mocks.Now(),
+		CurrentTime: now,
 	}
 }
@@ -0,0 +1,645 @@
+package algorithms
+
+/*
+GCRA (Generic Cell Rate Algorithm)
+A token bucket that stores a single timestamp per user, the theoretical arrival time (TAT): the time the bucket
+is full again. Every request pushes the TAT forward by one emission interval (refill period / refill rate) per token,
+it is declined when the TAT would move further than capacity intervals ahead of now.
+Retry-after and reset times are exact, and the Redis variant updates the user with one Lua script.
+*/
+
+import (
+	"context"
+	"time"
+
+	"github.com/carantes/go-rate-limiter/lib/internal/interfaces"
+	"github.com/carantes/go-rate-limiter/lib/internal/utils"
+)
+
+// gcraLimiter implements the RateLimiter interface
+type gcraLimiter struct {
+	clock           interfaces.Clock
+	usersMap        *utils.ShardedMap[*userGCRA] // users state, safe for concurrent use
+	defaultCapacity int
+	defaultInterval time.Duration
+	stopJanitor     func() // stops the background cleanup
+}
+
+// redisGCRALimiter implements the RateLimiter interface, users are stored in Redis
+type redisGCRALimiter struct {
+	clock           interfaces.Clock
+	redisClient     *utils.RedisClient
+	keyPrefix       string // prefix of the Redis keys of the users
+	defaultCapacity int
+	defaultInterval time.Duration
+}
+
+// userGCRA is the state of a user, the Redis limiter only stores the TAT
+type userGCRA struct {
+	TAT      time.Time     // theoretical arrival time, the time the bucket is full again
+	Capacity int           // maximum number of tokens
+	Interval time.Duration // emission interval, the time to refill one token
+
+	algorithm interfaces.Algorithm // variant reported in the stats, not stored
+}
+
+type GCRAArgs struct {
+	MemoryArgs
+	Capacity     int
+	RefillRate   float64          // number of tokens added every refill period, can be fractional
+	RefillPeriod time.Duration    // period of the refill rate, defaults to one second
+	Clock        interfaces.Clock // source of time, defaults to the system clock
+}
+
+type RedisGCRAArgs struct {
+	RedisURL     string
+	KeyPrefix    string // prefix of the Redis keys, limits sharing a Redis server need different prefixes
+	Capacity     int
+	RefillRate   float64          // number of tokens added every refill period, can be fractional
+	RefillPeriod time.Duration    // period of the refill rate, defaults to one second
+	Clock        interfaces.Clock // source of time, defaults to the system clock
+}
+
+// operations of the GCRA script
+const (
+	gcraAllow   = "allow"   // move the TAT by the tokens unless it goes further than the burst ahead of now
+	gcraReserve = "reserve" // move the TAT by the tokens even beyond the burst
+	gcraRefund  = "refund"  // move the TAT back by the tokens, never before now
+	gcraSet     = "set"     // set the TAT to now plus the tokens
+	gcraPeek    = "peek"    // read the TAT only
+)
+
+// KEYS: TAT of the user, a hash of seconds and nanoseconds since the epoch
+// ARGV: now in seconds and nanoseconds, emission interval, burst, tokens, operation
+// returns 1 when the request is accepted, 0 when it is declined, then how far the TAT is ahead of now.
+// Durations are in nanoseconds relative to now, doubles hold them exactly unlike nanoseconds since the epoch
+var gcraScript = utils.NewScript(`
+local nowSec = tonumber(ARGV[1])
+local nowNsec = tonumber(ARGV[2])
+local interval = tonumber(ARGV[3])
+local burst = tonumber(ARGV[4])
+local tokens = tonumber(ARGV[5])
+local op = ARGV[6]
+
+local ahead = 0
+local tat = redis.call('HMGET', KEYS[1], 'sec', 'nsec')
+
+if tat[1] then
+	ahead = math.max((tonumber(tat[1]) - nowSec) * 1e9 + tonumber(tat[2]) - nowNsec, 0)
+end
+
+if op == 'peek' then
+	return {1, ahead}
+end
+
+if op == 'allow' or op == 'reserve' then
+	local next = ahead + tokens * interval
+
+	if op == 'allow' and next > burst then
+		return {0, ahead}
+	end
+
+	ahead = next
+elseif op == 'refund' then
+	ahead = math.max(ahead - tokens * interval, 0)
+elseif op == 'set' then
+	ahead = tokens * interval
+end
+
+local nsec = nowNsec + ahead
+local sec = math.floor(nsec / 1e9)
+
+redis.call('HSET', KEYS[1], 'sec', string.format('%d', nowSec + sec), 'nsec', string.format('%d', nsec - sec * 1e9))
+-- the key outlives the TAT, however far reservations pushed it, plus the burst. PEXPIRE 0 would delete it
+redis.call('PEXPIRE', KEYS[1], math.max(math.ceil((ahead + burst) / 1e6), 1))
+
+return {1, ahead}
+`)
+
+func (a GCRAArgs) Validate() error {
+	if err := validateGCRA(a.Capacity, a.RefillRate, a.RefillPeriod); err != nil {
+		return err
+	}
+
+	return a.MemoryArgs.Validate()
+}
+
+func (a GCRAArgs) algorithm() interfaces.Algorithm {
+	return interfaces.GCRA
+}
+
+func (a GCRAArgs) newLimiter(clock interfaces.Clock) interfaces.RateLimiter {
+	a.Clock = clockOr(a.Clock, clock)
+
+	return NewGCRALimiter(a)
+}
+
+func (a RedisGCRAArgs) Validate() error {
+	if err := validateGCRA(a.Capacity, a.RefillRate, a.RefillPeriod); err != nil {
+		return err
+	}
+
+	if err := utils.ValidateRedisURL(a.RedisURL); err != nil {
+		return interfaces.NewFieldError("redisURL", `Invalid rate limit config "redisURL", `+err.Error())
+	}
+
+	return nil
+}
+
+func (a RedisGCRAArgs) algorithm() interfaces.Algorithm {
+	return interfaces.RedisGCRA
+}
+
+func (a RedisGCRAArgs) newLimiter(clock interfaces.Clock) interfaces.RateLimiter {
+	a.Clock = clockOr(a.Clock, clock)
+
+	return NewRedisGCRALimiter(a)
+}
+
+func validateGCRA(capacity int, refillRate float64, refillPeriod time.Duration) error {
+	if err := validatePositive("capacity", capacity); err != nil {
+		return err
+	}
+
+	if err := validatePositive("refillRate", refillRate); err != nil {
+		return err
+	}
+
+	return validateNotNegative("refillPeriod", refillPeriod)
+}
+
+// config fields shared by both variants
+var gcraFields = []interfaces.ConfigField{
+	{Name: "capacity", Type: interfaces.IntField, Required: true, Default: "10", Usage: "The maximum number of requests allowed in a burst"},
+	{Name: "refillRate", Type: interfaces.RateField, Required: true, Default: "1", Usage: "The number of requests to add every refill period, or per duration like 5/100ms"},
+	{Name: "refillPeriod", Type: interfaces.DurationField, Usage: "The period of the refill rate, e.g. 100ms. Defaults to 1s"},
+}
+
+func init() {
+	registerAlgorithm(interfaces.AlgorithmSpec{
+		Name:        interfaces.GCRA.String(),
+		Command:     "gcra",
+		Description: "Generic cell rate algorithm, a token bucket with one timestamp per user",
+		Fields:      append(append([]interfaces.ConfigField{}, gcraFields...), memoryFields...),
+	}, parseGCRAArgs)
+
+	registerAlgorithm(interfaces.AlgorithmSpec{
+		Name:        interfaces.RedisGCRA.String(),
+		Command:     "redisGcra",
+		Description: "Generic cell rate algorithm using Redis",
+		Fields:      append(append([]interfaces.ConfigField{}, gcraFields...), redisFields...),
+	}, parseRedisGCRAArgs)
+}
+
+// Rate Limiter Constructor
+func NewGCRALimiter(args GCRAArgs) interfaces.RateLimiter {
+	l := &gcraLimiter{
+		clock:           interfaces.ClockOrDefault(args.Clock),
+		usersMap:        utils.NewShardedMap[*userGCRA](utils.DefaultShards, args.MaxKeys),
+		defaultCapacity: args.Capacity,
+		defaultInterval: emissionInterval(args.RefillRate, args.RefillPeriod),
+	}
+
+	l.stopJanitor = utils.StartJanitor(args.CleanupInterval, l.cleanup)
+
+	return l
+}
+
+// Rate Limiter Constructor
+func NewRedisGCRALimiter(args RedisGCRAArgs) interfaces.RateLimiter {
+	return &redisGCRALimiter{
+		clock:           interfaces.ClockOrDefault(args.Clock),
+		redisClient:     utils.NewRedisClient(args.RedisURL),
+		keyPrefix:       redisKeyPrefix(args.KeyPrefix, interfaces.RedisGCRA),
+		defaultCapacity: args.Capacity,
+		defaultInterval: emissionInterval(args.RefillRate, args.RefillPeriod),
+	}
+}
+
+// emissionInterval returns the time to refill one token, the period defaults to one second
+func emissionInterval(rate float64, period time.Duration) time.Duration {
+	if period <= 0 {
+		period = time.Second
+	}
+
+	return max(time.Duration(float64(period)/rate), 1)
+}
+
+// parseGCRAArgs reads the arguments of the algorithm from a string config
+func parseGCRAArgs(config map[string]string) (GCRAArgs, error) {
+	r := newConfigReader(config)
+
+	args := GCRAArgs{MemoryArgs: r.memoryArgs(), Capacity: r.int("capacity")}
+	args.RefillRate, args.RefillPeriod = r.refillRate()
+
+	return args, r.err
+}
+
+// parseRedisGCRAArgs reads the arguments of the algorithm from a string config
+func parseRedisGCRAArgs(config map[string]string) (RedisGCRAArgs, error) {
+	r := newConfigReader(config)
+
+	args := RedisGCRAArgs{RedisURL: r.string("redisURL"), KeyPrefix: config["keyPrefix"], Capacity: r.int("capacity")}
+	args.RefillRate, args.RefillPeriod = r.refillRate()
+
+	return args, r.err
+}
+
+func (l *gcraLimiter) Allow(ctx context.Context, user string) (interfaces.RateLimiterStats, error) {
+	return l.AllowN(ctx, user, 1)
+}
+
+func (l *gcraLimiter) AllowN(ctx context.Context, user string, n int) (interfaces.RateLimiterStats, error) {
+	// do not count requests whose context is already done
+	if err := ctx.Err(); err != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
+
+	if err := validateTokens(n); err != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
+
+	users, unlock := l.usersMap.Lock(user)
+	defer unlock()
+
+	now := l.clock.Now()
+
+	g := l.userGCRA(users, user)
+
+	if err := g.checkTokens(now, n); err != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
+
+	return g.stats(now), nil
+}
+
+func (l *gcraLimiter) Reserve(ctx context.Context, user string, n int) (*interfaces.Reservation, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := validateTokens(n); err != nil {
+		return nil, err
+	}
+
+	users, unlock := l.usersMap.Lock(user)
+	defer unlock()
+
+	now := l.clock.Now()
+
+	g := l.userGCRA(users, user)
+
+	readyAt, err := g.reserveTokens(now, n)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return interfaces.NewReservation(true, readyAt.Sub(now), g.stats(now), func() {
+		_, unlock := l.usersMap.Lock(user)
+		defer unlock()
+
+		g.cancelTokens(l.clock.Now(), n, readyAt)
+	}), nil
+}
+
+func (l *gcraLimiter) Wait(ctx context.Context, user string) error {
+	return waitN(ctx, l, l.clock, user, 1)
+}
+
+func (l *gcraLimiter) Peek(ctx context.Context, user string) (interfaces.RateLimiterStats, error) {
+	if err := ctx.Err(); err != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
+
+	users, unlock := l.usersMap.Lock(user)
+	defer unlock()
+
+	g := users.Get(user)
+
+	if g == nil {
+		g = l.newUserGCRA()
+	}
+
+	return g.stats(l.clock.Now()), nil
+}
+
+func (l *gcraLimiter) Reset(ctx context.Context, user string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	users, unlock := l.usersMap.Lock(user)
+	defer unlock()
+
+	users.Delete(user)
+
+	return nil
+}
+
+func (l *gcraLimiter) Refund(ctx context.Context, user string, n int) (interfaces.RateLimiterStats, error) {
+	if err := ctx.Err(); err != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
+
+	if err := validateTokens(n); err != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
+
+	users, unlock := l.usersMap.Lock(user)
+	defer unlock()
+
+	now := l.clock.Now()
+
+	g := l.userGCRA(users, user)
+	g.refundTokens(now, n)
+
+	return g.stats(now), nil
+}
+
+func (l *gcraLimiter) SetRemaining(ctx context.Context, user string, n int) (interfaces.RateLimiterStats, error) {
+	if err := ctx.Err(); err != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
+
+	if err := validateTokens(n); err != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
+
+	users, unlock := l.usersMap.Lock(user)
+	defer unlock()
+
+	now := l.clock.Now()
+
+	g := l.userGCRA(users, user)
+	g.setRemaining(now, n)
+
+	return g.stats(now), nil
+}
+
+func (l *gcraLimiter) TrackedKeys() int {
+	return l.usersMap.Len()
+}
+
+func (l *gcraLimiter) Close() error {
+	l.stopJanitor()
+
+	return nil
+}
+
+// cleanup removes the users whose bucket is full again, they are created again on their next request
+func (l *gcraLimiter) cleanup() {
+	now := l.clock.Now()
+
+	l.usersMap.DeleteFunc(func(_ string, g *userGCRA) bool {
+		return g.full(now)
+	})
+}
+
+// read user from the map, first request for this user creates a new state
+func (l *gcraLimiter) userGCRA(users *utils.MapShard[*userGCRA], user string) *userGCRA {
+	g := users.Get(user)
+
+	if g == nil {
+		g = l.newUserGCRA()
+
+		users.Set(user, g)
+	}
+
+	return g
+}
+
+// create the initial state of a user, a TAT in the past is a full bucket
+func (l *gcraLimiter) newUserGCRA() *userGCRA {
+	return &userGCRA{Capacity: l.defaultCapacity, Interval: l.defaultInterval, algorithm: interfaces.GCRA}
+}
+
+func (l *redisGCRALimiter) Allow(ctx context.Context, user string) (interfaces.RateLimiterStats, error) {
+	return l.AllowN(ctx, user, 1)
+}
+
+func (l *redisGCRALimiter) AllowN(ctx context.Context, user string, n int) (interfaces.RateLimiterStats, error) {
+	if err := validateTokens(n); err != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
+
+	// check and move the TAT atomically. If the context expires before the script runs the request is not counted
+	now := l.clock.Now()
+	g, ok, err := l.run(ctx, user, now, gcraAllow, n)
+
+	if err != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
+
+	if !ok {
+		return interfaces.RateLimiterStats{}, g.limitError(now, n)
+	}
+
+	return g.stats(now), nil
+}
+
+func (l *redisGCRALimiter) Reserve(ctx context.Context, user string, n int) (*interfaces.Reservation, error) {
+	if err := validateTokens(n); err != nil {
+		return nil, err
+	}
+
+	op := gcraReserve
+
+	// the request can never be fulfilled, the TAT is only read to report the stats
+	if n > l.defaultCapacity {
+		op = gcraAllow
+	}
+
+	now := l.clock.Now()
+	g, ok, err := l.run(ctx, user, now, op, n)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, g.limitError(now, n)
+	}
+
+	readyAt := g.readyAt(now)
+
+	return interfaces.NewReservation(true, readyAt.Sub(l.clock.Now()), g.stats(now), func() {
+		now := l.clock.Now()
+
+		// tokens already spent past the ready time are not restored
+		if now.After(readyAt) {
+			return
+		}
+
+		// best effort, the reservation has no context of its own
+		_, _, _ = l.run(context.Background(), user, now, gcraRefund, n)
+	}), nil
+}
+
+func (l *redisGCRALimiter) Wait(ctx context.Context, user string) error {
+	return waitN(ctx, l, l.clock, user, 1)
+}
+
+func (l *redisGCRALimiter) Peek(ctx context.Context, user string) (interfaces.RateLimiterStats, error) {
+	now := l.clock.Now()
+	g, _, err := l.run(ctx, user, now, gcraPeek, 0)
+
+	if err != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
+
+	return g.stats(now), nil
+}
+
+func (l *redisGCRALimiter) Reset(ctx context.Context, user string) error {
+	return interfaces.NewBackendError(l.redisClient.Del(ctx, l.key(user)))
+}
+
+func (l *redisGCRALimiter) Refund(ctx context.Context, user string, n int) (interfaces.RateLimiterStats, error) {
+	if err := validateTokens(n); err != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
+
+	now := l.clock.Now()
+	g, _, err := l.run(ctx, user, now, gcraRefund, n)
+
+	if err != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
+
+	return g.stats(now), nil
+}
+
+func (l *redisGCRALimiter) SetRemaining(ctx context.Context, user string, n int) (interfaces.RateLimiterStats, error) {
+	if err := validateTokens(n); err != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
+
+	// the script moves the TAT by the tokens missing from a full bucket
+	now := l.clock.Now()
+	g, _, err := l.run(ctx, user, now, gcraSet, l.defaultCapacity-min(n, l.defaultCapacity))
+
+	if err != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
+
+	return g.stats(now), nil
+}
+
+// key returns the Redis key of the user
+func (l *redisGCRALimiter) key(user string) string {
+	return l.keyPrefix + user
+}
+
+func (l *redisGCRALimiter) Close() error {
+	return l.redisClient.Close()
+}
+
+// run applies op for n tokens to the TAT of the user in a single script and returns the resulting state
+// and whether the request was accepted. Redis failures are returned as ErrBackendUnavailable
+func (l *redisGCRALimiter) run(ctx context.Context, user string, now time.Time, op string, n int) (*userGCRA, bool, error) {
+	res, err := l.redisClient.Run(ctx, gcraScript, []string{l.key(user)},
+		now.Unix(), now.Nanosecond(), int64(l.defaultInterval), int64(l.newUserGCRA().burst()), n, op)
+
+	if err != nil {
+		return nil, false, interfaces.NewBackendError(err)
+	}
+
+	g := l.newUserGCRA()
+	g.TAT = now.Add(time.Duration(res[1]))
+
+	return g, res[0] == 1, nil
+}
+
+// create the initial state of a user, a TAT in the past is a full bucket
+func (l *redisGCRALimiter) newUserGCRA() *userGCRA {
+	return &userGCRA{Capacity: l.defaultCapacity, Interval: l.defaultInterval, algorithm: interfaces.RedisGCRA}
+}
+
+// burst returns how far ahead of now the TAT may be, the time to refill the whole capacity
+func (g *userGCRA) burst() time.Duration {
+	return time.Duration(g.Capacity) * g.Interval
+}
+
+// tat returns the theoretical arrival time, never before now
+func (g *userGCRA) tat(now time.Time) time.Time {
+	return latest(g.TAT, now)
+}
+
+func (g *userGCRA) checkTokens(now time.Time, n int) error {
+	tat := g.tat(now).Add(time.Duration(n) * g.Interval)
+
+	// the TAT would move too far ahead, nothing is consumed
+	if tat.Sub(now) > g.burst() {
+		return g.limitError(now, n)
+	}
+
+	g.TAT = tat
+
+	return nil
+}
+
+// reserveTokens moves the TAT even beyond the burst and returns when the tokens are refilled
+func (g *userGCRA) reserveTokens(now time.Time, n int) (time.Time, error) {
+	// the request can never be fulfilled
+	if n > g.Capacity {
+		return time.Time{}, g.limitError(now, n)
+	}
+
+	g.TAT = g.tat(now).Add(time.Duration(n) * g.Interval)
+
+	return g.readyAt(now), nil
+}
+
+// readyAt returns when the tokens reserved last are refilled, the TAT is then back within the burst
+func (g *userGCRA) readyAt(now time.Time) time.Time {
+	return latest(g.TAT.Add(-g.burst()), now)
+}
+
+// limitError returns the error of a denied request with the exact time until n tokens are available
+func (g *userGCRA) limitError(now time.Time, n int) error {
+	var retryAfter time.Duration
+
+	if n <= g.Capacity {
+		retryAfter = g.tat(now).Add(time.Duration(n) * g.Interval).Add(-g.burst()).Sub(now)
+	}
+
+	return interfaces.NewRateLimitedError(g.stats(now), retryAfter)
+}
+
+// cancelTokens gives back n tokens reserved for readyAt, tokens already spent past that time are not restored
+func (g *userGCRA) cancelTokens(now time.Time, n int, readyAt time.Time) {
+	if now.After(readyAt) {
+		return
+	}
+
+	g.refundTokens(now, n)
+}
+
+// refundTokens moves the TAT back by n tokens, a bucket is never fuller than its capacity
+func (g *userGCRA) refundTokens(now time.Time, n int) {
+	g.TAT = latest(g.TAT.Add(-time.Duration(n)*g.Interval), now)
+}
+
+// setRemaining overrides the number of available tokens
+func (g *userGCRA) setRemaining(now time.Time, n int) {
+	g.TAT = now.Add(time.Duration(g.Capacity-min(n, g.Capacity)) * g.Interval)
+}
+
+// full reports whether the bucket is full again, the same state as a new user
+func (g *userGCRA) full(now time.Time) bool {
+	return !g.TAT.After(now)
+}
+
+// Return the rate limit stats for the user, reset is the TAT: the time the bucket is full again
+func (g *userGCRA) stats(now time.Time) interfaces.RateLimiterStats {
+	used := g.tat(now).Sub(now)
+
+	return interfaces.RateLimiterStats{
+		Algorithm:   g.algorithm.String(),
+		Capacity:    g.Capacity,
+		Remaining:   max(int((g.burst()-used)/g.Interval), 0),
+		Reset:       g.tat(now),
+		CurrentTime: now,
+	}
+}
@@ -0,0 +1,561 @@
+package algorithms
+
+/*
+Leaky Bucket Algorithm
+Every user has a bucket that leaks at a constant rate, leak rate units per leak period (one second by default).
+It comes in two forms:
+- meter: every request pours n units in the bucket, a request that would overflow it is declined right away.
+  The traffic may burst up to the capacity, then it is held to the leak rate.
+- queue: requests wait in a bounded queue of capacity requests and are released one after the other at the leak rate,
+  the outflow is constant. Allow blocks until the request is released, a request that finds the queue full is declined.
+*/
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/carantes/go-rate-limiter/lib/internal/interfaces"
+	"github.com/carantes/go-rate-limiter/lib/internal/utils"
+)
+
+// LeakyBucketMode is the form of the leaky bucket
+type LeakyBucketMode string
+
+const (
+	LeakyBucketMeter LeakyBucketMode = "meter" // declines the requests that overflow the bucket, the default
+	LeakyBucketQueue LeakyBucketMode = "queue" // delays the requests to release them at the leak rate
+)
+
+// LeakyBucketLimiter implements the RateLimiter interface
+type leakyBucketLimiter struct {
+	clock             interfaces.Clock
+	usersMap          *utils.ShardedMap[leakyBucket] // users state, safe for concurrent use
+	defaultCapacity   int
+	defaultLeakRate   float64
+	defaultLeakPeriod time.Duration
+	mode              LeakyBucketMode
+	stopJanitor       func() // stops the background cleanup
+}
+
+// leakyBucket is the state of a user, in one of the two forms
+type leakyBucket interface {
+	// allowTokens admits n units and returns when they are released, now for the meter
+	allowTokens(now time.Time, n int) (time.Time, error)
+	// reserveTokens admits n units ahead of time, ok is false when they cannot be admitted before readyAt
+	reserveTokens(now time.Time, n int) (readyAt time.Time, ok bool, err error)
+	// cancelTokens gives back n units admitted to be released at readyAt
+	cancelTokens(now time.Time, n int, readyAt time.Time)
+	refundTokens(now time.Time, n int)
+	setRemaining(now time.Time, n int)
+	// full reports whether the bucket is back to empty, the same state as a new bucket
+	full(now time.Time) bool
+	stats(now time.Time) interfaces.RateLimiterStats
+}
+
+// userLeakyMeter is the bucket of a user in the meter form
+type userLeakyMeter struct {
+	level    float64   // units in the bucket, above the capacity when units are reserved ahead
+	capacity int       // maximum number of units
+	rate     float64   // number of units leaked per nanosecond
+	lastLeak time.Time // last time the bucket leaked
+}
+
+// userLeakyQueue is the queue of a user in the queue form
+type userLeakyQueue struct {
+	capacity int           // maximum number of queued requests
+	interval time.Duration // time between two releases
+	tail     time.Time     // release time of the last queued request
+}
+
+type LeakyBucketArgs struct {
+	MemoryArgs
+	Capacity   int
+	LeakRate   float64          // number of units leaked, or requests released, every leak period. Can be fractional
+	LeakPeriod time.Duration    // period of the leak rate, defaults to one second
+	Mode       LeakyBucketMode  // meter or queue, defaults to meter
+	Clock      interfaces.Clock // source of time, defaults to the system clock
+}
+
+func (a LeakyBucketArgs) Validate() error {
+	if err := validatePositive("capacity", a.Capacity); err != nil {
+		return err
+	}
+
+	if err := validatePositive("leakRate", a.LeakRate); err != nil {
+		return err
+	}
+
+	if err := validateNotNegative("leakPeriod", a.LeakPeriod); err != nil {
+		return err
+	}
+
+	switch a.Mode {
+	case "", LeakyBucketMeter, LeakyBucketQueue:
+	default:
+		return interfaces.NewFieldError("mode", fmt.Sprintf(`Invalid rate limit config "mode", %q is not "meter" or "queue"`, a.Mode))
+	}
+
+	return a.MemoryArgs.Validate()
+}
+
+func (a LeakyBucketArgs) algorithm() interfaces.Algorithm {
+	return interfaces.LeakyBucket
+}
+
+func (a LeakyBucketArgs) newLimiter(clock interfaces.Clock) interfaces.RateLimiter {
+	a.Clock = clockOr(a.Clock, clock)
+
+	return NewLeakyBucketLimiter(a)
+}
+
+func init() {
+	registerAlgorithm(interfaces.AlgorithmSpec{
+		Name:        interfaces.LeakyBucket.String(),
+		Command:     "leakyBucket",
+		Description: "Leaky bucket rate limit algorithm, as a meter or a queue",
+		Fields: append([]interfaces.ConfigField{
+			{Name: "capacity", Type: interfaces.IntField, Required: true, Default: "10", Usage: "The size of the bucket, or the maximum number of queued requests"},
+			{Name: "leakRate", Type: interfaces.RateField, Required: true, Default: "1", Usage: "The number of requests leaked every leak period, or per duration like 5/100ms"},
+			{Name: "leakPeriod", Type: interfaces.DurationField, Usage: "The period of the leak rate, e.g. 100ms. Defaults to 1s"},
+			{Name: "mode", Type: interfaces.StringField, Default: string(LeakyBucketMeter), Usage: `"meter" declines the requests that overflow the bucket, "queue" delays them to a constant outflow`},
+		}, memoryFields...),
+	}, parseLeakyBucketArgs)
+}
+
+// Rate Limiter Constructor
+func NewLeakyBucketLimiter(args LeakyBucketArgs) interfaces.RateLimiter {
+	l := &leakyBucketLimiter{
+		clock:             interfaces.ClockOrDefault(args.Clock),
+		usersMap:          utils.NewShardedMap[leakyBucket](utils.DefaultShards, args.MaxKeys),
+		defaultCapacity:   args.Capacity,
+		defaultLeakRate:   args.LeakRate,
+		defaultLeakPeriod: args.LeakPeriod,
+		mode:              args.Mode,
+	}
+
+	if l.defaultLeakPeriod <= 0 {
+		l.defaultLeakPeriod = time.Second
+	}
+
+	if l.mode == "" {
+		l.mode = LeakyBucketMeter
+	}
+
+	l.stopJanitor = utils.StartJanitor(args.CleanupInterval, l.cleanup)
+
+	return l
+}
+
+// parseLeakyBucketArgs reads the arguments of the algorithm from a string config
+func parseLeakyBucketArgs(config map[string]string) (LeakyBucketArgs, error) {
+	r := newConfigReader(config)
+
+	args := LeakyBucketArgs{
+		MemoryArgs: r.memoryArgs(),
+		Capacity:   r.int("capacity"),
+		LeakPeriod: r.optionalDuration("leakPeriod"),
+		Mode:       LeakyBucketMode(config["mode"]),
+	}
+
+	var period time.Duration
+	args.LeakRate, period = r.rate("leakRate")
+
+	// the period can be given with the rate, e.g. "5/100ms"
+	if period > 0 {
+		if args.LeakPeriod > 0 {
+			r.fail("leakPeriod", `Invalid rate limit config "leakPeriod", the leak rate already has a period`)
+		}
+
+		args.LeakPeriod = period
+	}
+
+	return args, r.err
+}
+
+func (l *leakyBucketLimiter) Allow(ctx context.Context, user string) (interfaces.RateLimiterStats, error) {
+	return l.AllowN(ctx, user, 1)
+}
+
+// AllowN admits n units. In the queue form it blocks until the request is released,
+// the request leaves the queue when the context is done first
+func (l *leakyBucketLimiter) AllowN(ctx context.Context, user string, n int) (interfaces.RateLimiterStats, error) {
+	// do not count requests whose context is already done
+	if err := ctx.Err(); err != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
+
+	if err := validateTokens(n); err != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
+
+	users, unlock := l.usersMap.Lock(user)
+
+	now := l.clock.Now()
+
+	bucket := l.userBucket(users, now, user)
+
+	readyAt, err := bucket.allowTokens(now, n)
+	stats := bucket.stats(now)
+
+	unlock()
+
+	if err != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
+
+	if delay := readyAt.Sub(now); delay > 0 {
+		select {
+		case <-ctx.Done():
+			l.cancel(bucket, user, n, readyAt)
+			return interfaces.RateLimiterStats{}, ctx.Err()
+		case <-l.clock.After(delay):
+		}
+	}
+
+	return stats, nil
+}
+
+func (l *leakyBucketLimiter) Reserve(ctx context.Context, user string, n int) (*interfaces.Reservation, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := validateTokens(n); err != nil {
+		return nil, err
+	}
+
+	users, unlock := l.usersMap.Lock(user)
+	defer unlock()
+
+	now := l.clock.Now()
+
+	bucket := l.userBucket(users, now, user)
+
+	readyAt, ok, err := bucket.reserveTokens(now, n)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return interfaces.NewReservation(ok, readyAt.Sub(now), bucket.stats(now), func() {
+		l.cancel(bucket, user, n, readyAt)
+	}), nil
+}
+
+func (l *leakyBucketLimiter) Wait(ctx context.Context, user string) error {
+	return waitN(ctx, l, l.clock, user, 1)
+}
+
+func (l *leakyBucketLimiter) Peek(ctx context.Context, user string) (interfaces.RateLimiterStats, error) {
+	if err := ctx.Err(); err != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
+
+	users, unlock := l.usersMap.Lock(user)
+	defer unlock()
+
+	now := l.clock.Now()
+
+	bucket := users.Get(user)
+
+	if bucket == nil {
+		bucket = l.newUserBucket(now)
+	}
+
+	return bucket.stats(now), nil
+}
+
+func (l *leakyBucketLimiter) Reset(ctx context.Context, user string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	users, unlock := l.usersMap.Lock(user)
+	defer unlock()
+
+	users.Delete(user)
+
+	return nil
+}
+
+func (l *leakyBucketLimiter) Refund(ctx context.Context, user string, n int) (interfaces.RateLimiterStats, error) {
+	if err := ctx.Err(); err != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
+
+	if err := validateTokens(n); err != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
+
+	users, unlock := l.usersMap.Lock(user)
+	defer unlock()
+
+	now := l.clock.Now()
+
+	bucket := l.userBucket(users, now, user)
+	bucket.refundTokens(now, n)
+
+	return bucket.stats(now), nil
+}
+
+func (l *leakyBucketLimiter) SetRemaining(ctx context.Context, user string, n int) (interfaces.RateLimiterStats, error) {
+	if err := ctx.Err(); err != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
+
+	if err := validateTokens(n); err != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
+
+	users, unlock := l.usersMap.Lock(user)
+	defer unlock()
+
+	now := l.clock.Now()
+
+	bucket := l.userBucket(users, now, user)
+	bucket.setRemaining(now, n)
+
+	return bucket.stats(now), nil
+}
+
+func (l *leakyBucketLimiter) TrackedKeys() int {
+	return l.usersMap.Len()
+}
+
+func (l *leakyBucketLimiter) Close() error {
+	l.stopJanitor()
+
+	return nil
+}
+
+// cleanup removes the users whose bucket is back to empty, they are created again on their next request
+func (l *leakyBucketLimiter) cleanup() {
+	now := l.clock.Now()
+
+	l.usersMap.DeleteFunc(func(_ string, b leakyBucket) bool {
+		return b.full(now)
+	})
+}
+
+// cancel gives back n units admitted to be released at readyAt
+func (l *leakyBucketLimiter) cancel(bucket leakyBucket, user string, n int, readyAt time.Time) {
+	_, unlock := l.usersMap.Lock(user)
+	defer unlock()
+
+	bucket.cancelTokens(l.clock.Now(), n, readyAt)
+}
+
+// read user from the map, first request for this user creates a new bucket
+func (l *leakyBucketLimiter) userBucket(users *utils.MapShard[leakyBucket], now time.Time, user string) leakyBucket {
+	bucket := users.Get(user)
+
+	if bucket == nil {
+		bucket = l.newUserBucket(now)
+
+		users.Set(user, bucket)
+	}
+
+	return bucket
+}
+
+// create the initial state of a user, an empty bucket
+func (l *leakyBucketLimiter) newUserBucket(now time.Time) leakyBucket {
+	if l.mode == LeakyBucketQueue {
+		return &userLeakyQueue{
+			capacity: l.defaultCapacity,
+			interval: max(time.Duration(float64(l.defaultLeakPeriod)/l.defaultLeakRate), 1),
+		}
+	}
+
+	return &userLeakyMeter{
+		capacity: l.defaultCapacity,
+		rate:     l.defaultLeakRate / float64(l.defaultLeakPeriod),
+		lastLeak: now,
+	}
+}
+
+func (b *userLeakyMeter) allowTokens(now time.Time, n int) (time.Time, error) {
+	b.leak(now)
+
+	// the request would overflow the bucket, nothing is poured
+	if b.level+float64(n) > float64(b.capacity)+tokenEpsilon {
+		return time.Time{}, b.limitError(now, n)
+	}
+
+	b.level += float64(n)
+
+	return now, nil
+}
+
+// reserveTokens pours n units even if the bucket overflows and returns when it is back to its capacity
+func (b *userLeakyMeter) reserveTokens(now time.Time, n int) (time.Time, bool, error) {
+	b.leak(now)
+
+	// the request can never be fulfilled
+	if n > b.capacity {
+		return time.Time{}, false, b.limitError(now, n)
+	}
+
+	b.level += float64(n)
+
+	return now.Add(b.leakTime(float64(b.capacity))), true, nil
+}
+
+func (b *userLeakyMeter) cancelTokens(now time.Time, n int, _ time.Time) {
+	b.refundTokens(now, n)
+}
+
+// refundTokens takes n units out of the bucket
+func (b *userLeakyMeter) refundTokens(now time.Time, n int) {
+	b.leak(now)
+
+	b.level = max(b.level-float64(n), 0)
+}
+
+// setRemaining overrides the room left in the bucket
+func (b *userLeakyMeter) setRemaining(now time.Time, n int) {
+	b.leak(now)
+
+	b.level = float64(b.capacity - min(n, b.capacity))
+}
+
+func (b *userLeakyMeter) full(now time.Time) bool {
+	return b.levelAt(now) <= tokenEpsilon
+}
+
+// limitError returns the error of a denied request with the time until n units fit in the bucket
+func (b *userLeakyMeter) limitError(now time.Time, n int) error {
+	var retryAfter time.Duration
+
+	if n <= b.capacity {
+		retryAfter = b.leakTime(float64(b.capacity - n))
+	}
+
+	return interfaces.NewRateLimitedError(b.stats(now), retryAfter)
+}
+
+// leak removes the units leaked since the last leak
+func (b *userLeakyMeter) leak(now time.Time) {
+	b.level = b.levelAt(now)
+
+	if now.After(b.lastLeak) {
+		b.lastLeak = now
+	}
+}
+
+// levelAt returns the level of the bucket at the given time, the bucket is not changed
+func (b *userLeakyMeter) levelAt(now time.Time) float64 {
+	elapsed := now.Sub(b.lastLeak)
+
+	if elapsed <= 0 {
+		return b.level
+	}
+
+	return max(b.level-float64(elapsed)*b.rate, 0)
+}
+
+// leakTime returns the time until the bucket is down to the given level, measured from the last leak
+func (b *userLeakyMeter) leakTime(level float64) time.Duration {
+	excess := b.level - level
+
+	if excess <= tokenEpsilon {
+		return 0
+	}
+
+	return time.Duration(math.Ceil(excess / b.rate))
+}
+
+// Return the rate limit stats for the user, reset is the time the bucket is empty again
+func (b *userLeakyMeter) stats(now time.Time) interfaces.RateLimiterStats {
+	bucket := *b
+	bucket.leak(now)
+
+	return interfaces.RateLimiterStats{
+		Algorithm:   interfaces.LeakyBucket.String(),
+		Capacity:    bucket.capacity,
+		Remaining:   max(int(math.Floor(float64(bucket.capacity)-bucket.level+tokenEpsilon)), 0),
+		Reset:       bucket.lastLeak.Add(bucket.leakTime(0)),
+		CurrentTime: now,
+	}
+}
+
+// allowTokens queues n requests behind the last one and returns when they are released
+func (q *userLeakyQueue) allowTokens(now time.Time, n int) (time.Time, error) {
+	readyAt, ok, err := q.reserveTokens(now, n)
+
+	if err == nil && !ok {
+		err = interfaces.NewRateLimitedError(q.stats(now), readyAt.Sub(now))
+	}
+
+	return readyAt, err
+}
+
+// reserveTokens queues n requests, ok is false while the queue is full and readyAt is when there is room
+func (q *userLeakyQueue) reserveTokens(now time.Time, n int) (time.Time, bool, error) {
+	// the request can never be fulfilled
+	if n > q.capacity {
+		return time.Time{}, false, interfaces.NewRateLimitedError(q.stats(now), 0)
+	}
+
+	if q.queued(now)+n > q.capacity {
+		return q.tail.Add(-time.Duration(q.capacity-n) * q.interval), false, nil
+	}
+
+	// one release every interval, a request on an idle queue is released right away
+	q.tail = latest(q.tail.Add(q.interval), now).Add(time.Duration(n-1) * q.interval)
+
+	return q.tail, true, nil
+}
+
+// cancelTokens takes the requests out of the queue when they are the last ones,
+// otherwise their releases are left empty so that the requests behind them keep their place
+func (q *userLeakyQueue) cancelTokens(_ time.Time, n int, readyAt time.Time) {
+	if q.tail.Equal(readyAt) {
+		q.tail = q.tail.Add(-time.Duration(n) * q.interval)
+	}
+}
+
+// refundTokens frees the room of n requests, the next ones are released sooner
+func (q *userLeakyQueue) refundTokens(now time.Time, n int) {
+	q.tail = latest(q.tail.Add(-time.Duration(n)*q.interval), now.Add(-q.interval))
+}
+
+// setRemaining overrides the room left in the queue
+func (q *userLeakyQueue) setRemaining(now time.Time, n int) {
+	q.tail = now.Add(time.Duration(q.capacity-min(n, q.capacity)) * q.interval)
+}
+
+func (q *userLeakyQueue) full(now time.Time) bool {
+	return !q.tail.Add(q.interval).After(now)
+}
+
+// queued returns the number of requests waiting for their release
+func (q *userLeakyQueue) queued(now time.Time) int {
+	if !q.tail.After(now) {
+		return 0
+	}
+
+	return int((q.tail.Sub(now) + q.interval - 1) / q.interval)
+}
+
+// Return the rate limit stats for the user, remaining is the room left in the queue and reset the time it is empty
+func (q *userLeakyQueue) stats(now time.Time) interfaces.RateLimiterStats {
+	return interfaces.RateLimiterStats{
+		Algorithm:   interfaces.LeakyBucket.String(),
+		Capacity:    q.capacity,
+		Remaining:   max(q.capacity-q.queued(now), 0),
+		Reset:       latest(q.tail, now),
+		CurrentTime: now,
+	}
+}
+
+// latest returns the later of two times
+func latest(a time.Time, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+
+	return b
+}
@@ -0,0 +1,35 @@
+package algorithms
+
+import (
+	"time"
+
+	"github.com/carantes/go-rate-limiter/lib/internal/interfaces"
+)
+
+// MemoryArgs bounds the memory used by an in-memory rate limiter
+type MemoryArgs struct {
+	MaxKeys         int           // maximum number of tracked users, the least recently used are evicted first. Zero means unbounded
+	CleanupInterval time.Duration // how often users whose state is back to full are removed. Zero disables the cleanup
+}
+
+// config fields of the memory settings, shared by the in-memory algorithms
+var memoryFields = []interfaces.ConfigField{
+	{Name: "maxKeys", Type: interfaces.IntField, Default: "0", Usage: "The maximum number of users kept in memory, 0 means unbounded"},
+	{Name: "cleanupInterval", Type: interfaces.DurationField, Default: "1m", Usage: "How often idle users are removed from memory, 0 disables the cleanup"},
+}
+
+func (a MemoryArgs) Validate() error {
+	if err := validateNotNegative("maxKeys", a.MaxKeys); err != nil {
+		return err
+	}
+
+	return validateNotNegative("cleanupInterval", a.CleanupInterval)
+}
+
+// memoryArgs reads the optional memory settings of a config
+func (r *configReader) memoryArgs() MemoryArgs {
+	return MemoryArgs{
+		MaxKeys:         r.optionalInt("maxKeys"),
+		CleanupInterval: r.optionalDuration("cleanupInterval"),
+	}
+}
@@ -0,0 +1,325 @@
+package algorithms
+
+/*
+Multi Limiter
+Evaluates several rate limiters for the same user as one decision, e.g. 10/second, 500/minute and 10,000/day.
+Tokens are reserved on every limit in order, when one of them cannot serve the request now the reservations
+already made are cancelled, so a denied request consumes nothing. Decisions for the same user are serialized
+within the process. With Redis limiters shared by several processes, a concurrent request may briefly see
+tokens that are given back, it can be denied but never allowed over a limit.
+
+Limits can be nested: each one may count the user under its own key, e.g. the tenant of the user or a global
+key shared by every user. A request consumes from every level and the denial names the level that blocked it.
+Requests of different users are not serialized, like with Redis they may briefly see the tokens of a shared level
+that are given back, but never go over it.
+*/
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/carantes/go-rate-limiter/lib/internal/interfaces"
+	"github.com/carantes/go-rate-limiter/lib/internal/utils"
+)
+
+// GlobalKey counts every user under the same key, for limits shared by the whole server
+func GlobalKey(string) string {
+	return "*"
+}
+
+// ParentKey counts a user under its parent: the part of the key before the last "/", e.g. "acme" for "acme/alice".
+// Keys without a parent are counted under the global key
+func ParentKey(user string) string {
+	i := strings.LastIndex(user, "/")
+
+	if i < 0 {
+		return GlobalKey(user)
+	}
+
+	return user[:i]
+}
+
+// NamedLimiter is one of the limits of a multi limiter, the name is reported when it denies a request
+type NamedLimiter struct {
+	Name    string
+	Limiter interfaces.RateLimiter
+	Key     func(user string) string // key of the user at this level, e.g. ParentKey or GlobalKey, the user itself when nil
+}
+
+// KeyedLimit is a limit with the key a request is counted under, see AllowAll
+type KeyedLimit struct {
+	Name    string
+	Limiter interfaces.RateLimiter
+	Key     string
+}
+
+// rejectionRecorder is implemented by the limiters that log the requests they deny. A multi limiter denies through
+// Reserve and Cancel, it records the denial on the limit that made it once the reservations are cancelled
+type rejectionRecorder interface {
+	recordRejected(user string, n int)
+}
+
+// MultiLimiterArgs lists the limits checked for every request, in order
+type MultiLimiterArgs struct {
+	Limits []NamedLimiter
+	Clock  interfaces.Clock // source of time of Wait, defaults to the system clock
+}
+
+func (a MultiLimiterArgs) Validate() error {
+	if len(a.Limits) == 0 {
+		return interfaces.NewFieldError("limits", "A multi limiter needs at least one limit")
+	}
+
+	seen := make(map[string]bool)
+
+	for _, l := range a.Limits {
+		if l.Name == "" {
+			return interfaces.NewFieldError("name", "Missing limit name")
+		}
+
+		if seen[l.Name] {
+			return interfaces.NewFieldError("name", fmt.Sprintf("Duplicate limit name %q", l.Name))
+		}
+
+		seen[l.Name] = true
+
+		if l.Limiter == nil {
+			return interfaces.NewFieldError("limiter", fmt.Sprintf("Missing rate limiter of limit %q", l.Name))
+		}
+	}
+
+	return nil
+}
+
+// multiLimiter implements the RateLimiter interface on top of several limiters
+type multiLimiter struct {
+	clock  interfaces.Clock
+	limits []NamedLimiter
+	locks  *utils.ShardedMap[struct{}] // serializes the decisions of a user
+}
+
+// Rate Limiter Constructor
+func NewMultiLimiter(args MultiLimiterArgs) interfaces.RateLimiter {
+	return &multiLimiter{
+		clock:  interfaces.ClockOrDefault(args.Clock),
+		limits: args.Limits,
+		locks:  utils.NewShardedMap[struct{}](utils.DefaultShards, 0),
+	}
+}
+
+func (m *multiLimiter) Allow(ctx context.Context, user string) (interfaces.RateLimiterStats, error) {
+	return m.AllowN(ctx, user, 1)
+}
+
+func (m *multiLimiter) AllowN(ctx context.Context, user string, n int) (interfaces.RateLimiterStats, error) {
+	_, unlock := m.locks.Lock(user)
+	defer unlock()
+
+	return AllowAll(ctx, m.keyed(user), n)
+}
+
+func (m *multiLimiter) Reserve(ctx context.Context, user string, n int) (*interfaces.Reservation, error) {
+	_, unlock := m.locks.Lock(user)
+	defer unlock()
+
+	reservations, stats, err := reserveAll(ctx, m.keyed(user), n, false)
+
+	var rlErr *interfaces.RateLimitError
+
+	// a limit cannot hold the tokens now, tell when to try again
+	if errors.As(err, &rlErr) && errors.Is(err, interfaces.ErrRateLimited) && rlErr.RetryAfter > 0 {
+		return interfaces.NewReservation(false, rlErr.RetryAfter, rlErr.Stats, nil), nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var delay = reservations[0].Delay()
+
+	for _, r := range reservations[1:] {
+		delay = max(delay, r.Delay())
+	}
+
+	return interfaces.NewReservation(true, delay, stats, func() {
+		cancelAll(reservations)
+	}), nil
+}
+
+func (m *multiLimiter) Wait(ctx context.Context, user string) error {
+	return waitN(ctx, m, m.clock, user, 1)
+}
+
+func (m *multiLimiter) Peek(ctx context.Context, user string) (interfaces.RateLimiterStats, error) {
+	return m.each(user, true, func(l interfaces.RateLimiter, key string) (interfaces.RateLimiterStats, error) {
+		return l.Peek(ctx, key)
+	})
+}
+
+// Reset only drops the state of the levels counted under the user key, shared levels are left alone
+func (m *multiLimiter) Reset(ctx context.Context, user string) error {
+	_, err := m.each(user, false, func(l interfaces.RateLimiter, key string) (interfaces.RateLimiterStats, error) {
+		return interfaces.RateLimiterStats{}, l.Reset(ctx, key)
+	})
+
+	return err
+}
+
+// Refund gives the tokens back to every level, the way a request consumed them
+func (m *multiLimiter) Refund(ctx context.Context, user string, n int) (interfaces.RateLimiterStats, error) {
+	return m.each(user, true, func(l interfaces.RateLimiter, key string) (interfaces.RateLimiterStats, error) {
+		return l.Refund(ctx, key, n)
+	})
+}
+
+// SetRemaining only changes the levels counted under the user key, shared levels are left alone
+func (m *multiLimiter) SetRemaining(ctx context.Context, user string, n int) (interfaces.RateLimiterStats, error) {
+	return m.each(user, false, func(l interfaces.RateLimiter, key string) (interfaces.RateLimiterStats, error) {
+		return l.SetRemaining(ctx, key, n)
+	})
+}
+
+// Close closes every limit and returns the first error
+func (m *multiLimiter) Close() error {
+	var first error
+
+	for _, l := range m.limits {
+		if err := l.Limiter.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+
+	return first
+}
+
+// AllowAll checks a request against every limit as one decision. The tokens are taken from every limit,
+// or from none of them when one of the limits denies the request, the error then names that limit.
+// It returns the stats of the most restrictive limit
+func AllowAll(ctx context.Context, limits []KeyedLimit, n int) (interfaces.RateLimiterStats, error) {
+	// a single limit decides on its own, e.g. a leaky bucket queue delays the request instead of denying it
+	if len(limits) == 1 {
+		stats, err := limits[0].Limiter.AllowN(ctx, limits[0].Key, n)
+
+		return stats, withLimitName(err, limits[0].Name)
+	}
+
+	// the reservations are kept, their tokens are consumed
+	_, stats, err := reserveAll(ctx, limits, n, true)
+
+	return stats, err
+}
+
+// reserveAll takes n tokens from every limit in order. When a limit cannot hold them, or cannot serve them now
+// and now is set, the reservations already made are cancelled and the error names the limit
+func reserveAll(ctx context.Context, limits []KeyedLimit, n int, now bool) ([]*interfaces.Reservation, interfaces.RateLimiterStats, error) {
+	reservations := make([]*interfaces.Reservation, 0, len(limits))
+	var stats interfaces.RateLimiterStats
+
+	for i, l := range limits {
+		r, err := l.Limiter.Reserve(ctx, l.Key, n)
+
+		denied := err == nil && r.OK() && now && r.Delay() > 0
+
+		if err == nil && (!r.OK() || denied) {
+			r.Cancel()
+			err = interfaces.NewRateLimitedError(r.Stats(), r.Delay())
+		}
+
+		if err != nil {
+			cancelAll(reservations)
+
+			// the limit that denied the request counts it like AllowN would, e.g. a sliding window log counting rejected requests
+			if rec, ok := l.Limiter.(rejectionRecorder); ok && denied {
+				rec.recordRejected(l.Key, n)
+			}
+
+			return nil, interfaces.RateLimiterStats{}, withLimitName(err, l.Name)
+		}
+
+		reservations = append(reservations, r)
+
+		if i == 0 || moreRestrictive(r.Stats(), stats) {
+			stats = r.Stats()
+		}
+	}
+
+	return reservations, stats, nil
+}
+
+// keyed returns the limits with the key of the user at each level
+func (m *multiLimiter) keyed(user string) []KeyedLimit {
+	limits := make([]KeyedLimit, len(m.limits))
+
+	for i, l := range m.limits {
+		limits[i] = KeyedLimit{Name: l.Name, Limiter: l.Limiter, Key: keyOf(l, user)}
+	}
+
+	return limits
+}
+
+// each runs fn on the limits with the key of the user, shared levels are skipped unless shared is set.
+// It returns the stats of the most restrictive limit, or the first error
+func (m *multiLimiter) each(user string, shared bool, fn func(l interfaces.RateLimiter, key string) (interfaces.RateLimiterStats, error)) (interfaces.RateLimiterStats, error) {
+	var stats interfaces.RateLimiterStats
+	first := true
+
+	for _, l := range m.limits {
+		if l.Key != nil && !shared {
+			continue
+		}
+
+		s, err := fn(l.Limiter, keyOf(l, user))
+
+		if err != nil {
+			return interfaces.RateLimiterStats{}, withLimitName(err, l.Name)
+		}
+
+		if first || moreRestrictive(s, stats) {
+			stats = s
+			first = false
+		}
+	}
+
+	return stats, nil
+}
+
+// keyOf returns the key the user is counted under by the limit
+func keyOf(l NamedLimiter, user string) string {
+	if l.Key == nil {
+		return user
+	}
+
+	return l.Key(user)
+}
+
+// cancelAll gives back the tokens of the reservations, in reverse order
+func cancelAll(reservations []*interfaces.Reservation) {
+	for i := len(reservations) - 1; i >= 0; i-- {
+		reservations[i].Cancel()
+	}
+}
+
+// moreRestrictive reports whether a leaves fewer tokens than b, or as many tokens for longer
+func moreRestrictive(a interfaces.RateLimiterStats, b interfaces.RateLimiterStats) bool {
+	if a.Remaining != b.Remaining {
+		return a.Remaining < b.Remaining
+	}
+
+	return a.Reset.After(b.Reset)
+}
+
+// withLimitName records the name of the limit in the rate limit errors, other errors are returned as they are
+func withLimitName(err error, name string) error {
+	var rlErr *interfaces.RateLimitError
+
+	if !errors.As(err, &rlErr) {
+		return err
+	}
+
+	named := *rlErr
+	named.LimitName = name
+
+	return &named
+}
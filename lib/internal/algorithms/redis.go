@@ -0,0 +1,19 @@
+package algorithms
+
+import "github.com/carantes/go-rate-limiter/lib/internal/interfaces"
+
+// config fields of the Redis settings, shared by the Redis algorithms
+var redisFields = []interfaces.ConfigField{
+	{Name: "redisURL", Type: interfaces.StringField, Required: true, Default: "redis://localhost:6379/0", Usage: "The URL of the Redis server"},
+	{Name: "keyPrefix", Type: interfaces.StringField, Usage: "The prefix of the Redis keys, e.g. the name of the limit. Limits sharing a Redis server need different prefixes"},
+}
+
+// redisKeyPrefix returns the prefix of the Redis keys of a limiter, the algorithm keeps apart the state of limits
+// of different algorithms that share a prefix
+func redisKeyPrefix(keyPrefix string, algorithm interfaces.Algorithm) string {
+	if keyPrefix == "" {
+		return algorithm.String() + ":"
+	}
+
+	return keyPrefix + ":" + algorithm.String() + ":"
+}
@@ -0,0 +1,242 @@
+package algorithms
+
+/*
+Concurrency Limiter across multiple servers using Redis
+The slots are leases kept in Redis sorted sets, one per key and one for every key, scored by their expiry time.
+A lease is renewed while the request is in flight and removed when it is released. The leases of a server that
+stops without releasing them expire after the lease TTL, so a crashed instance does not hold its slots forever.
+Acquiring, releasing and renewing a lease are Lua scripts, run atomically by Redis.
+*/
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/carantes/go-rate-limiter/lib/internal/interfaces"
+	"github.com/carantes/go-rate-limiter/lib/internal/utils"
+)
+
+// default time a lease is held without being renewed
+const defaultLeaseTTL = 30 * time.Second
+
+// sorted set of the leases of every key, the leases of a key are stored at inFlightKey:key, both after the key prefix
+const inFlightKey = "inflight"
+
+// KEYS: leases of the key, leases of every key
+// ARGV: now, expiry of the lease, lease id, max per key, max total, lease TTL, times in milliseconds
+// returns 1 when the lease is taken, 0 when a limit is full, then the requests in flight per key and in total
+var acquireLeaseScript = utils.NewScript(`
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', ARGV[1])
+redis.call('ZREMRANGEBYSCORE', KEYS[2], '-inf', ARGV[1])
+
+local perKey = redis.call('ZCARD', KEYS[1])
+local total = redis.call('ZCARD', KEYS[2])
+local maxPerKey = tonumber(ARGV[4])
+local maxTotal = tonumber(ARGV[5])
+
+if (maxPerKey > 0 and perKey >= maxPerKey) or (maxTotal > 0 and total >= maxTotal) then
+	return {0, perKey, total}
+end
+
+for i = 1, 2 do
+	redis.call('ZADD', KEYS[i], ARGV[2], ARGV[3])
+	redis.call('PEXPIRE', KEYS[i], ARGV[6])
+end
+
+return {1, perKey + 1, total + 1}
+`)
+
+// KEYS: leases of the key, leases of every key
+// ARGV: lease id
+var releaseLeaseScript = utils.NewScript(`
+redis.call('ZREM', KEYS[1], ARGV[1])
+redis.call('ZREM', KEYS[2], ARGV[1])
+
+return {}
+`)
+
+// KEYS: leases of the key, leases of every key
+// ARGV: expiry of the lease, lease id, lease TTL, times in milliseconds
+// a lease that already expired is not renewed
+var renewLeaseScript = utils.NewScript(`
+for i = 1, 2 do
+	redis.call('ZADD', KEYS[i], 'XX', ARGV[1], ARGV[2])
+	redis.call('PEXPIRE', KEYS[i], ARGV[3])
+end
+
+return {}
+`)
+
+// KEYS: leases of the key, leases of every key
+// ARGV: now in milliseconds
+var countLeasesScript = utils.NewScript(`
+return {redis.call('ZCOUNT', KEYS[1], '(' .. ARGV[1], '+inf'), redis.call('ZCOUNT', KEYS[2], '(' .. ARGV[1], '+inf')}
+`)
+
+// redisConcurrencyLimiter implements the ConcurrencyLimiter interface, leases are stored in Redis
+type redisConcurrencyLimiter struct {
+	clock        interfaces.Clock
+	redisClient  *utils.RedisClient
+	keyPrefix    string // prefix of the Redis keys of the leases
+	maxPerKey    int
+	maxTotal     int
+	queueTimeout time.Duration
+	leaseTTL     time.Duration
+
+	mu     sync.Mutex
+	renews map[string]func() // stops the renewal of the leases held by this limiter, by lease id
+}
+
+type RedisConcurrencyArgs struct {
+	RedisURL     string
+	KeyPrefix    string           // prefix of the Redis keys, servers sharing a Redis server but not their limits need different prefixes
+	MaxPerKey    int              // maximum number of requests in flight per key, zero means unbounded
+	MaxTotal     int              // maximum number of requests in flight over every key, zero means unbounded
+	QueueTimeout time.Duration    // how long Acquire waits for a free slot, zero declines the request right away
+	LeaseTTL     time.Duration    // how long a slot is held once its server stops renewing it, defaults to 30 seconds
+	Clock        interfaces.Clock // source of time, defaults to the system clock
+}
+
+func (a RedisConcurrencyArgs) Validate() error {
+	if err := validateConcurrency(a.MaxPerKey, a.MaxTotal, a.QueueTimeout); err != nil {
+		return err
+	}
+
+	if err := validateNotNegative("leaseTTL", a.LeaseTTL); err != nil {
+		return err
+	}
+
+	if err := utils.ValidateRedisURL(a.RedisURL); err != nil {
+		return interfaces.NewFieldError("redisURL", `Invalid concurrency limit config "redisURL", `+err.Error())
+	}
+
+	return nil
+}
+
+// Concurrency Limiter Constructor
+func NewRedisConcurrencyLimiter(args RedisConcurrencyArgs) interfaces.ConcurrencyLimiter {
+	leaseTTL := args.LeaseTTL
+
+	if leaseTTL == 0 {
+		leaseTTL = defaultLeaseTTL
+	}
+
+	return &redisConcurrencyLimiter{
+		clock:        interfaces.ClockOrDefault(args.Clock),
+		redisClient:  utils.NewRedisClient(args.RedisURL),
+		keyPrefix:    leaseKeyPrefix(args.KeyPrefix),
+		maxPerKey:    args.MaxPerKey,
+		maxTotal:     args.MaxTotal,
+		queueTimeout: args.QueueTimeout,
+		leaseTTL:     leaseTTL,
+		renews:       make(map[string]func()),
+	}
+}
+
+func (l *redisConcurrencyLimiter) Acquire(ctx context.Context, key string) (func(), error) {
+	keys := l.leaseKeys(key)
+
+	return acquireSlot(ctx, l.clock, l.queueTimeout, func() (func(), <-chan struct{}, error) {
+		lease, err := newLeaseID()
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		now := l.clock.Now()
+		res, err := l.redisClient.Run(ctx, acquireLeaseScript, keys,
+			now.UnixMilli(), now.Add(l.leaseTTL).UnixMilli(), lease, l.maxPerKey, l.maxTotal, l.leaseTTL.Milliseconds())
+
+		if err != nil {
+			return nil, nil, interfaces.NewBackendError(err)
+		}
+
+		// nil channel, the waiters poll redis
+		if res[0] == 0 {
+			return nil, nil, concurrencyError(concurrencyAlgorithm, int(res[1]), int(res[2]), l.maxPerKey, l.maxTotal)
+		}
+
+		return l.hold(keys, lease), nil, nil
+	})
+}
+
+func (l *redisConcurrencyLimiter) InFlight(ctx context.Context, key string) (int, int, error) {
+	res, err := l.redisClient.Run(ctx, countLeasesScript, l.leaseKeys(key), l.clock.Now().UnixMilli())
+
+	if err != nil {
+		return 0, 0, interfaces.NewBackendError(err)
+	}
+
+	return int(res[0]), int(res[1]), nil
+}
+
+// Close stops renewing the leases held by this limiter, they expire after the lease TTL, and closes the connections
+func (l *redisConcurrencyLimiter) Close() error {
+	l.mu.Lock()
+
+	for lease, stop := range l.renews {
+		stop()
+		delete(l.renews, lease)
+	}
+
+	l.mu.Unlock()
+
+	return l.redisClient.Close()
+}
+
+// hold renews the lease until it is released and returns its release
+func (l *redisConcurrencyLimiter) hold(keys []string, lease string) func() {
+	stop := utils.StartJanitor(max(l.leaseTTL/3, minRetryDelay), func() {
+		expiry := l.clock.Now().Add(l.leaseTTL)
+
+		// a failed renewal is retried on the next tick, the lease is only lost when every renewal fails
+		_, _ = l.redisClient.Run(context.Background(), renewLeaseScript, keys, expiry.UnixMilli(), lease, l.leaseTTL.Milliseconds())
+	})
+
+	l.mu.Lock()
+	l.renews[lease] = stop
+	l.mu.Unlock()
+
+	var once sync.Once
+
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			delete(l.renews, lease)
+			l.mu.Unlock()
+
+			stop()
+
+			// a lease that cannot be removed expires after the lease TTL
+			_, _ = l.redisClient.Run(context.Background(), releaseLeaseScript, keys, lease)
+		})
+	}
+}
+
+// leaseKeys returns the sorted sets of the leases of the key and of every key
+func (l *redisConcurrencyLimiter) leaseKeys(key string) []string {
+	return []string{l.keyPrefix + inFlightKey + ":" + key, l.keyPrefix + inFlightKey}
+}
+
+// leaseKeyPrefix returns the prefix of the Redis keys of the leases, none when keyPrefix is empty
+func leaseKeyPrefix(keyPrefix string) string {
+	if keyPrefix == "" {
+		return ""
+	}
+
+	return keyPrefix + ":"
+}
+
+// newLeaseID returns a random id, unique across the servers sharing the leases
+func newLeaseID() (string, error) {
+	id := make([]byte, 16)
+
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(id), nil
+}
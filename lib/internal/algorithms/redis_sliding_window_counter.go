@@ -1,18 +1,23 @@
 package algorithms
 
 import (
+	"context"
+	"errors"
+	"math"
 	"time"
 
 	"github.com/carantes/go-rate-limiter/lib/internal/interfaces"
-	"github.com/carantes/go-rate-limiter/lib/internal/mocks"
 	"github.com/carantes/go-rate-limiter/lib/internal/utils"
 )
 
 type redisSlidingWindowCounterLimiter struct {
+	clock                 interfaces.Clock
 	redisClient           *utils.RedisClient
+	keyPrefix             string // prefix of the Redis keys of the users
 	defaultWindowCapacity int
 	defaultWindowDuration time.Duration
 	currentWindowWeight   float64
+	mode                  SlidingWindowCounterMode
 }
 
 type redisUserSlidingWindowCounter struct {
@@ -23,13 +28,66 @@ type redisUserSlidingWindowCounter struct {
 	CurrentWindowCount      int
 	PreviousWindowStartTime time.Time
 	PreviousWindowCount     int
+	ReservedCount           int                      // tokens reserved for the next window
+	Mode                    SlidingWindowCounterMode `json:",omitempty"`
 }
 
 type RedisSlidingWindowCounterArgs struct {
-	RedisURL string
-	Capacity int
-	Duration time.Duration
-	Weight   float64
+	RedisURL  string
+	KeyPrefix string // prefix of the Redis keys, limits sharing a Redis server need different prefixes
+	Capacity  int
+	Duration  time.Duration            // window size, e.g. 100 * time.Millisecond
+	Weight    float64                  // weight of the current window in the weighted mode
+	Mode      SlidingWindowCounterMode // weighted or interpolated, defaults to weighted
+	Clock     interfaces.Clock         // source of time, defaults to the system clock
+}
+
+func (a RedisSlidingWindowCounterArgs) Validate() error {
+	if err := validatePositive("capacity", a.Capacity); err != nil {
+		return err
+	}
+
+	if err := validatePositive("duration", a.Duration); err != nil {
+		return err
+	}
+
+	if err := validateWeight(a.Weight); err != nil {
+		return err
+	}
+
+	if err := validateSlidingWindowMode(a.Mode); err != nil {
+		return err
+	}
+
+	if err := utils.ValidateRedisURL(a.RedisURL); err != nil {
+		return interfaces.NewFieldError("redisURL", `Invalid rate limit config "redisURL", `+err.Error())
+	}
+
+	return nil
+}
+
+func (a RedisSlidingWindowCounterArgs) algorithm() interfaces.Algorithm {
+	return interfaces.RedisSlidingWindowCounter
+}
+
+func (a RedisSlidingWindowCounterArgs) newLimiter(clock interfaces.Clock) interfaces.RateLimiter {
+	a.Clock = clockOr(a.Clock, clock)
+
+	return NewRedisSlidingWindowCounterLimiter(a)
+}
+
+func init() {
+	registerAlgorithm(interfaces.AlgorithmSpec{
+		Name:        interfaces.RedisSlidingWindowCounter.String(),
+		Command:     "redisSlidingWindowCounter",
+		Description: "Sliding window counter rate limit algorithm using Redis",
+		Fields: append([]interfaces.ConfigField{
+			{Name: "capacity", Type: interfaces.IntField, Required: true, Default: "60", Usage: "The maximum number of requests allowed in the time window"},
+			{Name: "duration", Type: interfaces.DurationField, Required: true, Default: "1m", Usage: "The duration of the window, e.g. 250ms or 1m30s"},
+			{Name: "weight", Type: interfaces.FloatField, Required: true, Default: "0.4", Usage: "The weight of the current window in the average calculation, in the weighted mode"},
+			{Name: "mode", Type: interfaces.StringField, Default: string(SlidingWindowWeighted), Usage: `"weighted" uses a fixed weight, "interpolated" weights the previous window by the time it still covers`},
+		}, redisFields...),
+	}, parseRedisSlidingWindowCounterArgs)
 }
 
 // Rate Limiter Constructor
@@ -37,98 +95,245 @@ func NewRedisSlidingWindowCounterLimiter(args RedisSlidingWindowCounterArgs) int
 	client := utils.NewRedisClient(args.RedisURL)
 
 	return &redisSlidingWindowCounterLimiter{
+		clock:                 interfaces.ClockOrDefault(args.Clock),
 		redisClient:           client,
+		keyPrefix:             redisKeyPrefix(args.KeyPrefix, interfaces.RedisSlidingWindowCounter),
 		defaultWindowCapacity: args.Capacity,
-		defaultWindowDuration: args.Duration * time.Second,
+		defaultWindowDuration: args.Duration,
 		currentWindowWeight:   args.Weight,
+		mode:                  args.Mode,
 	}
 }
 
-func NewRedisSlidingWindowCounterLimiterFromConfig(config map[string]string) (interfaces.RateLimiter, error) {
-	capacity, ok := config["capacity"]
+// parseRedisSlidingWindowCounterArgs reads the arguments of the algorithm from a string config
+func parseRedisSlidingWindowCounterArgs(config map[string]string) (RedisSlidingWindowCounterArgs, error) {
+	r := newConfigReader(config)
+
+	args := RedisSlidingWindowCounterArgs{
+		RedisURL:  r.string("redisURL"),
+		KeyPrefix: config["keyPrefix"],
+		Capacity:  r.int("capacity"),
+		Duration:  r.duration("duration"),
+		Weight:    r.float("weight"),
+		Mode:      SlidingWindowCounterMode(config["mode"]),
+	}
+
+	return args, r.err
+}
 
-	if !ok {
-		return nil, &interfaces.RateLimitError{Message: "Missing rate limit capacity"}
+func (l *redisSlidingWindowCounterLimiter) Allow(ctx context.Context, user string) (interfaces.RateLimiterStats, error) {
+	return l.AllowN(ctx, user, 1)
+}
+
+func (l *redisSlidingWindowCounterLimiter) AllowN(ctx context.Context, user string, n int) (interfaces.RateLimiterStats, error) {
+	if err := validateTokens(n); err != nil {
+		return interfaces.RateLimiterStats{}, err
 	}
 
-	duration, ok := config["duration"]
+	var stats interfaces.RateLimiterStats
+
+	// read, check and write the user window atomically, the context deadline applies to every call.
+	// If the context expires before the write the request is not counted
+	err := l.update(ctx, user, func(now time.Time, userWindow *redisUserSlidingWindowCounter) error {
+		// check if there are enough tokens to allow the request
+		if err := userWindow.checkTokens(now, n); err != nil {
+			return err
+		}
+
+		stats = userWindow.stats(now)
+
+		return nil
+	})
 
-	if !ok {
-		return nil, &interfaces.RateLimitError{Message: "Missing rate limit duration"}
+	if err != nil {
+		return interfaces.RateLimiterStats{}, err
 	}
 
-	weight, ok := config["weight"]
+	return stats, nil
+}
 
-	if !ok {
-		return nil, &interfaces.RateLimitError{Message: "Missing rate limit weight"}
+func (l *redisSlidingWindowCounterLimiter) Reserve(ctx context.Context, user string, n int) (*interfaces.Reservation, error) {
+	if err := validateTokens(n); err != nil {
+		return nil, err
 	}
 
-	redisURL, ok := config["redisURL"]
+	var (
+		stats   interfaces.RateLimiterStats
+		readyAt time.Time
+		ok      bool
+	)
 
-	if !ok {
-		return nil, &interfaces.RateLimitError{Message: "Missing redis URL"}
+	err := l.update(ctx, user, func(now time.Time, userWindow *redisUserSlidingWindowCounter) error {
+		var err error
+
+		readyAt, ok, err = userWindow.reserveTokens(now, n)
+		stats = userWindow.stats(now)
+
+		return err
+	})
+
+	if err != nil {
+		return nil, err
 	}
 
-	return NewRedisSlidingWindowCounterLimiter(RedisSlidingWindowCounterArgs{
-		RedisURL: redisURL,
-		Capacity: utils.ParseInt(capacity),
-		Duration: time.Duration(utils.ParseInt(duration)),
-		Weight:   utils.ParseFloat(weight),
+	return interfaces.NewReservation(ok, readyAt.Sub(l.clock.Now()), stats, func() {
+		// best effort, the reservation has no context of its own
+		_ = l.update(context.Background(), user, func(now time.Time, userWindow *redisUserSlidingWindowCounter) error {
+			userWindow.cancelTokens(now, n, readyAt)
+			return nil
+		})
 	}), nil
 }
 
-func (l *redisSlidingWindowCounterLimiter) Allow(user string) (interfaces.RateLimiterStats, error) {
-	// read user from the map
+func (l *redisSlidingWindowCounterLimiter) Wait(ctx context.Context, user string) error {
+	return waitN(ctx, l, l.clock, user, 1)
+}
+
+func (l *redisSlidingWindowCounterLimiter) Peek(ctx context.Context, user string) (interfaces.RateLimiterStats, error) {
 	var userWindow *redisUserSlidingWindowCounter
 
-	redisTTL := l.defaultWindowDuration * 2
+	now := l.clock.Now()
 
-	l.redisClient.Get(user, &userWindow)
-
-	if userWindow == nil {
-		userWindow = &redisUserSlidingWindowCounter{
-			Duration:                l.defaultWindowDuration,
-			Capacity:                l.defaultWindowCapacity,
-			CurrentWindowWeight:     l.currentWindowWeight,
-			CurrentWindowStartTime:  mocks.Now(),
-			CurrentWindowCount:      0,
-			PreviousWindowStartTime: mocks.Now().Add(-l.defaultWindowDuration),
-			PreviousWindowCount:     0,
-		}
+	err := l.redisClient.Get(ctx, l.key(user), &userWindow)
 
-		// save user window
-		l.redisClient.Set(user, userWindow, redisTTL)
+	if errors.Is(err, utils.ErrKeyNotFound) {
+		return l.newUserWindow(now).stats(now), nil
 	}
 
-	// if user exists, check if there are enough tokens to allow the request
-	err := userWindow.checkTokens()
+	if err != nil {
+		return interfaces.RateLimiterStats{}, interfaces.NewBackendError(err)
+	}
 
-	// update user window
-	l.redisClient.Set(user, userWindow, redisTTL)
+	return userWindow.peek(now), nil
+}
 
-	if (err) != nil {
+func (l *redisSlidingWindowCounterLimiter) Reset(ctx context.Context, user string) error {
+	return interfaces.NewBackendError(l.redisClient.Del(ctx, l.key(user)))
+}
+
+func (l *redisSlidingWindowCounterLimiter) Refund(ctx context.Context, user string, n int) (interfaces.RateLimiterStats, error) {
+	if err := validateTokens(n); err != nil {
 		return interfaces.RateLimiterStats{}, err
 	}
 
-	return userWindow.stats(), nil
+	var stats interfaces.RateLimiterStats
+
+	err := l.update(ctx, user, func(now time.Time, userWindow *redisUserSlidingWindowCounter) error {
+		userWindow.refundTokens(now, n)
+		stats = userWindow.stats(now)
+
+		return nil
+	})
+
+	return stats, err
 }
 
-func (sw *redisUserSlidingWindowCounter) checkTokens() error {
-	// check if the current window has expired
-	if time.Since(sw.CurrentWindowStartTime) > sw.Duration {
+func (l *redisSlidingWindowCounterLimiter) SetRemaining(ctx context.Context, user string, n int) (interfaces.RateLimiterStats, error) {
+	if err := validateTokens(n); err != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
+
+	var stats interfaces.RateLimiterStats
+
+	err := l.update(ctx, user, func(now time.Time, userWindow *redisUserSlidingWindowCounter) error {
+		userWindow.setRemaining(now, n)
+		stats = userWindow.stats(now)
+
+		return nil
+	})
+
+	return stats, err
+}
+
+// key returns the Redis key of the user
+func (l *redisSlidingWindowCounterLimiter) key(user string) string {
+	return l.keyPrefix + user
+}
+
+func (l *redisSlidingWindowCounterLimiter) Close() error {
+	return l.redisClient.Close()
+}
+
+// update runs fn on the user window inside a Redis transaction, a new window is created for unknown users.
+// Redis failures are returned as ErrBackendUnavailable
+func (l *redisSlidingWindowCounterLimiter) update(ctx context.Context, user string, fn func(now time.Time, userWindow *redisUserSlidingWindowCounter) error) error {
+	redisTTL := l.defaultWindowDuration * 2
+
+	// aligned windows keep the tokens reserved for the next window until the end of the window after
+	if l.mode == SlidingWindowInterpolated {
+		redisTTL = l.defaultWindowDuration * 3
+	}
+
+	err := utils.Update(ctx, l.redisClient, l.key(user), redisTTL, func(userWindow *redisUserSlidingWindowCounter, found bool) error {
+		now := l.clock.Now()
+
+		if !found {
+			*userWindow = *l.newUserWindow(now)
+		}
+
+		return fn(now, userWindow)
+	})
+
+	// rate limit errors returned by fn are kept, anything else comes from redis
+	return interfaces.NewBackendError(err)
+}
+
+// create the initial state of a user
+func (l *redisSlidingWindowCounterLimiter) newUserWindow(now time.Time) *redisUserSlidingWindowCounter {
+	start := now
+
+	// interpolated windows are aligned to multiples of the duration
+	if l.mode == SlidingWindowInterpolated {
+		start = now.Truncate(l.defaultWindowDuration)
+	}
+
+	return &redisUserSlidingWindowCounter{
+		Duration:                l.defaultWindowDuration,
+		Capacity:                l.defaultWindowCapacity,
+		CurrentWindowWeight:     l.currentWindowWeight,
+		CurrentWindowStartTime:  start,
+		CurrentWindowCount:      0,
+		PreviousWindowStartTime: start.Add(-l.defaultWindowDuration),
+		PreviousWindowCount:     0,
+		Mode:                    l.mode,
+	}
+}
+
+// advance starts a new window when the current one has expired, tokens reserved for the next window become current
+func (sw *redisUserSlidingWindowCounter) advance(now time.Time) {
+	if sw.Mode == SlidingWindowInterpolated {
+		sw.interpolate(func(w *interpolatedWindow) { w.advance(now) })
+		return
+	}
+
+	if now.Sub(sw.CurrentWindowStartTime) > sw.Duration {
 		sw.PreviousWindowStartTime = sw.CurrentWindowStartTime
 		sw.PreviousWindowCount = sw.CurrentWindowCount
-		sw.CurrentWindowStartTime = mocks.Now()
-		sw.CurrentWindowCount = 0
+		sw.CurrentWindowStartTime = now
+		sw.CurrentWindowCount = sw.ReservedCount
+		sw.ReservedCount = 0
+	}
+}
+
+func (sw *redisUserSlidingWindowCounter) checkTokens(now time.Time, n int) error {
+	if sw.Mode == SlidingWindowInterpolated {
+		var err error
+
+		sw.interpolate(func(w *interpolatedWindow) { err = w.checkTokens(now, n) })
+
+		return err
 	}
 
-	// check if there are enough tokens to fulfill the request
-	if (sw.currentTokens()) >= sw.Capacity {
-		return &interfaces.RateLimitError{Message: "Rate limit exceeded"}
+	// check if the current window has expired
+	sw.advance(now)
+
+	// check if there are enough tokens to fulfill the request, reserved tokens go first
+	if sw.ReservedCount > 0 || sw.currentTokens()+n > sw.Capacity {
+		return sw.limitError(now, n)
 	}
 
 	// increment the counter
-	sw.CurrentWindowCount++
+	sw.CurrentWindowCount += n
 
 	return nil
 }
@@ -139,13 +344,159 @@ func (sw *redisUserSlidingWindowCounter) currentTokens() int {
 	return int((float64(sw.CurrentWindowCount)*sw.CurrentWindowWeight + float64(sw.PreviousWindowCount)*previousWindowWeight))
 }
 
-func (sw *redisUserSlidingWindowCounter) stats() interfaces.RateLimiterStats {
+// reserveTokens counts n tokens in the current window or, when they do not fit, in the next one.
+// It returns false when the tokens do not fit in the next window either
+func (sw *redisUserSlidingWindowCounter) reserveTokens(now time.Time, n int) (time.Time, bool, error) {
+	if sw.Mode == SlidingWindowInterpolated {
+		var (
+			readyAt time.Time
+			ok      bool
+			err     error
+		)
+
+		sw.interpolate(func(w *interpolatedWindow) { readyAt, ok, err = w.reserveTokens(now, n) })
+
+		return readyAt, ok, err
+	}
+
+	sw.advance(now)
+
+	// the request can never be fulfilled
+	if n > sw.Capacity {
+		return time.Time{}, false, sw.limitError(now, n)
+	}
+
+	if sw.ReservedCount == 0 && sw.currentTokens()+n <= sw.Capacity {
+		sw.CurrentWindowCount += n
+		return now, true, nil
+	}
+
+	nextWindowStartTime := sw.CurrentWindowStartTime.Add(sw.Duration)
+
+	// estimated tokens at the beginning of the next window, when the current window becomes the previous one
+	nextTokens := int(float64(sw.ReservedCount+n)*sw.CurrentWindowWeight + float64(sw.CurrentWindowCount)*(1-sw.CurrentWindowWeight))
+
+	if nextTokens > sw.Capacity {
+		return nextWindowStartTime, false, nil
+	}
+
+	sw.ReservedCount += n
+
+	return nextWindowStartTime, true, nil
+}
+
+// cancelTokens gives back n tokens reserved for readyAt, tokens of an expired window are not restored
+func (sw *redisUserSlidingWindowCounter) cancelTokens(now time.Time, n int, readyAt time.Time) {
+	if sw.Mode == SlidingWindowInterpolated {
+		sw.interpolate(func(w *interpolatedWindow) { w.cancelTokens(now, n, readyAt) })
+		return
+	}
+
+	sw.advance(now)
+
+	if readyAt.Equal(sw.CurrentWindowStartTime.Add(sw.Duration)) {
+		sw.ReservedCount = max(sw.ReservedCount-n, 0)
+		return
+	}
+
+	if readyAt.Add(sw.Duration).Before(now) {
+		return
+	}
+
+	sw.CurrentWindowCount = max(sw.CurrentWindowCount-n, 0)
+}
+
+// limitError returns the error of a denied request with the time until the estimate leaves room for n tokens,
+// at the start of the next window or of the one after
+func (sw *redisUserSlidingWindowCounter) limitError(now time.Time, n int) error {
+	var retryAfter time.Duration
+
+	if n <= sw.Capacity {
+		nextWindowStartTime := sw.CurrentWindowStartTime.Add(sw.Duration)
+		nextTokens := int(float64(sw.ReservedCount+n)*sw.CurrentWindowWeight + float64(sw.CurrentWindowCount)*(1-sw.CurrentWindowWeight))
+
+		if nextTokens > sw.Capacity {
+			nextWindowStartTime = nextWindowStartTime.Add(sw.Duration)
+		}
+
+		retryAfter = nextWindowStartTime.Sub(now)
+	}
+
+	return interfaces.NewRateLimitedError(sw.stats(now), retryAfter)
+}
+
+// refundTokens gives n tokens back to the current window
+func (sw *redisUserSlidingWindowCounter) refundTokens(now time.Time, n int) {
+	sw.advance(now)
+
+	sw.CurrentWindowCount = max(sw.CurrentWindowCount-n, 0)
+}
+
+// setRemaining overrides the window counts so that the estimated number of tokens left is n
+func (sw *redisUserSlidingWindowCounter) setRemaining(now time.Time, n int) {
+	if sw.Mode == SlidingWindowInterpolated {
+		sw.interpolate(func(w *interpolatedWindow) { w.setRemaining(now, n) })
+		return
+	}
+
+	sw.advance(now)
+
+	requests := sw.Capacity - min(n, sw.Capacity)
+
+	sw.ReservedCount = 0
+	sw.PreviousWindowCount = 0
+	sw.CurrentWindowCount = 0
+
+	// only the previous window counts when the current window has no weight
+	if sw.CurrentWindowWeight <= 0 {
+		sw.PreviousWindowCount = requests
+		return
+	}
+
+	sw.CurrentWindowCount = int(math.Ceil(float64(requests) / sw.CurrentWindowWeight))
+}
+
+// peek returns the stats of an up to date copy of the window, the window itself is not changed
+func (sw *redisUserSlidingWindowCounter) peek(now time.Time) interfaces.RateLimiterStats {
+	window := *sw
+	window.advance(now)
+
+	return window.stats(now)
+}
+
+func (sw *redisUserSlidingWindowCounter) stats(now time.Time) interfaces.RateLimiterStats {
+	if sw.Mode == SlidingWindowInterpolated {
+		var stats interfaces.RateLimiterStats
+
+		sw.interpolate(func(w *interpolatedWindow) { stats = w.stats(now) })
+
+		return stats
+	}
+
 	return interfaces.RateLimiterStats{
 		Algorithm: interfaces.RedisSlidingWindowCounter.String(),
 		Capacity:  sw.Capacity,
-		Remaining: sw.Capacity - sw.currentTokens(),
+		Remaining: max(sw.Capacity-sw.currentTokens(), 0),
 		// The reset time is the end of the current window plus the duration of the previous window
 		Reset:       sw.CurrentWindowStartTime.Add(sw.Duration * 2),
-		CurrentTime: mocks.Now(),
+		CurrentTime: now,
+	}
+}
+
+// interpolate runs fn on the counts of the window in the interpolated mode and stores them back
+func (sw *redisUserSlidingWindowCounter) interpolate(fn func(w *interpolatedWindow)) {
+	w := interpolatedWindow{
+		algorithm: interfaces.RedisSlidingWindowCounter,
+		duration:  sw.Duration,
+		capacity:  sw.Capacity,
+		start:     sw.CurrentWindowStartTime,
+		previous:  sw.PreviousWindowCount,
+		current:   sw.CurrentWindowCount,
+		reserved:  sw.ReservedCount,
 	}
+
+	fn(&w)
+
+	sw.CurrentWindowStartTime, sw.PreviousWindowStartTime = w.start, w.start.Add(-w.duration)
+	sw.PreviousWindowCount, sw.CurrentWindowCount, sw.ReservedCount = w.previous, w.current, w.reserved
 }
@@ -1,18 +1,23 @@
 package algorithms
 
 import (
+	"context"
+	"io"
+	"math"
 	"time"
 
 	"github.com/carantes/go-rate-limiter/lib/internal/interfaces"
-	"github.com/carantes/go-rate-limiter/lib/internal/mocks"
 	"github.com/carantes/go-rate-limiter/lib/internal/utils"
 )
 
 type slidingWindowCounterLimiter struct {
-	userMap               map[string]*userSlidingWindowCounter
+	clock                 interfaces.Clock
+	userMap               *utils.ShardedMap[*userSlidingWindowCounter] // users state, safe for concurrent use
 	defaultWindowCapacity int
 	defaultWindowDuration time.Duration
 	currentWindowWeight   float64
+	mode                  SlidingWindowCounterMode
+	stopJanitor           func() // stops the background cleanup
 }
 
 type userSlidingWindowCounter struct {
@@ -23,94 +28,370 @@ type userSlidingWindowCounter struct {
 	currentWindowCount      int
 	previousWindowStartTime time.Time
 	previousWindowCount     int
+	reservedCount           int // tokens reserved for the next window
+	mode                    SlidingWindowCounterMode
 }
 
 type SlidingWindowCounterArgs struct {
+	MemoryArgs
 	Capacity int
-	Duration time.Duration
-	Weight   float64
+	Duration time.Duration            // window size, e.g. 100 * time.Millisecond
+	Weight   float64                  // weight of the current window in the weighted mode
+	Mode     SlidingWindowCounterMode // weighted or interpolated, defaults to weighted
+	Clock    interfaces.Clock         // source of time, defaults to the system clock
+}
+
+func (a SlidingWindowCounterArgs) Validate() error {
+	if err := validatePositive("capacity", a.Capacity); err != nil {
+		return err
+	}
+
+	if err := validatePositive("duration", a.Duration); err != nil {
+		return err
+	}
+
+	if err := validateWeight(a.Weight); err != nil {
+		return err
+	}
+
+	if err := validateSlidingWindowMode(a.Mode); err != nil {
+		return err
+	}
+
+	return a.MemoryArgs.Validate()
+}
+
+func (a SlidingWindowCounterArgs) algorithm() interfaces.Algorithm {
+	return interfaces.SlidingWindowCounter
+}
+
+func (a SlidingWindowCounterArgs) newLimiter(clock interfaces.Clock) interfaces.RateLimiter {
+	a.Clock = clockOr(a.Clock, clock)
+
+	return NewSlidingWindowCounterLimiter(a)
+}
+
+func init() {
+	registerAlgorithm(interfaces.AlgorithmSpec{
+		Name:        interfaces.SlidingWindowCounter.String(),
+		Command:     "slidingWindowCounter",
+		Description: "Sliding window counter rate limit algorithm",
+		Fields: append([]interfaces.ConfigField{
+			{Name: "capacity", Type: interfaces.IntField, Required: true, Default: "60", Usage: "The maximum number of requests allowed in the time window"},
+			{Name: "duration", Type: interfaces.DurationField, Required: true, Default: "1m", Usage: "The duration of the window, e.g. 250ms or 1m30s"},
+			{Name: "weight", Type: interfaces.FloatField, Required: true, Default: "0.4", Usage: "The weight of the current window in the average calculation, in the weighted mode"},
+			{Name: "mode", Type: interfaces.StringField, Default: string(SlidingWindowWeighted), Usage: `"weighted" uses a fixed weight, "interpolated" weights the previous window by the time it still covers`},
+		}, memoryFields...),
+	}, parseSlidingWindowCounterArgs)
 }
 
 // Rate Limiter Constructor
 func NewSlidingWindowCounterLimiter(args SlidingWindowCounterArgs) interfaces.RateLimiter {
-	return &slidingWindowCounterLimiter{
-		userMap:               make(map[string]*userSlidingWindowCounter),
+	l := &slidingWindowCounterLimiter{
+		clock:                 interfaces.ClockOrDefault(args.Clock),
+		userMap:               utils.NewShardedMap[*userSlidingWindowCounter](utils.DefaultShards, args.MaxKeys),
 		defaultWindowCapacity: args.Capacity,
-		defaultWindowDuration: args.Duration * time.Second,
+		defaultWindowDuration: args.Duration,
 		currentWindowWeight:   args.Weight,
+		mode:                  args.Mode,
 	}
+
+	l.stopJanitor = utils.StartJanitor(args.CleanupInterval, l.cleanup)
+
+	return l
 }
 
-func NewSlidingWindowCounterLimiterFromConfig(config map[string]string) (interfaces.RateLimiter, error) {
-	capacity, ok := config["capacity"]
+// parseSlidingWindowCounterArgs reads the arguments of the algorithm from a string config
+func parseSlidingWindowCounterArgs(config map[string]string) (SlidingWindowCounterArgs, error) {
+	r := newConfigReader(config)
 
-	if !ok {
-		return nil, &interfaces.RateLimitError{Message: "Missing rate limit capacity"}
+	args := SlidingWindowCounterArgs{
+		MemoryArgs: r.memoryArgs(),
+		Capacity:   r.int("capacity"),
+		Duration:   r.duration("duration"),
+		Weight:     r.float("weight"),
+		Mode:       SlidingWindowCounterMode(config["mode"]),
 	}
 
-	duration, ok := config["duration"]
+	return args, r.err
+}
+
+func (l *slidingWindowCounterLimiter) Allow(ctx context.Context, user string) (interfaces.RateLimiterStats, error) {
+	return l.AllowN(ctx, user, 1)
+}
 
-	if !ok {
-		return nil, &interfaces.RateLimitError{Message: "Missing rate limit duration"}
+func (l *slidingWindowCounterLimiter) AllowN(ctx context.Context, user string, n int) (interfaces.RateLimiterStats, error) {
+	// do not count requests whose context is already done
+	if err := ctx.Err(); err != nil {
+		return interfaces.RateLimiterStats{}, err
 	}
 
-	weight, ok := config["weight"]
+	if err := validateTokens(n); err != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
+
+	users, unlock := l.userMap.Lock(user)
+	defer unlock()
+
+	now := l.clock.Now()
+
+	userWindow := l.userWindow(users, now, user)
+
+	// if user exists, check if there are enough tokens to allow the request
+	err := userWindow.checkTokens(now, n)
+
+	if (err) != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
+
+	return userWindow.stats(now), nil
+}
 
-	if !ok {
-		return nil, &interfaces.RateLimitError{Message: "Missing rate limit weight"}
+func (l *slidingWindowCounterLimiter) Reserve(ctx context.Context, user string, n int) (*interfaces.Reservation, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
 
-	return NewSlidingWindowCounterLimiter(SlidingWindowCounterArgs{
-		Capacity: utils.ParseInt(capacity),
-		Duration: time.Duration(utils.ParseInt(duration)),
-		Weight:   utils.ParseFloat(weight),
+	if err := validateTokens(n); err != nil {
+		return nil, err
+	}
+
+	users, unlock := l.userMap.Lock(user)
+	defer unlock()
+
+	now := l.clock.Now()
+
+	userWindow := l.userWindow(users, now, user)
+
+	readyAt, ok, err := userWindow.reserveTokens(now, n)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return interfaces.NewReservation(ok, readyAt.Sub(now), userWindow.stats(now), func() {
+		_, unlock := l.userMap.Lock(user)
+		defer unlock()
+
+		now := l.clock.Now()
+
+		userWindow.cancelTokens(now, n, readyAt)
 	}), nil
 }
 
-func (l *slidingWindowCounterLimiter) Allow(user string) (interfaces.RateLimiterStats, error) {
-	// read user from the map
-	userWindow := l.userMap[user]
+func (l *slidingWindowCounterLimiter) Wait(ctx context.Context, user string) error {
+	return waitN(ctx, l, l.clock, user, 1)
+}
+
+func (l *slidingWindowCounterLimiter) Peek(ctx context.Context, user string) (interfaces.RateLimiterStats, error) {
+	if err := ctx.Err(); err != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
+
+	users, unlock := l.userMap.Lock(user)
+	defer unlock()
+
+	now := l.clock.Now()
+
+	userWindow := users.Get(user)
 
 	if userWindow == nil {
-		userWindow = &userSlidingWindowCounter{
-			duration:                l.defaultWindowDuration,
-			capacity:                l.defaultWindowCapacity,
-			currentWindowWeight:     l.currentWindowWeight,
-			currentWindowStartTime:  mocks.Now(),
-			currentWindowCount:      0,
-			previousWindowStartTime: mocks.Now().Add(-l.defaultWindowDuration),
-			previousWindowCount:     0,
-		}
+		return l.newUserWindow(now).stats(now), nil
+	}
+
+	return userWindow.peek(now), nil
+}
 
-		l.userMap[user] = userWindow
+func (l *slidingWindowCounterLimiter) Reset(ctx context.Context, user string) error {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
-	// if user exists, check if there are enough tokens to allow the request
-	err := userWindow.checkTokens()
+	users, unlock := l.userMap.Lock(user)
+	defer unlock()
 
-	if (err) != nil {
+	users.Delete(user)
+
+	return nil
+}
+
+func (l *slidingWindowCounterLimiter) Refund(ctx context.Context, user string, n int) (interfaces.RateLimiterStats, error) {
+	if err := ctx.Err(); err != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
+
+	if err := validateTokens(n); err != nil {
 		return interfaces.RateLimiterStats{}, err
 	}
 
-	return userWindow.stats(), nil
+	users, unlock := l.userMap.Lock(user)
+	defer unlock()
+
+	now := l.clock.Now()
+
+	userWindow := l.userWindow(users, now, user)
+	userWindow.refundTokens(now, n)
+
+	return userWindow.stats(now), nil
 }
 
-func (sw *userSlidingWindowCounter) checkTokens() error {
-	// check if the current window has expired
-	if time.Since(sw.currentWindowStartTime) > sw.duration {
+func (l *slidingWindowCounterLimiter) SetRemaining(ctx context.Context, user string, n int) (interfaces.RateLimiterStats, error) {
+	if err := ctx.Err(); err != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
+
+	if err := validateTokens(n); err != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
+
+	users, unlock := l.userMap.Lock(user)
+	defer unlock()
+
+	now := l.clock.Now()
+
+	userWindow := l.userWindow(users, now, user)
+	userWindow.setRemaining(now, n)
+
+	return userWindow.stats(now), nil
+}
+
+func (l *slidingWindowCounterLimiter) TrackedKeys() int {
+	return l.userMap.Len()
+}
+
+// slidingWindowCounterEntry is the snapshot of a user counter
+type slidingWindowCounterEntry struct {
+	Mode          SlidingWindowCounterMode
+	CurrentStart  time.Time
+	CurrentCount  int
+	PreviousStart time.Time
+	PreviousCount int
+	Reserved      int
+}
+
+func (l *slidingWindowCounterLimiter) Snapshot(w io.Writer) error {
+	now := l.clock.Now()
+
+	return writeSnapshot(w, interfaces.SlidingWindowCounter, now, l.userMap, func(sw *userSlidingWindowCounter) (slidingWindowCounterEntry, bool) {
+		return slidingWindowCounterEntry{
+			Mode:          sw.mode,
+			CurrentStart:  sw.currentWindowStartTime,
+			CurrentCount:  sw.currentWindowCount,
+			PreviousStart: sw.previousWindowStartTime,
+			PreviousCount: sw.previousWindowCount,
+			Reserved:      sw.reservedCount,
+		}, !sw.full(now)
+	})
+}
+
+func (l *slidingWindowCounterLimiter) Restore(r io.Reader) error {
+	now := l.clock.Now()
+
+	return readSnapshot(r, interfaces.SlidingWindowCounter, l.userMap, func(e slidingWindowCounterEntry) (*userSlidingWindowCounter, bool) {
+		// counters of another mode, or interpolated windows not aligned to the duration of this limiter, cannot be used
+		if (e.Mode == SlidingWindowInterpolated) != (l.mode == SlidingWindowInterpolated) || e.CurrentStart.After(now) {
+			return nil, false
+		}
+
+		if l.mode == SlidingWindowInterpolated && !e.CurrentStart.Equal(e.CurrentStart.Truncate(l.defaultWindowDuration)) {
+			return nil, false
+		}
+
+		sw := l.newUserWindow(now)
+		sw.currentWindowStartTime = e.CurrentStart
+		sw.currentWindowCount = max(e.CurrentCount, 0)
+		sw.previousWindowStartTime = e.PreviousStart
+		sw.previousWindowCount = max(e.PreviousCount, 0)
+		sw.reservedCount = max(e.Reserved, 0)
+
+		return sw, !sw.full(now)
+	})
+}
+
+func (l *slidingWindowCounterLimiter) Close() error {
+	l.stopJanitor()
+
+	return nil
+}
+
+// cleanup removes the users whose state is back to full, they are created again on their next request
+func (l *slidingWindowCounterLimiter) cleanup() {
+	now := l.clock.Now()
+
+	l.userMap.DeleteFunc(func(_ string, sw *userSlidingWindowCounter) bool {
+		return sw.full(now)
+	})
+}
+
+// read user from the map, first request for this user creates a new window
+func (l *slidingWindowCounterLimiter) userWindow(users *utils.MapShard[*userSlidingWindowCounter], now time.Time, user string) *userSlidingWindowCounter {
+	userWindow := users.Get(user)
+
+	if userWindow == nil {
+		userWindow = l.newUserWindow(now)
+
+		users.Set(user, userWindow)
+	}
+
+	return userWindow
+}
+
+// create the initial state of a user
+func (l *slidingWindowCounterLimiter) newUserWindow(now time.Time) *userSlidingWindowCounter {
+	start := now
+
+	// interpolated windows are aligned to multiples of the duration
+	if l.mode == SlidingWindowInterpolated {
+		start = now.Truncate(l.defaultWindowDuration)
+	}
+
+	return &userSlidingWindowCounter{
+		duration:                l.defaultWindowDuration,
+		capacity:                l.defaultWindowCapacity,
+		currentWindowWeight:     l.currentWindowWeight,
+		currentWindowStartTime:  start,
+		currentWindowCount:      0,
+		previousWindowStartTime: start.Add(-l.defaultWindowDuration),
+		previousWindowCount:     0,
+		mode:                    l.mode,
+	}
+}
+
+// advance starts a new window when the current one has expired, tokens reserved for the next window become current
+func (sw *userSlidingWindowCounter) advance(now time.Time) {
+	if sw.mode == SlidingWindowInterpolated {
+		sw.interpolate(func(w *interpolatedWindow) { w.advance(now) })
+		return
+	}
+
+	if now.Sub(sw.currentWindowStartTime) > sw.duration {
 		sw.previousWindowStartTime = sw.currentWindowStartTime
 		sw.previousWindowCount = sw.currentWindowCount
-		sw.currentWindowStartTime = mocks.Now()
-		sw.currentWindowCount = 0
+		sw.currentWindowStartTime = now
+		sw.currentWindowCount = sw.reservedCount
+		sw.reservedCount = 0
 	}
+}
+
+func (sw *userSlidingWindowCounter) checkTokens(now time.Time, n int) error {
+	if sw.mode == SlidingWindowInterpolated {
+		var err error
+
+		sw.interpolate(func(w *interpolatedWindow) { err = w.checkTokens(now, n) })
+
+		return err
+	}
+
+	// check if the current window has expired
+	sw.advance(now)
 
-	// check if there are enough tokens to fulfill the request
-	if (sw.currentTokens()) >= sw.capacity {
-		return &interfaces.RateLimitError{Message: "Rate limit exceeded"}
+	// check if there are enough tokens to fulfill the request, reserved tokens go first
+	if sw.reservedCount > 0 || sw.currentTokens()+n > sw.capacity {
+		return sw.limitError(now, n)
 	}
 
 	// increment the counter
-	sw.currentWindowCount++
+	sw.currentWindowCount += n
 
 	return nil
 }
@@ -121,13 +402,172 @@ func (sw *userSlidingWindowCounter) currentTokens() int {
 	return int((float64(sw.currentWindowCount)*sw.currentWindowWeight + float64(sw.previousWindowCount)*previousWindowWeight))
 }
 
-func (sw *userSlidingWindowCounter) stats() interfaces.RateLimiterStats {
+// reserveTokens counts n tokens in the current window or, when they do not fit, in the next one.
+// It returns false when the tokens do not fit in the next window either
+func (sw *userSlidingWindowCounter) reserveTokens(now time.Time, n int) (time.Time, bool, error) {
+	if sw.mode == SlidingWindowInterpolated {
+		var (
+			readyAt time.Time
+			ok      bool
+			err     error
+		)
+
+		sw.interpolate(func(w *interpolatedWindow) { readyAt, ok, err = w.reserveTokens(now, n) })
+
+		return readyAt, ok, err
+	}
+
+	sw.advance(now)
+
+	// the request can never be fulfilled
+	if n > sw.capacity {
+		return time.Time{}, false, sw.limitError(now, n)
+	}
+
+	if sw.reservedCount == 0 && sw.currentTokens()+n <= sw.capacity {
+		sw.currentWindowCount += n
+		return now, true, nil
+	}
+
+	nextWindowStartTime := sw.currentWindowStartTime.Add(sw.duration)
+
+	// estimated tokens at the beginning of the next window, when the current window becomes the previous one
+	nextTokens := int(float64(sw.reservedCount+n)*sw.currentWindowWeight + float64(sw.currentWindowCount)*(1-sw.currentWindowWeight))
+
+	if nextTokens > sw.capacity {
+		return nextWindowStartTime, false, nil
+	}
+
+	sw.reservedCount += n
+
+	return nextWindowStartTime, true, nil
+}
+
+// cancelTokens gives back n tokens reserved for readyAt, tokens of an expired window are not restored
+func (sw *userSlidingWindowCounter) cancelTokens(now time.Time, n int, readyAt time.Time) {
+	if sw.mode == SlidingWindowInterpolated {
+		sw.interpolate(func(w *interpolatedWindow) { w.cancelTokens(now, n, readyAt) })
+		return
+	}
+
+	sw.advance(now)
+
+	if readyAt.Equal(sw.currentWindowStartTime.Add(sw.duration)) {
+		sw.reservedCount = max(sw.reservedCount-n, 0)
+		return
+	}
+
+	if readyAt.Add(sw.duration).Before(now) {
+		return
+	}
+
+	sw.currentWindowCount = max(sw.currentWindowCount-n, 0)
+}
+
+// limitError returns the error of a denied request with the time until the estimate leaves room for n tokens,
+// at the start of the next window or of the one after
+func (sw *userSlidingWindowCounter) limitError(now time.Time, n int) error {
+	var retryAfter time.Duration
+
+	if n <= sw.capacity {
+		nextWindowStartTime := sw.currentWindowStartTime.Add(sw.duration)
+		nextTokens := int(float64(sw.reservedCount+n)*sw.currentWindowWeight + float64(sw.currentWindowCount)*(1-sw.currentWindowWeight))
+
+		if nextTokens > sw.capacity {
+			nextWindowStartTime = nextWindowStartTime.Add(sw.duration)
+		}
+
+		retryAfter = nextWindowStartTime.Sub(now)
+	}
+
+	return interfaces.NewRateLimitedError(sw.stats(now), retryAfter)
+}
+
+// refundTokens gives n tokens back to the current window
+func (sw *userSlidingWindowCounter) refundTokens(now time.Time, n int) {
+	sw.advance(now)
+
+	sw.currentWindowCount = max(sw.currentWindowCount-n, 0)
+}
+
+// setRemaining overrides the window counts so that the estimated number of tokens left is n
+func (sw *userSlidingWindowCounter) setRemaining(now time.Time, n int) {
+	if sw.mode == SlidingWindowInterpolated {
+		sw.interpolate(func(w *interpolatedWindow) { w.setRemaining(now, n) })
+		return
+	}
+
+	sw.advance(now)
+
+	requests := sw.capacity - min(n, sw.capacity)
+
+	sw.reservedCount = 0
+	sw.previousWindowCount = 0
+	sw.currentWindowCount = 0
+
+	// only the previous window counts when the current window has no weight
+	if sw.currentWindowWeight <= 0 {
+		sw.previousWindowCount = requests
+		return
+	}
+
+	sw.currentWindowCount = int(math.Ceil(float64(requests) / sw.currentWindowWeight))
+}
+
+// full reports whether both windows have expired and nothing is reserved, the same state as a new user
+func (sw *userSlidingWindowCounter) full(now time.Time) bool {
+	if sw.mode == SlidingWindowInterpolated {
+		var full bool
+
+		sw.interpolate(func(w *interpolatedWindow) { full = w.full(now) })
+
+		return full
+	}
+
+	return sw.reservedCount == 0 && now.Sub(sw.currentWindowStartTime) > 2*sw.duration
+}
+
+// peek returns the stats of an up to date copy of the window, the window itself is not changed
+func (sw *userSlidingWindowCounter) peek(now time.Time) interfaces.RateLimiterStats {
+	window := *sw
+	window.advance(now)
+
+	return window.stats(now)
+}
+
+func (sw *userSlidingWindowCounter) stats(now time.Time) interfaces.RateLimiterStats {
+	if sw.mode == SlidingWindowInterpolated {
+		var stats interfaces.RateLimiterStats
+
+		sw.interpolate(func(w *interpolatedWindow) { stats = w.stats(now) })
+
+		return stats
+	}
+
 	return interfaces.RateLimiterStats{
 		Algorithm: interfaces.SlidingWindowCounter.String(),
 		Capacity:  sw.capacity,
-		Remaining: sw.capacity - sw.currentTokens(),
+		Remaining: max(sw.capacity-sw.currentTokens(), 0),
 		// The reset time is the end of the current window plus the duration of the previous window
 		Reset:       sw.currentWindowStartTime.Add(sw.duration * 2),
-		CurrentTime: mocks.Now(),
+		CurrentTime: now,
 	}
 }
+
+// interpolate runs fn on the counts of the window in the interpolated mode and stores them back
+func (sw *userSlidingWindowCounter) interpolate(fn func(w *interpolatedWindow)) {
+	w := interpolatedWindow{
+		algorithm: interfaces.SlidingWindowCounter,
+		duration:  sw.duration,
+		capacity:  sw.capacity,
+		start:     sw.currentWindowStartTime,
+		previous:  sw.previousWindowCount,
+		current:   sw.currentWindowCount,
+		reserved:  sw.reservedCount,
+	}
+
+	fn(&w)
+
+	sw.currentWindowStartTime, sw.previousWindowStartTime = w.start, w.start.Add(-w.duration)
+	sw.previousWindowCount, sw.currentWindowCount, sw.reservedCount = w.previous, w.current, w.reserved
+}
@@ -0,0 +1,214 @@
+package algorithms
+
+/*
+Interpolated Sliding Window Counter
+The windows are aligned to multiples of the duration. The estimate of the sliding window ending now is the count of
+the current window plus the count of the previous window weighted by the part of it the sliding window still covers:
+with 30% of the current window elapsed, 70% of the previous window counts. Requests are assumed to be spread evenly
+over the previous window, which makes the estimate close to the exact count of a sliding window log in a fixed memory.
+Since the estimate only moves with time, the time a request fits again is computed exactly.
+*/
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/carantes/go-rate-limiter/lib/internal/interfaces"
+)
+
+// SlidingWindowCounterMode is how a sliding window counter weights the previous window
+type SlidingWindowCounterMode string
+
+const (
+	SlidingWindowWeighted     SlidingWindowCounterMode = "weighted"     // the current window has a fixed weight, the default
+	SlidingWindowInterpolated SlidingWindowCounterMode = "interpolated" // the previous window is weighted by the part of it the sliding window covers
+)
+
+func validateSlidingWindowMode(mode SlidingWindowCounterMode) error {
+	switch mode {
+	case "", SlidingWindowWeighted, SlidingWindowInterpolated:
+		return nil
+	default:
+		return interfaces.NewFieldError("mode", fmt.Sprintf(`Invalid rate limit config "mode", %q is not "weighted" or "interpolated"`, mode))
+	}
+}
+
+// interpolatedWindow holds the counts of a sliding window counter in the interpolated mode
+type interpolatedWindow struct {
+	algorithm interfaces.Algorithm // variant reported in the stats
+	duration  time.Duration
+	capacity  int
+	start     time.Time // start of the current window, a multiple of the duration
+	previous  int
+	current   int
+	reserved  int // tokens reserved for the next window
+}
+
+// advance moves to the window of now, the reserved tokens become current
+func (w *interpolatedWindow) advance(now time.Time) {
+	start := now.Truncate(w.duration)
+
+	switch start.Sub(w.start) / w.duration {
+	case 0:
+		return
+	case 1:
+		w.previous, w.current, w.reserved = w.current, w.reserved, 0
+	case 2:
+		w.previous, w.current, w.reserved = w.reserved, 0, 0
+	default:
+		// the clock went back or the windows expired
+		if start.Before(w.start) {
+			return
+		}
+
+		w.previous, w.current, w.reserved = 0, 0, 0
+	}
+
+	w.start = start
+}
+
+// estimate returns the number of tokens used in the sliding window ending now
+func (w *interpolatedWindow) estimate(now time.Time) float64 {
+	covered := float64(w.duration-now.Sub(w.start)) / float64(w.duration)
+
+	return float64(w.previous)*covered + float64(w.current)
+}
+
+// nextFit returns the first time n tokens fit in the sliding window, when no other tokens are taken.
+// Reserved tokens go first, nothing fits in the current window while there are some
+func (w *interpolatedWindow) nextFit(now time.Time, n int) (time.Time, bool) {
+	if n > w.capacity {
+		return time.Time{}, false
+	}
+
+	// counts of the previous and current windows of the current window and the next two
+	counts := []int{w.previous, w.current, w.reserved, 0}
+	first := 0
+
+	if w.reserved > 0 {
+		first = 1
+	}
+
+	for i := first; i < 3; i++ {
+		previous, current := counts[i], counts[i+1]
+
+		if current+n > w.capacity {
+			continue
+		}
+
+		// the part of the previous window still covered must leave room for n tokens
+		var elapsed time.Duration
+
+		if previous > 0 {
+			covered := float64(w.capacity-n-current) / float64(previous)
+			elapsed = time.Duration(math.Ceil(float64(w.duration) * max(1-covered, 0)))
+		}
+
+		return latest(w.start.Add(time.Duration(i)*w.duration+elapsed), now), true
+	}
+
+	return time.Time{}, false
+}
+
+func (w *interpolatedWindow) checkTokens(now time.Time, n int) error {
+	w.advance(now)
+
+	// reserved tokens go first
+	if w.reserved > 0 || w.estimate(now)+float64(n) > float64(w.capacity)+tokenEpsilon {
+		return w.limitError(now, n)
+	}
+
+	w.current += n
+
+	return nil
+}
+
+// reserveTokens counts n tokens in the window of the first time they fit, the current or the next one.
+// It returns false when they do not fit before the window after
+func (w *interpolatedWindow) reserveTokens(now time.Time, n int) (time.Time, bool, error) {
+	w.advance(now)
+
+	readyAt, ok := w.nextFit(now, n)
+
+	if !ok {
+		return time.Time{}, false, w.limitError(now, n)
+	}
+
+	switch {
+	case readyAt.Before(w.start.Add(w.duration)):
+		// the estimate stays over the capacity until readyAt, other requests wait as well
+		w.current += n
+	case readyAt.Before(w.start.Add(2 * w.duration)):
+		w.reserved += n
+	default:
+		return readyAt, false, nil
+	}
+
+	return readyAt, true, nil
+}
+
+// cancelTokens gives back n tokens taken for readyAt, tokens of an expired window are not restored
+func (w *interpolatedWindow) cancelTokens(now time.Time, n int, readyAt time.Time) {
+	w.advance(now)
+
+	switch window := readyAt.Truncate(w.duration); {
+	case window.Equal(w.start.Add(w.duration)):
+		w.reserved = max(w.reserved-n, 0)
+	case window.Equal(w.start):
+		w.current = max(w.current-n, 0)
+	case window.Equal(w.start.Add(-w.duration)):
+		w.previous = max(w.previous-n, 0)
+	}
+}
+
+// limitError returns the error of a denied request with the exact time until n tokens fit
+func (w *interpolatedWindow) limitError(now time.Time, n int) error {
+	var retryAfter time.Duration
+
+	if readyAt, ok := w.nextFit(now, n); ok {
+		retryAfter = readyAt.Sub(now)
+	}
+
+	return interfaces.NewRateLimitedError(w.stats(now), retryAfter)
+}
+
+// setRemaining overrides the counts so that n tokens are left
+func (w *interpolatedWindow) setRemaining(now time.Time, n int) {
+	w.advance(now)
+
+	w.previous, w.reserved = 0, 0
+	w.current = w.capacity - min(n, w.capacity)
+}
+
+// full reports whether no tokens are counted, the same state as a new user
+func (w *interpolatedWindow) full(now time.Time) bool {
+	window := *w
+	window.advance(now)
+
+	return window.previous == 0 && window.current == 0 && window.reserved == 0
+}
+
+func (w *interpolatedWindow) stats(now time.Time) interfaces.RateLimiterStats {
+	return interfaces.RateLimiterStats{
+		Algorithm:   w.algorithm.String(),
+		Capacity:    w.capacity,
+		Remaining:   max(int(math.Floor(float64(w.capacity)-w.estimate(now)+tokenEpsilon)), 0),
+		Reset:       w.reset(now),
+		CurrentTime: now,
+	}
+}
+
+// reset returns the time every counted token has left the sliding window, at the end of the window after its own
+func (w *interpolatedWindow) reset(now time.Time) time.Time {
+	switch {
+	case w.reserved > 0:
+		return w.start.Add(3 * w.duration)
+	case w.current > 0:
+		return w.start.Add(2 * w.duration)
+	case w.previous > 0:
+		return w.start.Add(w.duration)
+	default:
+		return now
+	}
+}
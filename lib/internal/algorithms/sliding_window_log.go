@@ -1,10 +1,13 @@
 package algorithms
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
 	"time"
 
 	"github.com/carantes/go-rate-limiter/lib/internal/interfaces"
-	"github.com/carantes/go-rate-limiter/lib/internal/mocks"
 	"github.com/carantes/go-rate-limiter/lib/internal/utils"
 )
 
@@ -12,107 +15,502 @@ import (
 Sliding Window Algorithm
 Log the timestamp of each request. When a new request arrives, remove all the timestamps that are older than the window size.
 If the number of remaining timestamps is bigger than the maximum number of requests allowed, then decline the request.
-The disadvantage of this algorithm is that it requires a lot of memory to store all the timestamps.
+The disadvantage of this algorithm is that it requires a lot of memory to store all the timestamps. The log of each user
+is a ring buffer sized to the capacity, 8 bytes per request, where expired timestamps are dropped from the front.
+It only grows to hold reservations made past the capacity, and shrinks back once they expire.
+Declined requests are not logged by default, with the count policy they are and a client that keeps retrying stays
+limited until it slows down. A declined request then replaces the oldest one, the most recent requests are enough
+to decide the next one.
 */
 
+// RejectedPolicy is whether the declined requests count against the window
+type RejectedPolicy string
+
+const (
+	RejectedIgnored RejectedPolicy = "ignore" // declined requests are not logged, the default
+	RejectedCounted RejectedPolicy = "count"  // declined requests are logged like allowed ones
+)
+
+func validateRejectedPolicy(policy RejectedPolicy) error {
+	switch policy {
+	case "", RejectedIgnored, RejectedCounted:
+		return nil
+	default:
+		return interfaces.NewFieldError("rejected", fmt.Sprintf(`Invalid rate limit config "rejected", %q is not "ignore" or "count"`, policy))
+	}
+}
+
 // SlidingWindowLimiter implements the RateLimiter interface
 type slidingWindowLogLimiter struct {
-	usersMap              map[string]*userSlidingWindow
+	clock                 interfaces.Clock
+	usersMap              *utils.ShardedMap[*userSlidingWindow] // users state, safe for concurrent use
 	defaultWindowCapacity int
 	defaultWindowDuration time.Duration
+	countRejected         bool
+	stopJanitor           func() // stops the background cleanup
 }
 
 // userSlidingWindow represents a sliding window for a specific user
 type userSlidingWindow struct {
-	duration     time.Duration    // window size
-	capacity     int              // maximum number of requests allowed
-	requestStack *utils.TimeStack // timestamps of the requests
+	duration      time.Duration   // window size
+	capacity      int             // maximum number of requests allowed
+	countRejected bool            // log the declined requests
+	requestRing   *utils.TimeRing // timestamps of the requests, from the oldest
 }
 
 type SlidingWindowLogArgs struct {
+	MemoryArgs
 	Capacity int
-	Duration time.Duration
+	Duration time.Duration    // window size, e.g. 100 * time.Millisecond
+	Rejected RejectedPolicy   // ignore or count, whether declined requests count against the window, defaults to ignore
+	Clock    interfaces.Clock // source of time, defaults to the system clock
+}
+
+func (a SlidingWindowLogArgs) Validate() error {
+	if err := validatePositive("capacity", a.Capacity); err != nil {
+		return err
+	}
+
+	if err := validatePositive("duration", a.Duration); err != nil {
+		return err
+	}
+
+	if err := validateRejectedPolicy(a.Rejected); err != nil {
+		return err
+	}
+
+	return a.MemoryArgs.Validate()
+}
+
+func (a SlidingWindowLogArgs) algorithm() interfaces.Algorithm {
+	return interfaces.SlidingWindowLog
+}
+
+func (a SlidingWindowLogArgs) newLimiter(clock interfaces.Clock) interfaces.RateLimiter {
+	a.Clock = clockOr(a.Clock, clock)
+
+	return NewSlidingWindowLogLimiter(a)
+}
+
+func init() {
+	registerAlgorithm(interfaces.AlgorithmSpec{
+		Name:        interfaces.SlidingWindowLog.String(),
+		Command:     "slidingWindowLog",
+		Description: "Sliding window log rate limit algorithm",
+		Fields: append([]interfaces.ConfigField{
+			{Name: "capacity", Type: interfaces.IntField, Required: true, Default: "60", Usage: "The maximum number of requests allowed in the time window"},
+			{Name: "duration", Type: interfaces.DurationField, Required: true, Default: "1m", Usage: "The duration of the window, e.g. 250ms or 1m30s"},
+			{Name: "rejected", Type: interfaces.StringField, Default: string(RejectedIgnored), Usage: `"ignore" does not log the declined requests, "count" counts them against the window`},
+		}, memoryFields...),
+	}, parseSlidingWindowLogArgs)
 }
 
 // Rate Limiter Constructor
 func NewSlidingWindowLogLimiter(args SlidingWindowLogArgs) interfaces.RateLimiter {
-	return &slidingWindowLogLimiter{
-		usersMap:              make(map[string]*userSlidingWindow),
+	l := &slidingWindowLogLimiter{
+		clock:                 interfaces.ClockOrDefault(args.Clock),
+		usersMap:              utils.NewShardedMap[*userSlidingWindow](utils.DefaultShards, args.MaxKeys),
 		defaultWindowCapacity: args.Capacity,
-		defaultWindowDuration: args.Duration * time.Second,
+		defaultWindowDuration: args.Duration,
+		countRejected:         args.Rejected == RejectedCounted,
 	}
+
+	l.stopJanitor = utils.StartJanitor(args.CleanupInterval, l.cleanup)
+
+	return l
 }
 
-func NewSlidingWindowLogLimiterFromConfig(config map[string]string) (interfaces.RateLimiter, error) {
-	capacity, ok := config["capacity"]
+// parseSlidingWindowLogArgs reads the arguments of the algorithm from a string config
+func parseSlidingWindowLogArgs(config map[string]string) (SlidingWindowLogArgs, error) {
+	r := newConfigReader(config)
 
-	if !ok {
-		return nil, &interfaces.RateLimitError{Message: "Missing rate limit capacity"}
+	args := SlidingWindowLogArgs{
+		MemoryArgs: r.memoryArgs(),
+		Capacity:   r.int("capacity"),
+		Duration:   r.duration("duration"),
+		Rejected:   RejectedPolicy(config["rejected"]),
 	}
 
-	duration, ok := config["duration"]
+	return args, r.err
+}
+
+func (l *slidingWindowLogLimiter) Allow(ctx context.Context, user string) (interfaces.RateLimiterStats, error) {
+	return l.AllowN(ctx, user, 1)
+}
+
+func (l *slidingWindowLogLimiter) AllowN(ctx context.Context, user string, n int) (interfaces.RateLimiterStats, error) {
+	// do not count requests whose context is already done
+	if err := ctx.Err(); err != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
+
+	if err := validateTokens(n); err != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
+
+	users, unlock := l.usersMap.Lock(user)
+	defer unlock()
+
+	now := l.clock.Now()
+
+	userWindow := l.userWindow(users, now, user)
+
+	// if user exists, check if there are enough tokens to allow the request
+	err := userWindow.checkTokens(now, n)
+
+	if (err) != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
+
+	return userWindow.stats(now), nil
+}
+
+func (l *slidingWindowLogLimiter) Reserve(ctx context.Context, user string, n int) (*interfaces.Reservation, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
-	if !ok {
-		return nil, &interfaces.RateLimitError{Message: "Missing rate limit duration"}
+	if err := validateTokens(n); err != nil {
+		return nil, err
 	}
 
-	return NewSlidingWindowLogLimiter(SlidingWindowLogArgs{
-		Capacity: utils.ParseInt(capacity),
-		Duration: time.Duration(utils.ParseInt(duration)),
+	users, unlock := l.usersMap.Lock(user)
+	defer unlock()
+
+	now := l.clock.Now()
+
+	userWindow := l.userWindow(users, now, user)
+
+	readyAt, err := userWindow.reserveTokens(now, n)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return interfaces.NewReservation(true, readyAt.Sub(now), userWindow.stats(now), func() {
+		_, unlock := l.usersMap.Lock(user)
+		defer unlock()
+
+		userWindow.requestRing.Remove(readyAt, n)
 	}), nil
 }
 
-func (l *slidingWindowLogLimiter) Allow(user string) (interfaces.RateLimiterStats, error) {
-	// read user from the map
-	userWindow := l.usersMap[user]
+func (l *slidingWindowLogLimiter) Wait(ctx context.Context, user string) error {
+	return waitN(ctx, l, l.clock, user, 1)
+}
+
+func (l *slidingWindowLogLimiter) Peek(ctx context.Context, user string) (interfaces.RateLimiterStats, error) {
+	if err := ctx.Err(); err != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
+
+	users, unlock := l.usersMap.Lock(user)
+	defer unlock()
+
+	now := l.clock.Now()
+
+	userWindow := users.Get(user)
 
 	if userWindow == nil {
-		userWindow = &userSlidingWindow{
-			duration:     l.defaultWindowDuration,
-			capacity:     l.defaultWindowCapacity,
-			requestStack: utils.NewTimeStack(),
-		}
+		return l.newUserWindow(now).stats(now), nil
+	}
 
-		l.usersMap[user] = userWindow
+	return userWindow.peek(now), nil
+}
+
+func (l *slidingWindowLogLimiter) Reset(ctx context.Context, user string) error {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
-	// if user exists, check if there are enough tokens to allow the request
-	err := userWindow.checkTokens()
+	users, unlock := l.usersMap.Lock(user)
+	defer unlock()
 
-	if (err) != nil {
+	users.Delete(user)
+
+	return nil
+}
+
+func (l *slidingWindowLogLimiter) Refund(ctx context.Context, user string, n int) (interfaces.RateLimiterStats, error) {
+	if err := ctx.Err(); err != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
+
+	if err := validateTokens(n); err != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
+
+	users, unlock := l.usersMap.Lock(user)
+	defer unlock()
+
+	now := l.clock.Now()
+
+	userWindow := l.userWindow(users, now, user)
+	userWindow.refundTokens(now, n)
+
+	return userWindow.stats(now), nil
+}
+
+func (l *slidingWindowLogLimiter) SetRemaining(ctx context.Context, user string, n int) (interfaces.RateLimiterStats, error) {
+	if err := ctx.Err(); err != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
+
+	if err := validateTokens(n); err != nil {
 		return interfaces.RateLimiterStats{}, err
 	}
 
-	return userWindow.stats(), nil
+	users, unlock := l.usersMap.Lock(user)
+	defer unlock()
+
+	now := l.clock.Now()
+
+	userWindow := l.userWindow(users, now, user)
+	userWindow.setRemaining(now, n)
+
+	return userWindow.stats(now), nil
 }
 
-func (sw *userSlidingWindow) checkTokens() error {
-	// inline remove requests that are older than the window size
-	for sw.requestStack.Size() > 0 {
-		if time.Since(sw.requestStack.Peek()) > sw.duration {
-			sw.requestStack.Pop()
+// recordRejected logs a request denied through Reserve, e.g. by a multi limiter, when declined requests are counted
+func (l *slidingWindowLogLimiter) recordRejected(user string, n int) {
+	if !l.countRejected {
+		return
+	}
+
+	users, unlock := l.usersMap.Lock(user)
+	defer unlock()
+
+	now := l.clock.Now()
+
+	userWindow := l.userWindow(users, now, user)
+	userWindow.trim(now)
+	userWindow.rejectTokens(now, n)
+}
+
+func (l *slidingWindowLogLimiter) TrackedKeys() int {
+	return l.usersMap.Len()
+}
+
+// slidingWindowLogEntry is the snapshot of a user log
+type slidingWindowLogEntry struct {
+	Requests []int64 // unix nanoseconds of the logged requests, from the oldest
+}
+
+func (l *slidingWindowLogLimiter) Snapshot(w io.Writer) error {
+	now := l.clock.Now()
+
+	return writeSnapshot(w, interfaces.SlidingWindowLog, now, l.usersMap, func(sw *userSlidingWindow) (slidingWindowLogEntry, bool) {
+		if sw.full(now) {
+			return slidingWindowLogEntry{}, false
+		}
+
+		requests := make([]int64, sw.requestRing.Size())
+
+		for i := range requests {
+			requests[i] = sw.requestRing.At(i).UnixNano()
+		}
+
+		return slidingWindowLogEntry{Requests: requests}, true
+	})
+}
+
+func (l *slidingWindowLogLimiter) Restore(r io.Reader) error {
+	now := l.clock.Now()
+
+	return readSnapshot(r, interfaces.SlidingWindowLog, l.usersMap, func(e slidingWindowLogEntry) (*userSlidingWindow, bool) {
+		// the log takes the capacity and duration of this limiter, the requests that left the window are dropped
+		sw := l.newUserWindow(now)
+		slices.Sort(e.Requests)
+
+		for _, ns := range e.Requests {
+			sw.requestRing.Insert(time.Unix(0, ns))
+		}
+
+		sw.trim(now)
+
+		return sw, !sw.full(now)
+	})
+}
+
+func (l *slidingWindowLogLimiter) Close() error {
+	l.stopJanitor()
+
+	return nil
+}
+
+// cleanup removes the users whose state is back to full, they are created again on their next request
+func (l *slidingWindowLogLimiter) cleanup() {
+	now := l.clock.Now()
+
+	l.usersMap.DeleteFunc(func(_ string, sw *userSlidingWindow) bool {
+		return sw.full(now)
+	})
+}
+
+// read user from the map, first request for this user creates a new window
+func (l *slidingWindowLogLimiter) userWindow(users *utils.MapShard[*userSlidingWindow], now time.Time, user string) *userSlidingWindow {
+	userWindow := users.Get(user)
+
+	if userWindow == nil {
+		userWindow = l.newUserWindow(now)
+
+		users.Set(user, userWindow)
+	}
+
+	return userWindow
+}
+
+// create the initial state of a user
+func (l *slidingWindowLogLimiter) newUserWindow(now time.Time) *userSlidingWindow {
+	return &userSlidingWindow{
+		duration:      l.defaultWindowDuration,
+		capacity:      l.defaultWindowCapacity,
+		countRejected: l.countRejected,
+		requestRing:   utils.NewTimeRing(l.defaultWindowCapacity),
+	}
+}
+
+// inline remove requests that are older than the window size
+func (sw *userSlidingWindow) trim(now time.Time) {
+	for sw.requestRing.Size() > 0 {
+		if now.Sub(sw.requestRing.Peek()) > sw.duration {
+			sw.requestRing.Pop()
 		} else {
 			break
 		}
 	}
 
-	// add current request timestamp
-	sw.requestStack.Push(mocks.Now())
+	// give back the memory of the reservations made past the capacity
+	sw.requestRing.Shrink(sw.capacity)
+}
+
+func (sw *userSlidingWindow) checkTokens(now time.Time, n int) error {
+	sw.trim(now)
 
 	// check if there are enough tokens to fulfill the request
-	if sw.requestStack.Size() > sw.capacity {
-		return &interfaces.RateLimitError{Message: "Rate limit exceeded"}
+	if sw.requestRing.Size()+n > sw.capacity {
+		sw.rejectTokens(now, n)
+
+		return sw.limitError(now, n)
+	}
+
+	// add one timestamp for each token of the current request
+	for i := 0; i < n; i++ {
+		sw.requestRing.Insert(now)
 	}
 
 	return nil
 }
 
-func (sw *userSlidingWindow) stats() interfaces.RateLimiterStats {
+// rejectTokens logs a declined request when they are counted, the oldest requests make room in a full window.
+// A request that can never fit is not a retry, it is not logged
+func (sw *userSlidingWindow) rejectTokens(now time.Time, n int) {
+	if !sw.countRejected || n > sw.capacity {
+		return
+	}
+
+	for i := 0; i < n; i++ {
+		if sw.requestRing.Size() >= sw.capacity {
+			sw.requestRing.Pop()
+		}
+
+		sw.requestRing.Insert(now)
+	}
+}
+
+// reserveTokens logs n requests at the time enough older requests have left the window and returns that time.
+// Reserved timestamps can be in the future, they count against the window until they expire. Requests are
+// inserted in order, a request logged now after a reservation stays before it and expires first
+func (sw *userSlidingWindow) reserveTokens(now time.Time, n int) (time.Time, error) {
+	sw.trim(now)
+
+	// the request can never be fulfilled
+	if n > sw.capacity {
+		return time.Time{}, sw.limitError(now, n)
+	}
+
+	readyAt := now
+
+	// number of logged requests that must expire before the new ones fit
+	if expire := sw.requestRing.Size() + n - sw.capacity; expire > 0 {
+		readyAt = sw.requestRing.At(expire - 1).Add(sw.duration)
+	}
+
+	for i := 0; i < n; i++ {
+		sw.requestRing.Insert(readyAt)
+	}
+
+	return readyAt, nil
+}
+
+// limitError returns the error of a denied request with the time until enough requests leave the window
+func (sw *userSlidingWindow) limitError(now time.Time, n int) error {
+	var retryAfter time.Duration
+
+	if expire := sw.requestRing.Size() + n - sw.capacity; n <= sw.capacity && expire > 0 {
+		retryAfter = sw.requestRing.At(expire - 1).Add(sw.duration).Sub(now)
+	}
+
+	return interfaces.NewRateLimitedError(sw.stats(now), retryAfter)
+}
+
+// refundTokens removes the n most recent requests from the log
+func (sw *userSlidingWindow) refundTokens(now time.Time, n int) {
+	sw.trim(now)
+
+	sw.requestRing.Truncate(max(sw.requestRing.Size()-n, 0))
+}
+
+// setRemaining logs or removes requests until n tokens are left in the window
+func (sw *userSlidingWindow) setRemaining(now time.Time, n int) {
+	sw.trim(now)
+
+	requests := sw.capacity - min(n, sw.capacity)
+
+	if sw.requestRing.Size() > requests {
+		sw.requestRing.Truncate(requests)
+		return
+	}
+
+	for sw.requestRing.Size() < requests {
+		sw.requestRing.Insert(now)
+	}
+}
+
+// full reports whether every logged request has left the window, the log is left untouched
+func (sw *userSlidingWindow) full(now time.Time) bool {
+	return sw.active(now) == 0
+}
+
+// active returns the number of logged requests still in the window, without removing the expired ones
+func (sw *userSlidingWindow) active(now time.Time) int {
+	active := 0
+
+	for i := 0; i < sw.requestRing.Size(); i++ {
+		if now.Sub(sw.requestRing.At(i)) <= sw.duration {
+			active++
+		}
+	}
+
+	return active
+}
+
+// peek returns the stats without removing expired requests from the log
+func (sw *userSlidingWindow) peek(now time.Time) interfaces.RateLimiterStats {
+	return sw.statsFor(now, sw.active(now))
+}
+
+func (sw *userSlidingWindow) stats(now time.Time) interfaces.RateLimiterStats {
+	return sw.statsFor(now, sw.requestRing.Size())
+}
+
+// statsFor returns the stats of a window holding the given number of requests
+func (sw *userSlidingWindow) statsFor(now time.Time, requests int) interfaces.RateLimiterStats {
 	return interfaces.RateLimiterStats{
 		Algorithm:   interfaces.SlidingWindowLog.String(),
 		Capacity:    sw.capacity,
-		Remaining:   sw.capacity - sw.requestStack.Size(),
-		Reset:       mocks.Now().Add(sw.duration),
-		CurrentTime: mocks.Now(),
+		Remaining:   max(sw.capacity-requests, 0),
+		Reset:       now.Add(sw.duration),
+		CurrentTime: now,
 	}
 }
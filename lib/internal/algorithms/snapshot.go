@@ -0,0 +1,252 @@
+package algorithms
+
+/*
+Snapshots
+The in-memory rate limiters lose their users when the process stops, so a restart would give every client a full quota.
+A snapshot is a versioned JSON document holding the state of every user that is not back to full. It is restored into
+a limiter of the same algorithm on startup, with the settings of that limiter: users whose state went back to full
+while the process was down are discarded. Saving and restoring are safe while the limiter serves requests.
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/carantes/go-rate-limiter/lib/internal/interfaces"
+	"github.com/carantes/go-rate-limiter/lib/internal/utils"
+)
+
+// version of the snapshot format, snapshots of another version are rejected
+const snapshotVersion = 1
+
+// snapshot is the format of the users of a rate limiter
+type snapshot[E any] struct {
+	Version   int
+	Algorithm string
+	CreatedAt time.Time
+	Users     map[string]E
+}
+
+// snapshotHeader is read first, the users are only decoded once the version is known
+type snapshotHeader struct {
+	Version   int
+	Algorithm string                     `json:",omitempty"`
+	Users     json.RawMessage            `json:",omitempty"`
+	Limits    map[string]json.RawMessage `json:",omitempty"` // snapshots of a group, by limit name
+}
+
+// writeSnapshot writes the users of a limiter, entry returns false for the users back to full
+func writeSnapshot[V any, E any](w io.Writer, algorithm interfaces.Algorithm, now time.Time, users *utils.ShardedMap[V], entry func(v V) (E, bool)) error {
+	s := snapshot[E]{Version: snapshotVersion, Algorithm: algorithm.String(), CreatedAt: now, Users: make(map[string]E)}
+
+	users.Range(func(key string, v V) {
+		if e, ok := entry(v); ok {
+			s.Users[key] = e
+		}
+	})
+
+	return json.NewEncoder(w).Encode(s)
+}
+
+// readSnapshot restores the users of a snapshot, restore returns false for the users back to full by now.
+// Restored users replace the ones already held by the limiter
+func readSnapshot[V any, E any](r io.Reader, algorithm interfaces.Algorithm, users *utils.ShardedMap[V], restore func(e E) (V, bool)) error {
+	header, err := readSnapshotHeader(r)
+
+	if err != nil {
+		return err
+	}
+
+	if header.Algorithm != algorithm.String() {
+		return interfaces.NewSnapshotError(fmt.Sprintf("Rate limiter snapshot of %q cannot be restored into %q", header.Algorithm, algorithm), nil)
+	}
+
+	var entries map[string]E
+
+	if err := json.Unmarshal(header.Users, &entries); err != nil {
+		return interfaces.NewSnapshotError("Invalid rate limiter snapshot", err)
+	}
+
+	for key, e := range entries {
+		v, ok := restore(e)
+
+		if !ok {
+			continue
+		}
+
+		shard, unlock := users.Lock(key)
+		shard.Set(key, v)
+		unlock()
+	}
+
+	return nil
+}
+
+// readSnapshotHeader decodes a snapshot and checks its version
+func readSnapshotHeader(r io.Reader) (snapshotHeader, error) {
+	var header snapshotHeader
+
+	if err := json.NewDecoder(r).Decode(&header); err != nil {
+		return header, interfaces.NewSnapshotError("Invalid rate limiter snapshot", err)
+	}
+
+	return header, header.checkVersion()
+}
+
+// checkVersion rejects the snapshots of another format version
+func (h snapshotHeader) checkVersion() error {
+	if h.Version != snapshotVersion {
+		return interfaces.NewSnapshotError(fmt.Sprintf("Unsupported rate limiter snapshot version %d", h.Version), nil)
+	}
+
+	return nil
+}
+
+// snapshotGroup saves several rate limiters in one snapshot, by name
+type snapshotGroup struct {
+	limiters map[string]interfaces.Snapshotter
+	onError  func(error) // receives the limits that cannot be restored, can be nil
+}
+
+// NewSnapshotGroup returns a Snapshotter of several rate limiters, e.g. the limits of a policy.
+// Restoring skips the limits of the snapshot that are not in the group. A limit that cannot be restored, e.g. its
+// algorithm changed, or a snapshot of another format version, starts empty and its error is passed to onError when it is not nil.
+// Only a snapshot that cannot be read fails
+func NewSnapshotGroup(limiters map[string]interfaces.Snapshotter, onError func(error)) interfaces.Snapshotter {
+	return &snapshotGroup{limiters: limiters, onError: onError}
+}
+
+func (g *snapshotGroup) Snapshot(w io.Writer) error {
+	limits := make(map[string]json.RawMessage, len(g.limiters))
+
+	for name, l := range g.limiters {
+		var buf bytes.Buffer
+
+		if err := l.Snapshot(&buf); err != nil {
+			return fmt.Errorf("limit %q: %w", name, err)
+		}
+
+		limits[name] = buf.Bytes()
+	}
+
+	return json.NewEncoder(w).Encode(snapshotHeader{Version: snapshotVersion, Limits: limits})
+}
+
+func (g *snapshotGroup) Restore(r io.Reader) error {
+	var header snapshotHeader
+
+	if err := json.NewDecoder(r).Decode(&header); err != nil {
+		return interfaces.NewSnapshotError("Invalid rate limiter snapshot", err)
+	}
+
+	if err := header.checkVersion(); err != nil {
+		g.skip(err)
+		return nil
+	}
+
+	for name, raw := range header.Limits {
+		if l, ok := g.limiters[name]; ok {
+			if err := l.Restore(bytes.NewReader(raw)); err != nil {
+				g.skip(fmt.Errorf("limit %q: %w", name, err))
+			}
+		}
+	}
+
+	return nil
+}
+
+// skip reports a snapshot that is not restored
+func (g *snapshotGroup) skip(err error) {
+	if g.onError != nil {
+		g.onError(err)
+	}
+}
+
+// SaveSnapshot writes the snapshot to a file. The file is replaced at once, a crash while writing keeps the previous one
+func SaveSnapshot(s interfaces.Snapshotter, path string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+
+	if err != nil {
+		return err
+	}
+
+	// the temporary file is gone after a successful rename
+	defer os.Remove(f.Name())
+
+	if err := s.Snapshot(f); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// LoadSnapshot restores the snapshot of a file, a missing file is a first start and restores nothing
+func LoadSnapshot(s interfaces.Snapshotter, path string) error {
+	f, err := os.Open(path)
+
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	return s.Restore(f)
+}
+
+// StartSnapshots saves the snapshot to a file every interval, failures are passed to onError when it is not nil.
+// The returned stop ends the periodic saves and saves a last snapshot, e.g. on shutdown. Only its first call saves
+func StartSnapshots(s interfaces.Snapshotter, path string, interval time.Duration, onError func(error)) (stop func() error) {
+	var (
+		mu      sync.Mutex // a periodic save still running when stop is called does not overwrite the last one
+		stopped bool
+		err     error
+	)
+
+	stopSaves := utils.StartJanitor(interval, func() {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if stopped {
+			return
+		}
+
+		if err := SaveSnapshot(s, path); err != nil && onError != nil {
+			onError(err)
+		}
+	})
+
+	return func() error {
+		stopSaves()
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		if !stopped {
+			stopped = true
+			err = SaveSnapshot(s, path)
+		}
+
+		return err
+	}
+}
@@ -4,133 +4,440 @@ package algorithms
 Token Bucket Algorithm
 A new bucket is created every time a new user is seen.
 The bucket is filled with N tokens and every time a request arrives, a token is removed from the bucket.
-If the bucket is empty, the request is declined. The bucket is refilled every second (refill rate) with N tokens.
+If the bucket is empty, the request is declined. The bucket is refilled continuously at refill rate tokens per refill period (one second by default),
+fractions of a token are kept so that any rate, e.g. 0.5 tokens per second, is respected in the long run.
 */
 
 import (
+	"context"
+	"io"
+	"math"
 	"time"
 
 	"github.com/carantes/go-rate-limiter/lib/internal/interfaces"
-	"github.com/carantes/go-rate-limiter/lib/internal/mocks"
 	"github.com/carantes/go-rate-limiter/lib/internal/utils"
 )
 
 // TokenBucketLimiter implements the RateLimiter interface
 type tokenBucketLimiter struct {
-	usersMap          map[string]*userTokenBucket
-	defaultCapacity   int
-	defaultRefillRate int
+	clock               interfaces.Clock
+	usersMap            *utils.ShardedMap[*userTokenBucket] // users state, safe for concurrent use
+	defaultCapacity     int
+	defaultRefillRate   float64
+	defaultRefillPeriod time.Duration
+	stopJanitor         func() // stops the background cleanup
 }
 
 // userTokenBucket represents a token bucket for a specific user
 type userTokenBucket struct {
-	current    int       // current number of available tokens
+	current    float64   // current number of available tokens, negative when tokens are reserved ahead
 	capacity   int       // maximum capacity of tokens
-	refillRate int       // number of tokens to add per second
+	rate       float64   // number of tokens added per nanosecond
 	lastRefill time.Time // last time the bucket was refilled
 }
 
 type TokenBucketArgs struct {
-	Capacity   int
-	RefillRate int
+	MemoryArgs
+	Capacity     int
+	RefillRate   float64          // number of tokens added every refill period, can be fractional
+	RefillPeriod time.Duration    // period of the refill rate, defaults to one second
+	Clock        interfaces.Clock // source of time, defaults to the system clock
 }
 
+func (a TokenBucketArgs) Validate() error {
+	if err := validatePositive("capacity", a.Capacity); err != nil {
+		return err
+	}
+
+	if err := validateNotNegative("refillRate", a.RefillRate); err != nil {
+		return err
+	}
+
+	if err := validateNotNegative("refillPeriod", a.RefillPeriod); err != nil {
+		return err
+	}
+
+	return a.MemoryArgs.Validate()
+}
+
+func (a TokenBucketArgs) algorithm() interfaces.Algorithm {
+	return interfaces.TokenBucket
+}
+
+func (a TokenBucketArgs) newLimiter(clock interfaces.Clock) interfaces.RateLimiter {
+	a.Clock = clockOr(a.Clock, clock)
+
+	return NewTokenBucketLimiter(a)
+}
+
+func init() {
+	registerAlgorithm(interfaces.AlgorithmSpec{
+		Name:        interfaces.TokenBucket.String(),
+		Command:     "tokenBucket",
+		Description: "Token bucket rate limit algorithm",
+		Fields: append([]interfaces.ConfigField{
+			{Name: "capacity", Type: interfaces.IntField, Required: true, Default: "10", Usage: "The maximum number of requests allowed in the time window"},
+			{Name: "refillRate", Type: interfaces.RateField, Required: true, Default: "1", Usage: "The number of requests to add every refill period, or per duration like 5/100ms"},
+			{Name: "refillPeriod", Type: interfaces.DurationField, Usage: "The period of the refill rate, e.g. 100ms. Defaults to 1s"},
+		}, memoryFields...),
+	}, parseTokenBucketArgs)
+}
+
+// tolerance of the token comparisons, absorbs float rounding errors of the refill
+const tokenEpsilon = 1e-9
+
 // Rate Limiter Constructor
 func NewTokenBucketLimiter(args TokenBucketArgs) interfaces.RateLimiter {
-	return &tokenBucketLimiter{
-		usersMap:          make(map[string]*userTokenBucket),
-		defaultCapacity:   args.Capacity,
-		defaultRefillRate: args.RefillRate,
+	l := &tokenBucketLimiter{
+		clock:               interfaces.ClockOrDefault(args.Clock),
+		usersMap:            utils.NewShardedMap[*userTokenBucket](utils.DefaultShards, args.MaxKeys),
+		defaultCapacity:     args.Capacity,
+		defaultRefillRate:   args.RefillRate,
+		defaultRefillPeriod: args.RefillPeriod,
+	}
+
+	if l.defaultRefillPeriod <= 0 {
+		l.defaultRefillPeriod = time.Second
 	}
+
+	l.stopJanitor = utils.StartJanitor(args.CleanupInterval, l.cleanup)
+
+	return l
 }
 
-func NewTokenBucketLimiterFromConfig(config map[string]string) (interfaces.RateLimiter, error) {
-	capacity, ok := config["capacity"]
+// parseTokenBucketArgs reads the arguments of the algorithm from a string config
+func parseTokenBucketArgs(config map[string]string) (TokenBucketArgs, error) {
+	r := newConfigReader(config)
+
+	args := TokenBucketArgs{MemoryArgs: r.memoryArgs(), Capacity: r.int("capacity")}
+	args.RefillRate, args.RefillPeriod = r.refillRate()
+
+	return args, r.err
+}
+
+func (l *tokenBucketLimiter) Allow(ctx context.Context, userId string) (interfaces.RateLimiterStats, error) {
+	return l.AllowN(ctx, userId, 1)
+}
+
+func (l *tokenBucketLimiter) AllowN(ctx context.Context, userId string, n int) (interfaces.RateLimiterStats, error) {
+	// do not count requests whose context is already done
+	if err := ctx.Err(); err != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
 
-	if !ok {
-		return nil, &interfaces.RateLimitError{Message: "Missing rate limit capacity"}
+	if err := validateTokens(n); err != nil {
+		return interfaces.RateLimiterStats{}, err
 	}
 
-	refillRate, ok := config["refillRate"]
+	users, unlock := l.usersMap.Lock(userId)
+	defer unlock()
+
+	now := l.clock.Now()
+
+	bucket := l.userBucket(users, now, userId)
+
+	err := bucket.checkTokens(now, n)
 
-	if !ok {
-		return nil, &interfaces.RateLimitError{Message: "Missing rate limit refill rate"}
+	if (err) != nil {
+		return interfaces.RateLimiterStats{}, err
 	}
 
-	return NewTokenBucketLimiter(TokenBucketArgs{
-		Capacity:   utils.ParseInt(capacity),
-		RefillRate: utils.ParseInt(refillRate),
+	return bucket.stats(now), nil
+}
+
+func (l *tokenBucketLimiter) Reserve(ctx context.Context, userId string, n int) (*interfaces.Reservation, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := validateTokens(n); err != nil {
+		return nil, err
+	}
+
+	users, unlock := l.usersMap.Lock(userId)
+	defer unlock()
+
+	now := l.clock.Now()
+
+	bucket := l.userBucket(users, now, userId)
+
+	readyAt, err := bucket.reserveTokens(now, n)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return interfaces.NewReservation(true, readyAt.Sub(now), bucket.stats(now), func() {
+		_, unlock := l.usersMap.Lock(userId)
+		defer unlock()
+
+		now := l.clock.Now()
+
+		bucket.cancelTokens(now, n, readyAt)
 	}), nil
 }
 
-func (l *tokenBucketLimiter) Allow(userId string) (interfaces.RateLimiterStats, error) {
-	// read user from the map
-	bucket := l.usersMap[userId]
+func (l *tokenBucketLimiter) Wait(ctx context.Context, userId string) error {
+	return waitN(ctx, l, l.clock, userId, 1)
+}
+
+func (l *tokenBucketLimiter) Peek(ctx context.Context, userId string) (interfaces.RateLimiterStats, error) {
+	if err := ctx.Err(); err != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
+
+	users, unlock := l.usersMap.Lock(userId)
+	defer unlock()
+
+	now := l.clock.Now()
+
+	bucket := users.Get(userId)
 
-	// first request for this user, create a new bucket
 	if bucket == nil {
-		bucket = &userTokenBucket{
-			current:    l.defaultCapacity, // start with full bucket
-			capacity:   l.defaultCapacity,
-			refillRate: l.defaultRefillRate,
-			lastRefill: mocks.Now(),
-		}
+		return l.newUserBucket(now).stats(now), nil
+	}
+
+	return bucket.peek(now), nil
+}
 
-		l.usersMap[userId] = bucket
+func (l *tokenBucketLimiter) Reset(ctx context.Context, userId string) error {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
-	err := bucket.checkTokens()
+	users, unlock := l.usersMap.Lock(userId)
+	defer unlock()
 
-	if (err) != nil {
+	users.Delete(userId)
+
+	return nil
+}
+
+func (l *tokenBucketLimiter) Refund(ctx context.Context, userId string, n int) (interfaces.RateLimiterStats, error) {
+	if err := ctx.Err(); err != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
+
+	if err := validateTokens(n); err != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
+
+	users, unlock := l.usersMap.Lock(userId)
+	defer unlock()
+
+	now := l.clock.Now()
+
+	bucket := l.userBucket(users, now, userId)
+	bucket.refundTokens(now, n)
+
+	return bucket.stats(now), nil
+}
+
+func (l *tokenBucketLimiter) SetRemaining(ctx context.Context, userId string, n int) (interfaces.RateLimiterStats, error) {
+	if err := ctx.Err(); err != nil {
 		return interfaces.RateLimiterStats{}, err
 	}
 
-	return bucket.stats(), nil
+	if err := validateTokens(n); err != nil {
+		return interfaces.RateLimiterStats{}, err
+	}
+
+	users, unlock := l.usersMap.Lock(userId)
+	defer unlock()
+
+	now := l.clock.Now()
+
+	bucket := l.userBucket(users, now, userId)
+	bucket.setRemaining(now, n)
+
+	return bucket.stats(now), nil
+}
+
+func (l *tokenBucketLimiter) TrackedKeys() int {
+	return l.usersMap.Len()
+}
+
+// tokenBucketEntry is the snapshot of a user bucket
+type tokenBucketEntry struct {
+	Tokens     float64 // negative when tokens are reserved ahead
+	LastRefill time.Time
+}
+
+func (l *tokenBucketLimiter) Snapshot(w io.Writer) error {
+	now := l.clock.Now()
+
+	return writeSnapshot(w, interfaces.TokenBucket, now, l.usersMap, func(b *userTokenBucket) (tokenBucketEntry, bool) {
+		return tokenBucketEntry{Tokens: b.current, LastRefill: b.lastRefill}, !b.full(now)
+	})
+}
+
+func (l *tokenBucketLimiter) Restore(r io.Reader) error {
+	now := l.clock.Now()
+
+	return readSnapshot(r, interfaces.TokenBucket, l.usersMap, func(e tokenBucketEntry) (*userTokenBucket, bool) {
+		// the bucket takes the capacity and rate of this limiter, tokens refill while the process was down
+		b := l.newUserBucket(now)
+		b.current = min(e.Tokens, float64(b.capacity))
+
+		if e.LastRefill.Before(now) {
+			b.lastRefill = e.LastRefill
+		}
+
+		return b, !b.full(now)
+	})
+}
+
+func (l *tokenBucketLimiter) Close() error {
+	l.stopJanitor()
+
+	return nil
+}
+
+// cleanup removes the users whose state is back to full, they are created again on their next request
+func (l *tokenBucketLimiter) cleanup() {
+	now := l.clock.Now()
+
+	l.usersMap.DeleteFunc(func(_ string, b *userTokenBucket) bool {
+		return b.full(now)
+	})
 }
 
-func (b *userTokenBucket) checkTokens() error {
+// read user from the map, first request for this user creates a new bucket
+func (l *tokenBucketLimiter) userBucket(users *utils.MapShard[*userTokenBucket], now time.Time, userId string) *userTokenBucket {
+	bucket := users.Get(userId)
+
+	if bucket == nil {
+		bucket = l.newUserBucket(now)
+
+		users.Set(userId, bucket)
+	}
+
+	return bucket
+}
+
+// create the initial state of a user
+func (l *tokenBucketLimiter) newUserBucket(now time.Time) *userTokenBucket {
+	return &userTokenBucket{
+		current:    float64(l.defaultCapacity), // start with full bucket
+		capacity:   l.defaultCapacity,
+		rate:       l.defaultRefillRate / float64(l.defaultRefillPeriod),
+		lastRefill: now,
+	}
+}
+
+func (b *userTokenBucket) checkTokens(now time.Time, n int) error {
 	// refill the bucket before checking
-	b.refill()
+	b.refill(now)
 
-	// Not enough tokens to fulfill the request
-	if b.current <= 0 {
-		return &interfaces.RateLimitError{Message: "Rate limit exceeded"}
+	// Not enough tokens to fulfill the request, nothing is consumed
+	if !b.has(float64(n)) {
+		return b.limitError(now, n)
 	}
 
-	b.current--
+	b.current -= float64(n)
 
 	return nil
 }
 
-func (b *userTokenBucket) refill() {
-	// calculate the number of tokens to add since the last refill
-	elapsed := time.Since(b.lastRefill)
+// reserveTokens takes n tokens even if the bucket goes below zero and returns when the debt is refilled
+func (b *userTokenBucket) reserveTokens(now time.Time, n int) (time.Time, error) {
+	b.refill(now)
+
+	// the request can never be fulfilled
+	if n > b.capacity || (!b.has(float64(n)) && b.rate <= 0) {
+		return time.Time{}, b.limitError(now, n)
+	}
+
+	b.current -= float64(n)
+
+	return now.Add(b.refillTime(0)), nil
+}
 
-	if elapsed.Seconds() <= 0 {
+// cancelTokens gives back n tokens reserved for readyAt, tokens already spent past that time are not restored
+func (b *userTokenBucket) cancelTokens(now time.Time, n int, readyAt time.Time) {
+	if now.After(readyAt) {
 		return
 	}
 
-	tokensToAdd := int(elapsed.Seconds()) * b.refillRate
+	b.refundTokens(now, n)
+}
 
-	newCurrent := b.current + tokensToAdd
+// limitError returns the error of a denied request with the time until n tokens are available
+func (b *userTokenBucket) limitError(now time.Time, n int) error {
+	var retryAfter time.Duration
 
-	// check if the number of tokens exceeds the capacity
-	if newCurrent > b.capacity {
-		b.current = b.capacity
-	} else {
-		b.current = newCurrent
+	if n <= b.capacity && b.rate > 0 {
+		retryAfter = b.refillTime(float64(n))
 	}
 
-	b.lastRefill = mocks.Now()
+	return interfaces.NewRateLimitedError(b.stats(now), retryAfter)
+}
+
+// refundTokens gives n tokens back to the bucket, up to its capacity
+func (b *userTokenBucket) refundTokens(now time.Time, n int) {
+	b.refill(now)
+
+	b.current = min(b.current+float64(n), float64(b.capacity))
+}
+
+// setRemaining overrides the number of available tokens
+func (b *userTokenBucket) setRemaining(now time.Time, n int) {
+	b.refill(now)
+
+	b.current = float64(min(n, b.capacity))
+}
+
+// refill adds the tokens accrued since the last refill, fractions of a token are kept
+func (b *userTokenBucket) refill(now time.Time) {
+	elapsed := now.Sub(b.lastRefill)
+
+	if elapsed <= 0 {
+		return
+	}
+
+	b.current = min(b.current+float64(elapsed)*b.rate, float64(b.capacity))
+	b.lastRefill = now
+}
+
+// has reports whether n tokens are available, ignoring float rounding errors
+func (b *userTokenBucket) has(n float64) bool {
+	return b.current+tokenEpsilon >= n
+}
+
+// refillTime returns the time until the bucket holds n tokens, measured from the last refill
+func (b *userTokenBucket) refillTime(n float64) time.Duration {
+	missing := n - b.current
+
+	if missing <= tokenEpsilon || b.rate <= 0 {
+		return 0
+	}
+
+	return time.Duration(math.Ceil(missing / b.rate))
+}
+
+// full reports whether the bucket is back to its capacity, the same state as a new bucket
+func (b *userTokenBucket) full(now time.Time) bool {
+	bucket := *b
+	bucket.refill(now)
+
+	return bucket.has(float64(bucket.capacity))
+}
+
+// peek returns the stats of a refilled copy of the bucket, the bucket itself is not changed
+func (b *userTokenBucket) peek(now time.Time) interfaces.RateLimiterStats {
+	bucket := *b
+	bucket.refill(now)
+
+	return bucket.stats(now)
 }
 
-// Return the rate limit stats for the user
-func (b *userTokenBucket) stats() interfaces.RateLimiterStats {
+// Return the rate limit stats for the user, reset is the time the bucket is full again
+func (b *userTokenBucket) stats(now time.Time) interfaces.RateLimiterStats {
 	return interfaces.RateLimiterStats{
 		Algorithm:   interfaces.TokenBucket.String(),
 		Capacity:    b.capacity,
-		Remaining:   b.current,
-		Reset:       b.lastRefill.Add(time.Duration(b.capacity-b.current) * time.Second),
-		CurrentTime: mocks.Now(),
+		Remaining:   max(int(math.Floor(b.current+tokenEpsilon)), 0),
+		Reset:       b.lastRefill.Add(b.refillTime(float64(b.capacity))),
+		CurrentTime: now,
 	}
 }
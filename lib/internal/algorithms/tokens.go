@@ -0,0 +1,12 @@
+package algorithms
+
+import "github.com/carantes/go-rate-limiter/lib/internal/interfaces"
+
+// validateTokens checks the number of tokens requested by AllowN
+func validateTokens(n int) error {
+	if n < 0 {
+		return &interfaces.RateLimitError{Message: "Invalid number of tokens", Err: interfaces.ErrInvalidTokens}
+	}
+
+	return nil
+}
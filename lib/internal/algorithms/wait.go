@@ -0,0 +1,64 @@
+package algorithms
+
+import (
+	"context"
+	"time"
+
+	"github.com/carantes/go-rate-limiter/lib/internal/interfaces"
+)
+
+// pause between two attempts when a reservation could not be made and no delay is known
+const minRetryDelay = 10 * time.Millisecond
+
+// reserver is implemented by the limiters that can hold tokens ahead of time
+type reserver interface {
+	Reserve(ctx context.Context, user string, n int) (*interfaces.Reservation, error)
+}
+
+// waitN blocks until n tokens are reserved for the user and the reservation delay has passed.
+// The reservation is cancelled when the context is done first. The delay is measured with the limiter clock,
+// the context deadline is always wall clock time.
+func waitN(ctx context.Context, l reserver, clock interfaces.Clock, user string, n int) error {
+	for {
+		r, err := l.Reserve(ctx, user, n)
+
+		if err != nil {
+			return err
+		}
+
+		delay := r.Delay()
+
+		if r.OK() && delay == 0 {
+			return nil
+		}
+
+		if !r.OK() && delay == 0 {
+			delay = minRetryDelay
+		}
+
+		// fail fast when the context would expire before the tokens are available
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			r.Cancel()
+			stats := r.Stats()
+
+			return &interfaces.RateLimitError{
+				Message:    "Wait would exceed the context deadline",
+				Err:        interfaces.ErrRateLimited,
+				RetryAfter: delay,
+				Limit:      stats.Capacity,
+				Stats:      stats,
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			r.Cancel()
+			return ctx.Err()
+		case <-clock.After(delay):
+		}
+
+		if r.OK() {
+			return nil
+		}
+	}
+}
@@ -1,31 +1,29 @@
 package interfaces
 
-import "strings"
-
-type Algorithm int
+// Algorithm is the name of a registered rate limit algorithm
+type Algorithm string
 
+// Built-in algorithms, registered by the algorithms package
 const (
-	TokenBucket Algorithm = iota
-	FixedWindow
-	SlidingWindowLog
-	SlidingWindowCounter
-	RedisSlidingWindowCounter
+	TokenBucket                Algorithm = "token-bucket"
+	FixedWindow                Algorithm = "fixed-window"
+	SlidingWindowLog           Algorithm = "sliding-window-log"
+	SlidingWindowCounter       Algorithm = "sliding-window-counter"
+	RedisSlidingWindowCounter  Algorithm = "redis-sliding-window-counter"
+	LeakyBucket                Algorithm = "leaky-bucket"
+	GCRA                       Algorithm = "gcra"
+	RedisGCRA                  Algorithm = "redis-gcra"
+	BucketedSlidingWindow      Algorithm = "bucketed-sliding-window"
+	RedisBucketedSlidingWindow Algorithm = "redis-bucketed-sliding-window"
 )
 
+// ParseAlgorithm returns the registered algorithm with the given name, case insensitive
 func ParseAlgorithm(s string) (Algorithm, bool) {
-	var algorithmMap = map[string]Algorithm{
-		"token-bucket":                 TokenBucket,
-		"fixed-window":                 FixedWindow,
-		"sliding-window-log":           SlidingWindowLog,
-		"sliding-window-counter":       SlidingWindowCounter,
-		"redis-sliding-window-counter": RedisSlidingWindowCounter,
-	}
-
-	a, ok := algorithmMap[strings.ToLower(s)]
+	spec, ok := LookupAlgorithm(s)
 
-	return a, ok
+	return Algorithm(spec.Name), ok
 }
 
 func (d Algorithm) String() string {
-	return [...]string{"token-bucket", "fixed-window", "sliding-window-log", "sliding-window-counter", "redis-sliding-window-counter"}[d]
+	return string(d)
 }
@@ -0,0 +1,33 @@
+package interfaces
+
+import "time"
+
+// Clock is the source of time of the rate limiters, it is passed to each limiter at construction
+type Clock interface {
+	// Now returns the current time
+	Now() time.Time
+	// After waits for the duration to elapse and then sends the current time on the returned channel
+	After(d time.Duration) <-chan time.Time
+}
+
+// SystemClock reads the time from the operating system
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// ClockOrDefault returns the given clock or the system clock when it is nil
+func ClockOrDefault(c Clock) Clock {
+	if c == nil {
+		return SystemClock
+	}
+
+	return c
+}
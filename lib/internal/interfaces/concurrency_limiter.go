@@ -0,0 +1,42 @@
+package interfaces
+
+import (
+	"context"
+	"time"
+)
+
+// ConcurrencyLimiter limits how many requests a key has in flight at once, instead of how many it makes over time
+type ConcurrencyLimiter interface {
+	//take an in-flight slot for the key, waiting for a free one when queueing is enabled.
+	//The returned release gives the slot back, it must be called when the request ends and can be called more than once
+	Acquire(ctx context.Context, key string) (release func(), err error)
+
+	//return the number of requests in flight for the key and for every key
+	InFlight(ctx context.Context, key string) (perKey int, total int, err error)
+
+	//release the resources held by the limiter, e.g. backend connections
+	Close() error
+}
+
+// AdaptiveLimiter is a concurrency limiter whose limit follows the latency and the failures of the requests
+type AdaptiveLimiter interface {
+	ConcurrencyLimiter
+
+	//take a slot like Acquire. The returned done gives the slot back and reports the outcome of the request,
+	//its latency is measured from the acquire. It must be called when the request ends, only the first call counts
+	AcquireTracked(ctx context.Context, key string) (done func(failed bool), err error)
+
+	//return the current limit and the latencies it is based on
+	Stats() AdaptiveLimiterStats
+}
+
+// AdaptiveLimiterStats represents the state of an adaptive limiter
+type AdaptiveLimiterStats struct {
+	Algorithm       string
+	Limit           int           // current limit on the requests in flight
+	MinLimit        int           // the limit never goes below
+	MaxLimit        int           // the limit never goes above
+	InFlight        int           // requests in flight over every key
+	Latency         time.Duration // latency of the last request
+	BaselineLatency time.Duration // long-term average latency, used by the gradient algorithm
+}
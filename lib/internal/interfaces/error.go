@@ -1,10 +1,88 @@
 package interfaces
 
+import (
+	"errors"
+	"time"
+)
+
+// Sentinel errors, use errors.Is to find out why a rate limiter failed
+var (
+	ErrRateLimited        = errors.New("rate limit exceeded")
+	ErrInvalidConfig      = errors.New("invalid rate limiter config")
+	ErrInvalidTokens      = errors.New("invalid number of tokens")
+	ErrBackendUnavailable = errors.New("rate limiter backend unavailable")
+	ErrInvalidSnapshot    = errors.New("invalid rate limiter snapshot")
+)
+
 // Custom Error
 type RateLimitError struct {
-	Message string
+	Message    string
+	Field      string           // config field that failed the validation
+	Err        error            // sentinel error matching the failure
+	Cause      error            // underlying error, e.g. returned by the backend
+	RetryAfter time.Duration    // time until the request may succeed, zero when it can never fit
+	Limit      int              // capacity of the limit that denied the request
+	Stats      RateLimiterStats // user stats at the time of the denial
+	LimitName  string           // name of the limit that denied the request, e.g. set by the multi limiter
 }
 
 func (r *RateLimitError) Error() string {
-	panic(r.Message)
+	if r.Cause != nil {
+		return r.Message + ": " + r.Cause.Error()
+	}
+
+	return r.Message
+}
+
+// Unwrap allows errors.Is and errors.As to match both the sentinel and the underlying error
+func (r *RateLimitError) Unwrap() []error {
+	var errs []error
+
+	if r.Err != nil {
+		errs = append(errs, r.Err)
+	}
+
+	if r.Cause != nil {
+		errs = append(errs, r.Cause)
+	}
+
+	return errs
+}
+
+// NewRateLimitedError returns the error of a denied request
+func NewRateLimitedError(stats RateLimiterStats, retryAfter time.Duration) error {
+	return &RateLimitError{
+		Message:    "Rate limit exceeded",
+		Err:        ErrRateLimited,
+		RetryAfter: max(retryAfter, 0),
+		Limit:      stats.Capacity,
+		Stats:      stats,
+	}
+}
+
+// NewConfigError returns the error of an invalid configuration
+func NewConfigError(message string) error {
+	return &RateLimitError{Message: message, Err: ErrInvalidConfig}
+}
+
+// NewFieldError returns the error of an invalid config field
+func NewFieldError(field string, message string) error {
+	return &RateLimitError{Message: message, Err: ErrInvalidConfig, Field: field}
+}
+
+// NewSnapshotError returns the error of a snapshot that cannot be restored
+func NewSnapshotError(message string, cause error) error {
+	return &RateLimitError{Message: message, Err: ErrInvalidSnapshot, Cause: cause}
+}
+
+// NewBackendError wraps an error returned by the storage backend.
+// Errors already returned by a rate limiter are kept as they are
+func NewBackendError(err error) error {
+	var rlErr *RateLimitError
+
+	if err == nil || errors.As(err, &rlErr) {
+		return err
+	}
+
+	return &RateLimitError{Message: "Rate limiter backend unavailable", Err: ErrBackendUnavailable, Cause: err}
 }
@@ -1,11 +1,55 @@
 package interfaces
 
-import "time"
+import (
+	"context"
+	"io"
+	"time"
+)
 
 // RateLimiter is an interface that defines the methods that a rate limiter should implement
 type RateLimiter interface {
-	//check if a request is allowed, return user stats or error
-	Allow(user string) (RateLimiterStats, error)
+	//check if a request is allowed, return user stats or error.
+	//If the context is cancelled or expires before the decision is made the request is not counted and the context error is returned
+	Allow(ctx context.Context, user string) (RateLimiterStats, error)
+
+	//check if a request costing n tokens is allowed. The check is atomic, a denied request consumes nothing
+	AllowN(ctx context.Context, user string, n int) (RateLimiterStats, error)
+
+	//reserve n tokens ahead of time, the reservation tells how long to wait before acting and can be cancelled to give the tokens back
+	Reserve(ctx context.Context, user string, n int) (*Reservation, error)
+
+	//block until a request is allowed for the user or the context is done
+	Wait(ctx context.Context, user string) error
+
+	//return the current user stats without consuming tokens or changing the user state
+	Peek(ctx context.Context, user string) (RateLimiterStats, error)
+
+	//drop the user state, the next request starts from the full capacity
+	Reset(ctx context.Context, user string) error
+
+	//give n tokens back to the user, e.g. when a request should not have counted
+	Refund(ctx context.Context, user string, n int) (RateLimiterStats, error)
+
+	//override the number of tokens left for the user
+	SetRemaining(ctx context.Context, user string, n int) (RateLimiterStats, error)
+
+	//release the resources held by the rate limiter, e.g. background cleanup or backend connections
+	Close() error
+}
+
+// KeyTracker is implemented by the rate limiters that keep their users in memory
+type KeyTracker interface {
+	//return the number of users currently held in memory
+	TrackedKeys() int
+}
+
+// Snapshotter is implemented by the in-memory rate limiters whose users can be saved and restored across restarts
+type Snapshotter interface {
+	//write the state of every user whose state is not back to full
+	Snapshot(w io.Writer) error
+
+	//read a snapshot written by the same algorithm, users whose state is back to full by now are discarded
+	Restore(r io.Reader) error
 }
 
 // RateLimiterStats represents the stats of a rate limiter for a specific user
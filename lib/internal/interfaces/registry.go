@@ -0,0 +1,203 @@
+package interfaces
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/carantes/go-rate-limiter/lib/internal/utils"
+)
+
+// FieldType is the type of the value of a config field
+type FieldType int
+
+const (
+	IntField FieldType = iota
+	FloatField
+	StringField
+	DurationField // e.g. "250ms" or "1m30s", a plain number is read as seconds
+	RateField     // a number, or a number per duration e.g. "5/100ms"
+)
+
+// ConfigField describes one key of the string config of an algorithm
+type ConfigField struct {
+	Name     string
+	Type     FieldType
+	Required bool
+	Default  string // default value of the command line flag
+	Usage    string
+}
+
+// AlgorithmSpec describes a rate limit algorithm, register it with RegisterAlgorithm
+type AlgorithmSpec struct {
+	Name        string        // name used in configs, e.g. "token-bucket"
+	Command     string        // name of the CLI subcommand, defaults to the name
+	Description string        // one line description, e.g. "Token bucket rate limit algorithm"
+	Fields      []ConfigField // keys accepted by the config, besides "algorithm"
+
+	// Factory creates a rate limiter, the config has been checked against the fields
+	Factory func(config map[string]string, clock Clock) (RateLimiter, error)
+
+	// Validate checks the values of the config without creating the rate limiter, optional
+	Validate func(config map[string]string) error
+}
+
+// registry holds the registered algorithms, safe for concurrent use
+var registry = struct {
+	sync.RWMutex
+	specs map[string]AlgorithmSpec
+}{specs: make(map[string]AlgorithmSpec)}
+
+// RegisterAlgorithm adds an algorithm to the registry, names are case insensitive and must be unique
+func RegisterAlgorithm(spec AlgorithmSpec) error {
+	name := strings.ToLower(spec.Name)
+
+	if name == "" || spec.Factory == nil {
+		return NewConfigError("An algorithm needs a name and a factory")
+	}
+
+	if spec.Command == "" {
+		spec.Command = spec.Name
+	}
+
+	registry.Lock()
+	defer registry.Unlock()
+
+	if _, ok := registry.specs[name]; ok {
+		return NewConfigError(fmt.Sprintf("Algorithm %q is already registered", spec.Name))
+	}
+
+	registry.specs[name] = spec
+
+	return nil
+}
+
+// MustRegisterAlgorithm registers an algorithm and panics on error, for use in init functions
+func MustRegisterAlgorithm(spec AlgorithmSpec) {
+	if err := RegisterAlgorithm(spec); err != nil {
+		panic(err)
+	}
+}
+
+// LookupAlgorithm returns the registered algorithm with the given name
+func LookupAlgorithm(name string) (AlgorithmSpec, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+
+	spec, ok := registry.specs[strings.ToLower(name)]
+
+	return spec, ok
+}
+
+// Algorithms returns every registered algorithm sorted by name
+func Algorithms() []AlgorithmSpec {
+	registry.RLock()
+	defer registry.RUnlock()
+
+	specs := make([]AlgorithmSpec, 0, len(registry.specs))
+
+	for _, spec := range registry.specs {
+		specs = append(specs, spec)
+	}
+
+	sort.Slice(specs, func(i, j int) bool { return specs[i].Name < specs[j].Name })
+
+	return specs
+}
+
+// ValidateConfig checks a string config against its algorithm without creating the rate limiter
+func ValidateConfig(config map[string]string) error {
+	spec, ok := LookupAlgorithm(config["algorithm"])
+
+	if !ok {
+		return NewFieldError("algorithm", fmt.Sprintf("Unknown rate limit algorithm %q", config["algorithm"]))
+	}
+
+	if err := spec.CheckConfig(config); err != nil {
+		return err
+	}
+
+	if spec.Validate != nil {
+		return spec.Validate(config)
+	}
+
+	return nil
+}
+
+// CheckConfig rejects the keys that are not fields of the algorithm, missing required fields
+// and values that do not match their type. Empty optional values are accepted
+func (s AlgorithmSpec) CheckConfig(config map[string]string) error {
+	fields := make(map[string]ConfigField, len(s.Fields))
+
+	for _, f := range s.Fields {
+		fields[f.Name] = f
+	}
+
+	keys := make([]string, 0, len(config))
+
+	for key := range config {
+		keys = append(keys, key)
+	}
+
+	// report the same error for the same config
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := config[key]
+
+		if key == "algorithm" {
+			continue
+		}
+
+		f, ok := fields[key]
+
+		if !ok {
+			return NewFieldError(key, fmt.Sprintf("Unknown rate limit config %q", key))
+		}
+
+		if value == "" && !f.Required {
+			continue
+		}
+
+		if err := f.check(value); err != nil {
+			return err
+		}
+	}
+
+	for _, f := range s.Fields {
+		if _, ok := config[f.Name]; f.Required && !ok {
+			return NewFieldError(f.Name, fmt.Sprintf("Missing rate limit config %q", f.Name))
+		}
+	}
+
+	return nil
+}
+
+// check returns an error when the value does not match the type of the field
+func (f ConfigField) check(value string) error {
+	var err error
+	var kind string
+
+	switch f.Type {
+	case IntField:
+		_, err = strconv.Atoi(value)
+		kind = "an integer"
+	case FloatField:
+		_, err = strconv.ParseFloat(value, 64)
+		kind = "a number"
+	case DurationField:
+		_, err = utils.ParseDuration(value)
+		kind = "a duration"
+	case RateField:
+		_, _, err = utils.ParseRate(value)
+		kind = "a rate"
+	}
+
+	if err != nil {
+		return NewFieldError(f.Name, fmt.Sprintf("Invalid rate limit config %q, %q is not %s", f.Name, value, kind))
+	}
+
+	return nil
+}
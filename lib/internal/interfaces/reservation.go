@@ -0,0 +1,54 @@
+package interfaces
+
+import (
+	"sync"
+	"time"
+)
+
+// Reservation holds tokens taken from a rate limiter ahead of time.
+// When OK is false no tokens are held and Delay tells when a new reservation may succeed.
+type Reservation struct {
+	ok     bool
+	delay  time.Duration
+	stats  RateLimiterStats
+	cancel func()
+	once   sync.Once
+}
+
+// NewReservation creates a reservation, cancel is called at most once to give the tokens back
+func NewReservation(ok bool, delay time.Duration, stats RateLimiterStats, cancel func()) *Reservation {
+	if delay < 0 {
+		delay = 0
+	}
+
+	return &Reservation{
+		ok:     ok,
+		delay:  delay,
+		stats:  stats,
+		cancel: cancel,
+	}
+}
+
+// OK reports whether the tokens are held by the reservation
+func (r *Reservation) OK() bool {
+	return r.ok
+}
+
+// Delay returns how long to wait before acting on the reservation
+func (r *Reservation) Delay() time.Duration {
+	return r.delay
+}
+
+// Stats returns the user stats at the time of the reservation
+func (r *Reservation) Stats() RateLimiterStats {
+	return r.stats
+}
+
+// Cancel gives the reserved tokens back to the rate limiter, tokens that already expired are not restored
+func (r *Reservation) Cancel() {
+	if !r.ok || r.cancel == nil {
+		return
+	}
+
+	r.once.Do(r.cancel)
+}
@@ -0,0 +1,81 @@
+package mocks
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is a controllable clock for tests, time only moves with Advance and Set
+type Clock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []clockWaiter
+}
+
+// clockWaiter is a channel returned by After, fired once the clock reaches its deadline
+type clockWaiter struct {
+	deadline time.Time
+	ch       chan time.Time
+}
+
+// NewClock creates a clock stopped at the given time
+func NewClock(now time.Time) *Clock {
+	return &Clock{now: now}
+}
+
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *Clock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ch := make(chan time.Time, 1)
+
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+
+	c.waiters = append(c.waiters, clockWaiter{deadline: c.now.Add(d), ch: ch})
+
+	return ch
+}
+
+// Advance moves the clock forward by d
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.set(c.now.Add(d))
+}
+
+// Set moves the clock to the given time
+func (c *Clock) Set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.set(now)
+}
+
+// set updates the time and fires the waiters whose deadline has passed
+func (c *Clock) set(now time.Time) {
+	c.now = now
+
+	pending := c.waiters[:0]
+
+	for _, w := range c.waiters {
+		if w.deadline.After(now) {
+			pending = append(pending, w)
+			continue
+		}
+
+		w.ch <- now
+	}
+
+	c.waiters = pending
+}
@@ -0,0 +1,50 @@
+package mocks_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/carantes/go-rate-limiter/lib/internal/mocks"
+	"github.com/stretchr/testify/suite"
+)
+
+type clockSuite struct {
+	suite.Suite
+	start time.Time
+	*mocks.Clock
+}
+
+func (s *clockSuite) SetupTest() {
+	s.start = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.Clock = mocks.NewClock(s.start)
+}
+
+func (s *clockSuite) TestAdvance() {
+	s.Equal(s.start, s.Clock.Now())
+	s.Clock.Advance(time.Second)
+	s.Equal(s.start.Add(time.Second), s.Clock.Now())
+}
+
+func (s *clockSuite) TestSet() {
+	later := s.start.Add(time.Hour)
+	s.Clock.Set(later)
+	s.Equal(later, s.Clock.Now())
+}
+
+func (s *clockSuite) TestAfter() {
+	ch := s.Clock.After(time.Second)
+
+	s.Clock.Advance(500 * time.Millisecond)
+	s.Empty(ch)
+
+	s.Clock.Advance(500 * time.Millisecond)
+	s.Equal(s.start.Add(time.Second), <-ch)
+
+	s.Run("Zero duration fires immediately", func() {
+		s.Equal(s.Clock.Now(), <-s.Clock.After(0))
+	})
+}
+
+func TestClockSuite(t *testing.T) {
+	suite.Run(t, new(clockSuite))
+}
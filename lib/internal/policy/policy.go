@@ -0,0 +1,247 @@
+package policy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/carantes/go-rate-limiter/lib/internal/interfaces"
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// Supported policy file formats
+const (
+	FormatYAML = "yaml"
+	FormatJSON = "json"
+	FormatTOML = "toml"
+)
+
+// KeyGlobal is the key of the limits shared by every request
+const KeyGlobal = "global"
+
+// Policy defines named limits and the backends they store their data in
+type Policy struct {
+	Backends map[string]Backend `json:"backends" yaml:"backends" toml:"backends"`
+	Limits   []Limit            `json:"limits" yaml:"limits" toml:"limits"`
+}
+
+// Backend is a named storage shared by the limits, the in-memory backend needs no definition
+type Backend struct {
+	RedisURL string `json:"redisURL" yaml:"redisURL" toml:"redisURL"`
+}
+
+// Limit is a named rate limit, its params are the algorithm config (e.g. capacity, duration)
+type Limit struct {
+	Name      string         `json:"name" yaml:"name" toml:"name"`
+	Algorithm string         `json:"algorithm" yaml:"algorithm" toml:"algorithm"`
+	Backend   string         `json:"backend" yaml:"backend" toml:"backend"` // name of a backend, in memory when empty
+	Routes    []string       `json:"routes" yaml:"routes" toml:"routes"`    // routes the limit applies to, all of them when empty
+	Key       string         `json:"key" yaml:"key" toml:"key"`             // what requests are counted by: "ip" (default), "header:<name>" or "global"
+	Parent    string         `json:"parent" yaml:"parent" toml:"parent"`    // name of an enclosing limit, its key prefixes the key of this limit
+	Params    map[string]any `json:"params" yaml:"params" toml:"params"`
+}
+
+// Load reads a policy file, the format is chosen by its extension (.yaml, .yml, .json or .toml)
+func Load(path string) (*Policy, error) {
+	format, ok := formatOf(path)
+
+	if !ok {
+		return nil, interfaces.NewConfigError(fmt.Sprintf("Unsupported policy file extension %q", filepath.Ext(path)))
+	}
+
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return Parse(data, format)
+}
+
+// Parse decodes and validates a policy, fields unknown to the format are rejected
+func Parse(data []byte, format string) (*Policy, error) {
+	var p Policy
+	var err error
+
+	switch format {
+	case FormatYAML:
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err = dec.Decode(&p)
+	case FormatJSON:
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&p)
+	case FormatTOML:
+		dec := toml.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&p)
+	default:
+		return nil, interfaces.NewConfigError(fmt.Sprintf("Unsupported policy format %q", format))
+	}
+
+	if err != nil {
+		return nil, &interfaces.RateLimitError{Message: "Invalid policy file", Err: interfaces.ErrInvalidConfig, Cause: err}
+	}
+
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &p, nil
+}
+
+// Validate checks every limit of the policy, the error names the limit that failed
+func (p *Policy) Validate() error {
+	if len(p.Limits) == 0 {
+		return interfaces.NewFieldError("limits", "The policy defines no limits")
+	}
+
+	seen := make(map[string]bool)
+
+	for _, l := range p.Limits {
+		if l.Name == "" {
+			return interfaces.NewFieldError("name", "Missing limit name")
+		}
+
+		if seen[l.Name] {
+			return interfaces.NewFieldError("name", fmt.Sprintf("Duplicate limit name %q", l.Name))
+		}
+
+		seen[l.Name] = true
+
+		if _, ok := parseKey(l.Key); !ok {
+			return interfaces.NewFieldError("key", fmt.Sprintf("Invalid key %q of limit %q", l.Key, l.Name))
+		}
+
+		// parents are defined first, a limit cannot be nested in itself
+		if l.Parent != "" && (!seen[l.Parent] || l.Parent == l.Name) {
+			return interfaces.NewFieldError("parent", fmt.Sprintf("Unknown parent %q of limit %q, it must be defined before", l.Parent, l.Name))
+		}
+
+		config, err := p.Config(l)
+
+		if err == nil {
+			err = interfaces.ValidateConfig(config)
+		}
+
+		if err != nil {
+			return fmt.Errorf("limit %q: %w", l.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// Config returns the string config of a limit, the backend is resolved from the policy
+func (p *Policy) Config(l Limit) (map[string]string, error) {
+	config := map[string]string{"algorithm": l.Algorithm}
+
+	for key, value := range l.Params {
+		config[key] = paramString(value)
+	}
+
+	if l.Backend != "" {
+		backend, ok := p.Backends[l.Backend]
+
+		if !ok {
+			return nil, interfaces.NewFieldError("backend", fmt.Sprintf("Unknown backend %q", l.Backend))
+		}
+
+		config["redisURL"] = backend.RedisURL
+	}
+
+	// limits sharing a Redis server keep their users under their own keys
+	if _, ok := config["keyPrefix"]; !ok && hasField(l.Algorithm, "keyPrefix") {
+		config["keyPrefix"] = l.Name
+	}
+
+	return config, nil
+}
+
+// hasField reports whether the algorithm takes the config field
+func hasField(algorithm string, name string) bool {
+	spec, ok := interfaces.LookupAlgorithm(algorithm)
+
+	if !ok {
+		return false
+	}
+
+	for _, f := range spec.Fields {
+		if f.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Applies reports whether the limit counts requests to the route, a limit without routes applies to all of them
+func (l Limit) Applies(route string) bool {
+	if len(l.Routes) == 0 {
+		return true
+	}
+
+	for _, r := range l.Routes {
+		if r == route {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Header returns the request header holding the user key, empty when requests are counted by client IP
+func (l Limit) Header() string {
+	header, _ := parseKey(l.Key)
+
+	return header
+}
+
+// Global reports whether every request is counted under the same key, e.g. a limit of the whole server
+func (l Limit) Global() bool {
+	return l.Key == KeyGlobal
+}
+
+// parseKey returns the header name of a "header:<name>" key, or an empty name for the client IP and the global key
+func parseKey(key string) (header string, ok bool) {
+	switch {
+	case key == "" || key == "ip" || key == KeyGlobal:
+		return "", true
+	case strings.HasPrefix(key, "header:") && len(key) > len("header:"):
+		return strings.TrimPrefix(key, "header:"), true
+	default:
+		return "", false
+	}
+}
+
+// formatOf returns the format matching the extension of a file
+func formatOf(path string) (string, bool) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return FormatYAML, true
+	case ".json":
+		return FormatJSON, true
+	case ".toml":
+		return FormatTOML, true
+	default:
+		return "", false
+	}
+}
+
+// paramString formats a decoded value the way the string config expects it, e.g. JSON numbers are floats
+func paramString(value any) string {
+	switch v := value.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32)
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,175 @@
+package policy_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/carantes/go-rate-limiter/lib/internal/algorithms" // registers the built-in algorithms
+	"github.com/carantes/go-rate-limiter/lib/internal/interfaces"
+	"github.com/carantes/go-rate-limiter/lib/internal/policy"
+	"github.com/stretchr/testify/suite"
+)
+
+type policySuite struct {
+	suite.Suite
+}
+
+func (s *policySuite) TestParseFormats() {
+	tests := []struct {
+		format string
+		data   string
+	}{
+		{policy.FormatYAML, `
+backends:
+  shared:
+    redisURL: redis://localhost:6379
+limits:
+  - name: global
+    algorithm: redis-sliding-window-counter
+    backend: shared
+    params: {capacity: 100, duration: 60, weight: 0.4}
+  - name: api
+    algorithm: token-bucket
+    routes: ["/limited"]
+    key: header:X-API-Key
+    params: {capacity: 10, refillRate: 1, cleanupInterval: 1m}
+`},
+		{policy.FormatJSON, `{
+  "backends": {"shared": {"redisURL": "redis://localhost:6379"}},
+  "limits": [
+    {"name": "global", "algorithm": "redis-sliding-window-counter", "backend": "shared", "params": {"capacity": 100, "duration": 60, "weight": 0.4}},
+    {"name": "api", "algorithm": "token-bucket", "routes": ["/limited"], "key": "header:X-API-Key", "params": {"capacity": 10, "refillRate": 1, "cleanupInterval": "1m"}}
+  ]
+}`},
+		{policy.FormatTOML, `
+[backends.shared]
+redisURL = "redis://localhost:6379"
+
+[[limits]]
+name = "global"
+algorithm = "redis-sliding-window-counter"
+backend = "shared"
+params = {capacity = 100, duration = 60, weight = 0.4}
+
+[[limits]]
+name = "api"
+algorithm = "token-bucket"
+routes = ["/limited"]
+key = "header:X-API-Key"
+params = {capacity = 10, refillRate = 1, cleanupInterval = "1m"}
+`},
+	}
+
+	for _, tt := range tests {
+		s.Run(tt.format, func() {
+			p, err := policy.Parse([]byte(tt.data), tt.format)
+			s.Require().NoError(err)
+			s.Len(p.Limits, 2)
+
+			global, err := p.Config(p.Limits[0])
+			s.NoError(err)
+			s.Equal(interfaces.RedisSlidingWindowCounter.String(), global["algorithm"])
+			s.Equal("redis://localhost:6379", global["redisURL"])
+			s.Equal("0.4", global["weight"])
+
+			api := p.Limits[1]
+			s.True(api.Applies("/limited"))
+			s.False(api.Applies("/unlimited"))
+			s.Equal("X-API-Key", api.Header())
+
+			config, err := p.Config(api)
+			s.NoError(err)
+			s.Equal("10", config["capacity"])
+			s.Equal("1m", config["cleanupInterval"])
+		})
+	}
+}
+
+func (s *policySuite) TestInvalidPolicy() {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"no limits", `limits: []`},
+		{"unknown field", `
+limits:
+  - name: api
+    algorithm: token-bucket
+    burst: 5
+`},
+		{"missing name", `
+limits:
+  - algorithm: token-bucket
+    params: {capacity: 10, refillRate: 1}
+`},
+		{"duplicate name", `
+limits:
+  - {name: api, algorithm: token-bucket, params: {capacity: 10, refillRate: 1}}
+  - {name: api, algorithm: token-bucket, params: {capacity: 10, refillRate: 1}}
+`},
+		{"invalid key", `
+limits:
+  - {name: api, algorithm: token-bucket, key: cookie, params: {capacity: 10, refillRate: 1}}
+`},
+		{"unknown parent", `
+limits:
+  - {name: user, algorithm: token-bucket, parent: tenant, params: {capacity: 10, refillRate: 1}}
+  - {name: tenant, algorithm: token-bucket, params: {capacity: 10, refillRate: 1}}
+`},
+		{"self parent", `
+limits:
+  - {name: user, algorithm: token-bucket, parent: user, params: {capacity: 10, refillRate: 1}}
+`},
+		{"unknown backend", `
+limits:
+  - {name: api, algorithm: redis-sliding-window-counter, backend: shared, params: {capacity: 10, duration: 5, weight: 1}}
+`},
+		{"invalid params", `
+limits:
+  - {name: api, algorithm: token-bucket, params: {capacity: 0, refillRate: 1}}
+`},
+	}
+
+	for _, tt := range tests {
+		s.Run(tt.name, func() {
+			_, err := policy.Parse([]byte(tt.data), policy.FormatYAML)
+			s.ErrorIs(err, interfaces.ErrInvalidConfig)
+		})
+	}
+}
+
+func (s *policySuite) TestNestedLimits() {
+	p, err := policy.Parse([]byte(`
+limits:
+  - {name: server, algorithm: fixed-window, key: global, params: {capacity: 50000, duration: 1m}}
+  - {name: tenant, algorithm: fixed-window, key: header:X-Tenant-ID, params: {capacity: 2000, duration: 1m}}
+  - {name: user, algorithm: fixed-window, key: header:X-User-ID, parent: tenant, params: {capacity: 100, duration: 1m}}
+`), policy.FormatYAML)
+	s.Require().NoError(err)
+
+	s.True(p.Limits[0].Global())
+	s.Equal("", p.Limits[0].Header())
+	s.False(p.Limits[1].Global())
+	s.Equal("tenant", p.Limits[2].Parent)
+	s.Equal("X-User-ID", p.Limits[2].Header())
+}
+
+func (s *policySuite) TestLoad() {
+	path := filepath.Join(s.T().TempDir(), "policy.yml")
+	s.NoError(os.WriteFile(path, []byte(`
+limits:
+  - {name: api, algorithm: fixed-window, params: {capacity: 10, duration: 5}}
+`), 0o600))
+
+	p, err := policy.Load(path)
+	s.NoError(err)
+	s.Equal("api", p.Limits[0].Name)
+
+	_, err = policy.Load(filepath.Join(s.T().TempDir(), "policy.ini"))
+	s.ErrorIs(err, interfaces.ErrInvalidConfig)
+}
+
+func TestPolicySuite(t *testing.T) {
+	suite.Run(t, new(policySuite))
+}
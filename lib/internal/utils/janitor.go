@@ -0,0 +1,36 @@
+package utils
+
+import (
+	"sync"
+	"time"
+)
+
+// StartJanitor calls fn every interval in a background goroutine until stop is called.
+// A zero or negative interval starts nothing, stop can be called many times
+func StartJanitor(interval time.Duration, fn func()) (stop func()) {
+	if interval <= 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	ticker := time.NewTicker(interval)
+
+	go func() {
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				fn()
+			}
+		}
+	}()
+
+	var once sync.Once
+
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
@@ -1,25 +1,59 @@
 package utils
 
-import "strconv"
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
 
 // ParseInt parse string to int
-func ParseInt(s string) int {
-	r, err := strconv.Atoi(s)
+func ParseInt(s string) (int, error) {
+	return strconv.Atoi(s)
+}
+
+// ParseFloat parse string to float64
+func ParseFloat(s string) (float64, error) {
+	return strconv.ParseFloat(s, 64)
+}
+
+// ParseDuration parse a Go duration string (e.g. "250ms", "1m30s"), a plain number is read as seconds
+func ParseDuration(s string) (time.Duration, error) {
+	seconds, err := strconv.ParseFloat(s, 64)
 
 	if err != nil {
-		return 0
+		return time.ParseDuration(s)
+	}
+
+	if math.IsNaN(seconds) || math.IsInf(seconds, 0) || math.Abs(seconds) > math.MaxInt64/float64(time.Second) {
+		return 0, errors.New("invalid duration " + strconv.Quote(s))
 	}
 
-	return r
+	return time.Duration(seconds * float64(time.Second)), nil
 }
 
-// ParseFloat parse string to float64
-func ParseFloat(s string) float64 {
-	r, err := strconv.ParseFloat(s, 64)
+// ParseRate parse a rate given as a number (e.g. "0.5") or as a number per duration (e.g. "5/100ms", "30/m").
+// The period is zero when the rate has none
+func ParseRate(s string) (float64, time.Duration, error) {
+	count, period, found := strings.Cut(s, "/")
 
-	if err != nil {
-		return 0
+	n, err := ParseFloat(count)
+
+	if err != nil || !found {
+		return n, 0, err
+	}
+
+	// a bare unit means one of it, e.g. "30/m"
+	if period != "" && (period[0] < '0' || period[0] > '9') && period[0] != '.' {
+		period = "1" + period
+	}
+
+	d, err := ParseDuration(period)
+
+	if err == nil && d <= 0 {
+		err = errors.New("invalid rate period " + strconv.Quote(period))
 	}
 
-	return r
+	return n, d, err
 }
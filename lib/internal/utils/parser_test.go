@@ -2,6 +2,7 @@ package utils_test
 
 import (
 	"testing"
+	"time"
 
 	"github.com/carantes/go-rate-limiter/lib/internal/utils"
 	"github.com/stretchr/testify/suite"
@@ -13,21 +14,85 @@ type parserSuite struct {
 
 func (s *parserSuite) TestParseInt() {
 	s.Run("Parse valid int", func() {
-		s.Equal(1234, utils.ParseInt("1234"))
+		n, err := utils.ParseInt("1234")
+		s.NoError(err)
+		s.Equal(1234, n)
 	})
 
 	s.Run("Parse invalid int", func() {
-		s.Equal(0, utils.ParseInt("abc"))
+		_, err := utils.ParseInt("abc")
+		s.Error(err)
 	})
 }
 
 func (s *parserSuite) TestParseFloat() {
 	s.Run("Parse valid float", func() {
-		s.Equal(1.234, utils.ParseFloat("1.234"))
+		f, err := utils.ParseFloat("1.234")
+		s.NoError(err)
+		s.Equal(1.234, f)
 	})
 
 	s.Run("Parse invalid float", func() {
-		s.Equal(0.0, utils.ParseFloat("abc"))
+		_, err := utils.ParseFloat("abc")
+		s.Error(err)
+	})
+}
+
+func (s *parserSuite) TestParseDuration() {
+	tests := []struct {
+		value    string
+		expected time.Duration
+	}{
+		{"250ms", 250 * time.Millisecond},
+		{"1m30s", 90 * time.Second},
+		{"5", 5 * time.Second},
+		{"2.5", 2500 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		s.Run(tt.value, func() {
+			d, err := utils.ParseDuration(tt.value)
+			s.NoError(err)
+			s.Equal(tt.expected, d)
+		})
+	}
+
+	s.Run("Parse invalid duration", func() {
+		for _, value := range []string{"abc", "NaN", "Inf", "1e300"} {
+			_, err := utils.ParseDuration(value)
+			s.Error(err, value)
+		}
+	})
+}
+
+func (s *parserSuite) TestParseRate() {
+	tests := []struct {
+		value  string
+		rate   float64
+		period time.Duration
+	}{
+		{"10", 10, 0},
+		{"0.5", 0.5, 0},
+		{"5/100ms", 5, 100 * time.Millisecond},
+		{"1/2.5s", 1, 2500 * time.Millisecond},
+		{"30/m", 30, time.Minute},
+		{"2/3", 2, 3 * time.Second},
+	}
+
+	for _, tt := range tests {
+		s.Run(tt.value, func() {
+			rate, period, err := utils.ParseRate(tt.value)
+			s.NoError(err)
+			s.Equal(tt.rate, rate)
+			s.Equal(tt.period, period)
+		})
+	}
+
+	s.Run("Parse invalid rate", func() {
+		for _, value := range []string{"abc", "5/", "5/abc", "5/0s", "/1s"} {
+			_, _, err := utils.ParseRate(value)
+			s.Error(err, value)
+		}
 	})
 }
 
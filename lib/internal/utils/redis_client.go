@@ -3,14 +3,30 @@ package utils
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
+// ErrKeyNotFound is returned by Get when the key does not exist
+var ErrKeyNotFound = errors.New("redis: key not found")
+
+// ErrTxConflict is returned by Update when the key kept changing during every attempt
+var ErrTxConflict = errors.New("redis: too many concurrent updates")
+
+// maximum number of optimistic transaction attempts in Update
+const maxTxRetries = 10
+
 type RedisClient struct {
 	client *redis.Client
-	ctx    context.Context
+}
+
+// ValidateRedisURL checks that the URL can be used to connect to Redis
+func ValidateRedisURL(redisURL string) error {
+	_, err := redis.ParseURL(redisURL)
+
+	return err
 }
 
 func NewRedisClient(redisURL string) *RedisClient {
@@ -22,22 +38,27 @@ func NewRedisClient(redisURL string) *RedisClient {
 
 	client := redis.NewClient(opt)
 
-	ctx := context.Background()
-
 	return &RedisClient{
 		client: client,
-		ctx:    ctx,
 	}
 }
 
-func (r *RedisClient) Set(key string, obj interface{}, ttl time.Duration) error {
-	value, _ := json.Marshal(obj)
+func (r *RedisClient) Set(ctx context.Context, key string, obj interface{}, ttl time.Duration) error {
+	value, err := json.Marshal(obj)
+
+	if err != nil {
+		return err
+	}
 
-	return r.client.Set(r.ctx, key, string(value), ttl).Err()
+	return r.client.Set(ctx, key, string(value), ttl).Err()
 }
 
-func (r *RedisClient) Get(key string, obj interface{}) error {
-	data, err := r.client.Get(r.ctx, key).Result()
+func (r *RedisClient) Get(ctx context.Context, key string, obj interface{}) error {
+	data, err := r.client.Get(ctx, key).Result()
+
+	if errors.Is(err, redis.Nil) {
+		return ErrKeyNotFound
+	}
 
 	if err != nil {
 		return err
@@ -49,3 +70,86 @@ func (r *RedisClient) Get(key string, obj interface{}) error {
 
 	return nil
 }
+
+func (r *RedisClient) Del(ctx context.Context, key string) error {
+	return r.client.Del(ctx, key).Err()
+}
+
+// Close closes the connections to Redis
+func (r *RedisClient) Close() error {
+	return r.client.Close()
+}
+
+// Update reads the JSON value stored at key, lets fn change it and writes it back in a single
+// optimistic transaction (WATCH/MULTI/EXEC), retrying when another client modifies the key in between.
+// The value is written even when fn returns an error, fn error is returned after the write.
+func Update[T any](ctx context.Context, r *RedisClient, key string, ttl time.Duration, fn func(obj *T, found bool) error) error {
+	return UpdateTTL(ctx, r, key, func(*T) time.Duration { return ttl }, fn)
+}
+
+// UpdateTTL is Update with the TTL of the key computed from the value fn wrote
+func UpdateTTL[T any](ctx context.Context, r *RedisClient, key string, ttl func(obj *T) time.Duration, fn func(obj *T, found bool) error) error {
+	var fnErr error
+
+	txf := func(tx *redis.Tx) error {
+		var obj T
+
+		data, err := tx.Get(ctx, key).Result()
+		found := err == nil
+
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return err
+		}
+
+		if found {
+			if err := json.Unmarshal([]byte(data), &obj); err != nil {
+				return err
+			}
+		}
+
+		fnErr = fn(&obj, found)
+
+		value, err := json.Marshal(obj)
+
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, string(value), ttl(&obj))
+			return nil
+		})
+
+		return err
+	}
+
+	for i := 0; i < maxTxRetries; i++ {
+		err := r.client.Watch(ctx, txf, key)
+
+		if errors.Is(err, redis.TxFailedErr) {
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		return fnErr
+	}
+
+	return ErrTxConflict
+}
+
+// Script is a Lua script run atomically by Redis
+type Script struct {
+	script *redis.Script
+}
+
+func NewScript(src string) *Script {
+	return &Script{script: redis.NewScript(src)}
+}
+
+// Run runs the script by its hash, the script is loaded when Redis does not know it yet
+func (r *RedisClient) Run(ctx context.Context, s *Script, keys []string, args ...interface{}) ([]int64, error) {
+	return s.script.Run(ctx, r.client, keys, args...).Int64Slice()
+}
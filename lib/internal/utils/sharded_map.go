@@ -0,0 +1,244 @@
+package utils
+
+import (
+	"container/list"
+	"hash/fnv"
+	"sync"
+)
+
+// DefaultShards is the number of shards used by the in-memory rate limiters
+const DefaultShards = 64
+
+// ShardedMap is a map safe for concurrent use. Keys are spread over several shards,
+// each one guarded by its own lock, so that requests for different keys rarely wait for each other.
+// The map can be bounded, the least recently used key of the whole map is then evicted when a new key is added
+type ShardedMap[V any] struct {
+	shards []*MapShard[V]
+	lru    *lruList[V] // nil when unbounded
+}
+
+// MapShard holds the keys of one shard, it must only be used between Lock and unlock
+type MapShard[V any] struct {
+	mu      sync.Mutex
+	items   map[string]*mapEntry[V]
+	lru     *lruList[V]
+	evicted evictedKeys[V] // keys evicted from this shard while another one was locked
+}
+
+type mapEntry[V any] struct {
+	key     string
+	value   V
+	shard   *MapShard[V]
+	elem    *list.Element // position in the recently used keys of the map
+	evicted bool          // guarded by the lock of the lru list
+}
+
+// lruList orders the keys of every shard, its lock is only taken while a shard is locked
+type lruList[V any] struct {
+	mu      sync.Mutex
+	order   *list.List // most recently used keys first
+	maxKeys int
+}
+
+// evictedKeys are removed from their shard the next time it is locked, the evicting shard cannot lock it
+type evictedKeys[V any] struct {
+	mu      sync.Mutex // only held to add or take the keys, never while taking another lock
+	entries []*mapEntry[V]
+}
+
+// create a new sharded map, maxKeys bounds the total number of keys and zero means unbounded
+func NewShardedMap[V any](shards int, maxKeys int) *ShardedMap[V] {
+	m := &ShardedMap[V]{shards: make([]*MapShard[V], max(shards, 1))}
+
+	if maxKeys > 0 {
+		m.lru = &lruList[V]{order: list.New(), maxKeys: maxKeys}
+	}
+
+	for i := range m.shards {
+		m.shards[i] = &MapShard[V]{
+			items: make(map[string]*mapEntry[V]),
+			lru:   m.lru,
+		}
+	}
+
+	return m
+}
+
+// Lock locks the shard that holds the key and returns it, it can be read and written until unlock is called
+func (m *ShardedMap[V]) Lock(key string) (shard *MapShard[V], unlock func()) {
+	shard = m.shard(key)
+	shard.lock()
+
+	return shard, shard.mu.Unlock
+}
+
+// Len returns the number of keys in the map
+func (m *ShardedMap[V]) Len() int {
+	if m.lru != nil {
+		m.lru.mu.Lock()
+		defer m.lru.mu.Unlock()
+
+		return m.lru.order.Len()
+	}
+
+	size := 0
+
+	for _, shard := range m.shards {
+		shard.mu.Lock()
+		size += len(shard.items)
+		shard.mu.Unlock()
+	}
+
+	return size
+}
+
+// DeleteFunc removes every key for which fn returns true and returns how many were removed.
+// Shards are locked one at a time
+func (m *ShardedMap[V]) DeleteFunc(fn func(key string, value V) bool) int {
+	removed := 0
+
+	for _, shard := range m.shards {
+		shard.lock()
+
+		for key, e := range shard.items {
+			if fn(key, e.value) {
+				shard.Delete(key)
+				removed++
+			}
+		}
+
+		shard.mu.Unlock()
+	}
+
+	return removed
+}
+
+// Range calls fn for every key, shards are locked one at a time
+func (m *ShardedMap[V]) Range(fn func(key string, value V)) {
+	for _, shard := range m.shards {
+		shard.lock()
+
+		for key, e := range shard.items {
+			fn(key, e.value)
+		}
+
+		shard.mu.Unlock()
+	}
+}
+
+// shard returns the shard of the key
+func (m *ShardedMap[V]) shard(key string) *MapShard[V] {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+
+	return m.shards[h.Sum32()%uint32(len(m.shards))]
+}
+
+// lock locks the shard and removes the keys evicted from it meanwhile
+func (s *MapShard[V]) lock() {
+	s.mu.Lock()
+
+	s.evicted.mu.Lock()
+	entries := s.evicted.entries
+	s.evicted.entries = nil
+	s.evicted.mu.Unlock()
+
+	for _, e := range entries {
+		if s.items[e.key] == e {
+			delete(s.items, e.key)
+		}
+	}
+}
+
+// Get returns the value of the key, or the zero value when it is missing, and marks it as recently used
+func (s *MapShard[V]) Get(key string) V {
+	e, ok := s.items[key]
+
+	if !ok || !s.touch(e) {
+		var zero V
+		return zero
+	}
+
+	return e.value
+}
+
+// Set stores the value of the key, the least recently used key of the map is evicted when it is full
+func (s *MapShard[V]) Set(key string, value V) {
+	if e, ok := s.items[key]; ok && s.touch(e) {
+		e.value = value
+		return
+	}
+
+	e := &mapEntry[V]{key: key, value: value, shard: s}
+	s.items[key] = e
+
+	if s.lru == nil {
+		return
+	}
+
+	s.lru.mu.Lock()
+	defer s.lru.mu.Unlock()
+
+	if s.lru.order.Len() >= s.lru.maxKeys {
+		s.evict(s.lru.order.Back().Value.(*mapEntry[V]))
+	}
+
+	e.elem = s.lru.order.PushFront(e)
+}
+
+// Delete removes the key
+func (s *MapShard[V]) Delete(key string) {
+	e, ok := s.items[key]
+
+	if !ok {
+		return
+	}
+
+	delete(s.items, key)
+
+	if s.lru == nil {
+		return
+	}
+
+	s.lru.mu.Lock()
+	defer s.lru.mu.Unlock()
+
+	if !e.evicted {
+		s.lru.order.Remove(e.elem)
+	}
+}
+
+// touch marks the key as recently used, it returns false when the key was evicted by another shard
+func (s *MapShard[V]) touch(e *mapEntry[V]) bool {
+	if s.lru == nil {
+		return true
+	}
+
+	s.lru.mu.Lock()
+	defer s.lru.mu.Unlock()
+
+	if e.evicted {
+		delete(s.items, e.key)
+		return false
+	}
+
+	s.lru.order.MoveToFront(e.elem)
+
+	return true
+}
+
+// evict removes the least recently used key, a key of another shard is removed from it once it is locked.
+// The lock of the lru list must be held
+func (s *MapShard[V]) evict(e *mapEntry[V]) {
+	s.lru.order.Remove(e.elem)
+	e.evicted = true
+
+	if e.shard == s {
+		delete(s.items, e.key)
+		return
+	}
+
+	e.shard.evicted.mu.Lock()
+	e.shard.evicted.entries = append(e.shard.evicted.entries, e)
+	e.shard.evicted.mu.Unlock()
+}
@@ -0,0 +1,205 @@
+package utils_test
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/carantes/go-rate-limiter/lib/internal/utils"
+	"github.com/stretchr/testify/suite"
+)
+
+type shardedMapSuite struct {
+	suite.Suite
+	*utils.ShardedMap[int]
+}
+
+func (s *shardedMapSuite) SetupTest() {
+	s.ShardedMap = utils.NewShardedMap[int](utils.DefaultShards, 0)
+}
+
+func (s *shardedMapSuite) TestLock() {
+	items, unlock := s.ShardedMap.Lock("key")
+	items.Set("key", 1)
+	unlock()
+
+	items, unlock = s.ShardedMap.Lock("key")
+	s.Equal(1, items.Get("key"))
+	unlock()
+
+	s.Equal(1, s.ShardedMap.Len())
+}
+
+func (s *shardedMapSuite) TestConcurrentWrites() {
+	var wg sync.WaitGroup
+
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			for j := 0; j < 100; j++ {
+				key := strconv.Itoa(j)
+
+				items, unlock := s.ShardedMap.Lock(key)
+				items.Set(key, items.Get(key)+1)
+				unlock()
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	s.Equal(100, s.ShardedMap.Len())
+
+	items, unlock := s.ShardedMap.Lock("42")
+	s.Equal(100, items.Get("42"))
+	unlock()
+}
+
+func (s *shardedMapSuite) TestMaxKeys() {
+	m := utils.NewShardedMap[int](1, 2)
+
+	items, unlock := m.Lock("a")
+	items.Set("a", 1)
+	items.Set("b", 2)
+
+	// a is now the most recently used key, b is evicted
+	s.Equal(1, items.Get("a"))
+	items.Set("c", 3)
+
+	s.Equal(0, items.Get("b"))
+	s.Equal(1, items.Get("a"))
+	s.Equal(3, items.Get("c"))
+	unlock()
+
+	s.Equal(2, m.Len())
+}
+
+func (s *shardedMapSuite) TestMaxKeysAcrossShards() {
+	m := utils.NewShardedMap[int](utils.DefaultShards, 10)
+
+	for i := 0; i < 100; i++ {
+		key := strconv.Itoa(i)
+
+		items, unlock := m.Lock(key)
+		items.Set(key, i)
+		unlock()
+	}
+
+	s.Equal(10, m.Len())
+}
+
+func (s *shardedMapSuite) TestMaxKeysBeforeEviction() {
+	m := utils.NewShardedMap[int](utils.DefaultShards, utils.DefaultShards)
+
+	set := func(key string, value int) {
+		items, unlock := m.Lock(key)
+		items.Set(key, value)
+		unlock()
+	}
+
+	get := func(key string) int {
+		items, unlock := m.Lock(key)
+		defer unlock()
+
+		return items.Get(key)
+	}
+
+	// keys that share a shard are all kept until the cap of the whole map is reached
+	for i := 1; i <= utils.DefaultShards; i++ {
+		set(strconv.Itoa(i), i)
+	}
+
+	s.Equal(utils.DefaultShards, m.Len())
+
+	for i := 1; i <= utils.DefaultShards; i++ {
+		s.Equal(i, get(strconv.Itoa(i)))
+	}
+
+	// the least recently used key of the whole map is evicted, whatever its shard
+	s.Equal(1, get("1"))
+	set("new", 100)
+
+	s.Equal(utils.DefaultShards, m.Len())
+	s.Equal(0, get("2"))
+	s.Equal(1, get("1"))
+	s.Equal(100, get("new"))
+
+	// the evicted key is not visited anymore
+	seen := 0
+
+	m.Range(func(string, int) { seen++ })
+	s.Equal(utils.DefaultShards, seen)
+}
+
+func (s *shardedMapSuite) TestConcurrentEviction() {
+	m := utils.NewShardedMap[int](utils.DefaultShards, 10)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			for j := 0; j < 100; j++ {
+				key := strconv.Itoa(i*100 + j)
+
+				items, unlock := m.Lock(key)
+				items.Set(key, items.Get(key)+1)
+				unlock()
+
+				if j%10 == 0 {
+					m.DeleteFunc(func(_ string, value int) bool { return value > 1 })
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	s.Equal(10, m.Len())
+}
+
+func (s *shardedMapSuite) TestDeleteFunc() {
+	for i := 0; i < 10; i++ {
+		key := strconv.Itoa(i)
+
+		items, unlock := s.ShardedMap.Lock(key)
+		items.Set(key, i)
+		unlock()
+	}
+
+	removed := s.ShardedMap.DeleteFunc(func(_ string, value int) bool {
+		return value%2 == 0
+	})
+
+	s.Equal(5, removed)
+	s.Equal(5, s.ShardedMap.Len())
+}
+
+func (s *shardedMapSuite) TestRange() {
+	for i := 0; i < 10; i++ {
+		key := strconv.Itoa(i)
+
+		items, unlock := s.ShardedMap.Lock(key)
+		items.Set(key, i)
+		unlock()
+	}
+
+	seen := make(map[string]int)
+
+	s.ShardedMap.Range(func(key string, value int) {
+		seen[key] = value
+	})
+
+	s.Equal(10, len(seen))
+	s.Equal(7, seen["7"])
+}
+
+func TestShardedMapSuite(t *testing.T) {
+	suite.Run(t, new(shardedMapSuite))
+}
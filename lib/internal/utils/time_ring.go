@@ -0,0 +1,138 @@
+package utils
+
+import "time"
+
+// TimeRing is a ring buffer of timestamps, ordered from the oldest to the most recent.
+// Timestamps are kept as unix nanoseconds, 8 bytes each, and the buffer only grows when it is full
+type TimeRing struct {
+	ring  []int64
+	start int // position of the oldest element
+	size  int
+}
+
+// create a new ring holding capacity elements before growing
+func NewTimeRing(capacity int) *TimeRing {
+	return &TimeRing{ring: make([]int64, max(capacity, 1))}
+}
+
+// push adds a new element after the most recent one, the buffer doubles when the ring is full
+func (r *TimeRing) Push(t time.Time) {
+	if r.size == len(r.ring) {
+		r.grow()
+	}
+
+	r.ring[r.index(r.size)] = t.UnixNano()
+	r.size++
+}
+
+// insert adds a new element after the ones not more recent than it, keeping the ring ordered.
+// Elements are shifted from the most recent one, inserting at the end costs the same as a push
+func (r *TimeRing) Insert(t time.Time) {
+	if r.size == len(r.ring) {
+		r.grow()
+	}
+
+	ns := t.UnixNano()
+	i := r.size
+
+	for ; i > 0 && r.ring[r.index(i-1)] > ns; i-- {
+		r.ring[r.index(i)] = r.ring[r.index(i-1)]
+	}
+
+	r.ring[r.index(i)] = ns
+	r.size++
+}
+
+// pop removes the oldest element of the ring
+func (r *TimeRing) Pop() time.Time {
+	if r.size == 0 {
+		return time.Time{}
+	}
+
+	t := r.At(0)
+	r.start = r.index(1)
+	r.size--
+	return t
+}
+
+// peek returns the oldest element of the ring
+func (r *TimeRing) Peek() time.Time {
+	return r.At(0)
+}
+
+// at returns the element at position i, starting from the oldest
+func (r *TimeRing) At(i int) time.Time {
+	if i < 0 || i >= r.size {
+		return time.Time{}
+	}
+
+	return time.Unix(0, r.ring[r.index(i)])
+}
+
+// remove deletes up to n elements equal to t, starting from the most recent, and returns how many were removed
+func (r *TimeRing) Remove(t time.Time, n int) int {
+	ns := t.UnixNano()
+	kept := r.size
+
+	// walk from the most recent element, shifting the kept ones over the removed ones
+	for i := r.size - 1; i >= 0; i-- {
+		if r.size-kept < n && r.ring[r.index(i)] == ns {
+			kept--
+			continue
+		}
+
+		r.ring[r.index(i+r.size-kept)] = r.ring[r.index(i)]
+	}
+
+	removed := r.size - kept
+	r.start = r.index(removed)
+	r.size = kept
+	return removed
+}
+
+// truncate keeps the first size elements of the ring and drops the most recent ones
+func (r *TimeRing) Truncate(size int) {
+	if size < 0 || size >= r.size {
+		return
+	}
+
+	r.size = size
+}
+
+func (r *TimeRing) Size() int {
+	return r.size
+}
+
+// cap returns the number of elements the ring holds before growing
+func (r *TimeRing) Cap() int {
+	return len(r.ring)
+}
+
+// shrink moves the elements to a buffer of the given capacity when the ring grew past it and they fit again
+func (r *TimeRing) Shrink(capacity int) {
+	if capacity = max(capacity, 1); capacity < len(r.ring) && r.size <= capacity {
+		r.resize(capacity)
+	}
+}
+
+// grow doubles the buffer
+func (r *TimeRing) grow() {
+	r.resize(len(r.ring) * 2)
+}
+
+// resize moves the elements to a new buffer, the oldest element moves to its start
+func (r *TimeRing) resize(capacity int) {
+	ring := make([]int64, capacity)
+
+	for i := 0; i < r.size; i++ {
+		ring[i] = r.ring[r.index(i)]
+	}
+
+	r.ring = ring
+	r.start = 0
+}
+
+// index returns the position in the buffer of the element at position i
+func (r *TimeRing) index(i int) int {
+	return (r.start + i) % len(r.ring)
+}
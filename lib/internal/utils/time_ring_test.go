@@ -0,0 +1,157 @@
+package utils_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/carantes/go-rate-limiter/lib/internal/utils"
+	"github.com/stretchr/testify/suite"
+)
+
+type timeRingSuite struct {
+	suite.Suite
+	*utils.TimeRing
+	now time.Time
+}
+
+func (s *timeRingSuite) SetupTest() {
+	s.TimeRing = utils.NewTimeRing(3)
+	s.now = time.Unix(1700000000, 0)
+}
+
+// at returns the time i seconds after now
+func (s *timeRingSuite) at(i int) time.Time {
+	return s.now.Add(time.Duration(i) * time.Second)
+}
+
+func (s *timeRingSuite) TestPush() {
+	s.Equal(0, s.TimeRing.Size())
+	s.TimeRing.Push(s.now)
+	s.Equal(1, s.TimeRing.Size())
+	s.True(s.now.Equal(s.TimeRing.Peek()))
+}
+
+func (s *timeRingSuite) TestPushFull() {
+	// start past the beginning of the buffer
+	s.TimeRing.Push(s.now)
+	s.TimeRing.Pop()
+
+	for i := 0; i < 5; i++ {
+		s.TimeRing.Push(s.at(i))
+	}
+
+	// the buffer doubles and keeps the order
+	s.Equal(5, s.TimeRing.Size())
+	s.Equal(6, s.TimeRing.Cap())
+
+	for i := 0; i < 5; i++ {
+		s.True(s.at(i).Equal(s.TimeRing.At(i)))
+	}
+}
+
+func (s *timeRingSuite) TestInsert() {
+	// start past the beginning of the buffer, the ring wraps and grows
+	s.TimeRing.Push(s.now)
+	s.TimeRing.Pop()
+
+	for _, i := range []int{3, 1, 4, 1, 5} {
+		s.TimeRing.Insert(s.at(i))
+	}
+
+	s.Equal(5, s.TimeRing.Size())
+
+	for i, expected := range []int{1, 1, 3, 4, 5} {
+		s.True(s.at(expected).Equal(s.TimeRing.At(i)))
+	}
+}
+
+func (s *timeRingSuite) TestShrink() {
+	for i := 0; i < 5; i++ {
+		s.TimeRing.Push(s.at(i))
+	}
+
+	// the elements do not fit yet
+	s.TimeRing.Shrink(3)
+	s.Equal(6, s.TimeRing.Cap())
+
+	s.TimeRing.Pop()
+	s.TimeRing.Pop()
+	s.TimeRing.Shrink(3)
+	s.Equal(3, s.TimeRing.Cap())
+	s.Equal(3, s.TimeRing.Size())
+	s.True(s.at(2).Equal(s.TimeRing.Peek()))
+	s.True(s.at(4).Equal(s.TimeRing.At(2)))
+}
+
+func (s *timeRingSuite) TestPop() {
+	s.Run("Pop non-empty ring", func() {
+		s.Equal(0, s.TimeRing.Size())
+		s.TimeRing.Push(s.now)
+		s.Equal(1, s.TimeRing.Size())
+		s.True(s.now.Equal(s.TimeRing.Pop()))
+		s.Equal(0, s.TimeRing.Size())
+	})
+
+	s.Run("Pop empty ring", func() {
+		s.Equal(0, s.TimeRing.Size())
+		s.Equal(time.Time{}, s.TimeRing.Pop())
+		s.Equal(0, s.TimeRing.Size())
+	})
+}
+
+func (s *timeRingSuite) TestWrap() {
+	// push and pop around the end of the buffer
+	for i := 0; i < 10; i++ {
+		s.TimeRing.Push(s.at(i))
+
+		if i >= 1 {
+			s.True(s.at(i - 1).Equal(s.TimeRing.Pop()))
+		}
+	}
+
+	s.Equal(1, s.TimeRing.Size())
+	s.True(s.at(9).Equal(s.TimeRing.Peek()))
+}
+
+func (s *timeRingSuite) TestAt() {
+	s.TimeRing.Push(s.at(0))
+	s.TimeRing.Push(s.at(1))
+	s.True(s.at(0).Equal(s.TimeRing.At(0)))
+	s.True(s.at(1).Equal(s.TimeRing.At(1)))
+	s.Equal(time.Time{}, s.TimeRing.At(2))
+	s.Equal(time.Time{}, s.TimeRing.At(-1))
+}
+
+func (s *timeRingSuite) TestRemove() {
+	s.TimeRing.Push(s.at(0))
+	s.TimeRing.Push(s.at(1))
+	s.TimeRing.Pop()
+
+	// the elements wrap around the end of the buffer
+	s.TimeRing.Push(s.at(2))
+	s.TimeRing.Push(s.at(2))
+	s.Equal(1, s.TimeRing.Remove(s.at(2), 1))
+	s.Equal(2, s.TimeRing.Size())
+	s.True(s.at(1).Equal(s.TimeRing.At(0)))
+	s.True(s.at(2).Equal(s.TimeRing.At(1)))
+
+	s.Equal(1, s.TimeRing.Remove(s.at(1), 2))
+	s.Equal(1, s.TimeRing.Size())
+	s.True(s.at(2).Equal(s.TimeRing.Peek()))
+	s.Equal(0, s.TimeRing.Remove(s.at(5), 1))
+}
+
+func (s *timeRingSuite) TestTruncate() {
+	s.TimeRing.Push(s.at(0))
+	s.TimeRing.Push(s.at(1))
+	s.TimeRing.Push(s.at(2))
+	s.TimeRing.Truncate(5)
+	s.Equal(3, s.TimeRing.Size())
+	s.TimeRing.Truncate(1)
+	s.Equal(1, s.TimeRing.Size())
+	s.True(s.at(0).Equal(s.TimeRing.Peek()))
+}
+
+func TestTimeRingSuite(t *testing.T) {
+	suite.Run(t, new(timeRingSuite))
+}
@@ -0,0 +1,52 @@
+package lib
+
+import (
+	"github.com/carantes/go-rate-limiter/lib/internal/policy"
+)
+
+// Policy defines named limits and the backends they use, it is usually loaded from a file with LoadPolicy
+type Policy = policy.Policy
+
+// PolicyBackend is a named storage shared by the limits of a policy
+type PolicyBackend = policy.Backend
+
+// PolicyLimit is a named rate limit of a policy
+type PolicyLimit = policy.Limit
+
+// LoadPolicy reads and validates a policy file, the format is chosen by its extension (.yaml, .yml, .json or .toml)
+func LoadPolicy(path string) (*Policy, error) {
+	return policy.Load(path)
+}
+
+// ParsePolicy decodes and validates a policy, format is one of "yaml", "json" or "toml"
+func ParsePolicy(data []byte, format string) (*Policy, error) {
+	return policy.Parse(data, format)
+}
+
+// NewPolicyLimiters creates the rate limiter of every limit of the policy, keyed by limit name.
+// Nil clock means the system clock. On error the limiters already created are closed
+func NewPolicyLimiters(p *Policy, clock Clock) (map[string]RateLimiter, error) {
+	limiters := make(map[string]RateLimiter, len(p.Limits))
+
+	for _, l := range p.Limits {
+		config, err := p.Config(l)
+
+		var rl RateLimiter
+
+		if err == nil {
+			rl, err = NewRateLimiterWithClock(config, clock)
+		}
+
+		if err != nil {
+			for _, rl := range limiters {
+				rl.Close()
+			}
+
+			return nil, err
+		}
+
+		limiters[l.Name] = rl
+	}
+
+	return limiters, nil
+}
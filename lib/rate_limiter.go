@@ -1,31 +1,50 @@
 package lib
 
 import (
+	"context"
+
 	"github.com/carantes/go-rate-limiter/lib/internal/algorithms"
 	"github.com/carantes/go-rate-limiter/lib/internal/interfaces"
 )
 
-// Rate limiter factory
-func NewRateLimiter(config map[string]string) (interfaces.RateLimiter, error) {
+// Rate limiter factory, the algorithm is looked up in the registry and the config is checked against its fields
+func NewRateLimiter(config map[string]string) (RateLimiter, error) {
+	return NewRateLimiterWithClock(config, nil)
+}
 
-	var alg, ok = interfaces.ParseAlgorithm(config["algorithm"])
+// NewRateLimiterWithClock creates a rate limiter that reads the time from the given clock, nil means the system clock
+func NewRateLimiterWithClock(config map[string]string, clock Clock) (RateLimiter, error) {
+	spec, ok := interfaces.LookupAlgorithm(config["algorithm"])
 
 	if !ok {
-		return nil, &interfaces.RateLimitError{Message: "Missing rate limit algorithm"}
+		return nil, interfaces.NewFieldError("algorithm", "Missing rate limit algorithm")
 	}
 
-	switch alg {
-	case interfaces.TokenBucket:
-		return algorithms.NewTokenBucketLimiterFromConfig(config)
-	case interfaces.FixedWindow:
-		return algorithms.NewFixedWindowLimiterFromConfig(config)
-	case interfaces.SlidingWindowLog:
-		return algorithms.NewSlidingWindowLogLimiterFromConfig(config)
-	case interfaces.SlidingWindowCounter:
-		return algorithms.NewSlidingWindowCounterLimiterFromConfig(config)
-	case interfaces.RedisSlidingWindowCounter:
-		return algorithms.NewRedisSlidingWindowCounterLimiterFromConfig(config)
-	default:
-		return nil, &interfaces.RateLimitError{Message: "Invalid rate limit algorithm"}
+	if err := spec.CheckConfig(config); err != nil {
+		return nil, err
 	}
+
+	return spec.Factory(config, clock)
+}
+
+// NewRateLimiterFromConfig validates the typed config and creates the rate limiter of its algorithm
+func NewRateLimiterFromConfig(config Config) (RateLimiter, error) {
+	return algorithms.New(config)
+}
+
+// ParseConfig reads the string config of a built-in algorithm into a typed Config.
+// Values that are not numbers and unknown keys are rejected, the config still has to be validated
+func ParseConfig(config map[string]string) (Config, error) {
+	return algorithms.ParseConfig(config)
+}
+
+// ValidateConfig checks a string config against its algorithm without creating the rate limiter
+func ValidateConfig(config map[string]string) error {
+	return interfaces.ValidateConfig(config)
+}
+
+// Allow checks a request for the given user with a background context.
+// It keeps the former Allow(user) call available, prefer RateLimiter.Allow with a request context.
+func Allow(rl RateLimiter, user string) (Stats, error) {
+	return rl.Allow(context.Background(), user)
 }
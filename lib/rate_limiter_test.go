@@ -1,12 +1,22 @@
 package lib_test
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"maps"
+	"math/rand"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/alicebob/miniredis/v2"
 	"github.com/carantes/go-rate-limiter/lib"
-	"github.com/carantes/go-rate-limiter/lib/internal/interfaces"
-	"github.com/carantes/go-rate-limiter/lib/internal/mocks"
 	"github.com/carantes/go-rate-limiter/lib/internal/utils"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
@@ -14,22 +24,44 @@ import (
 
 type testFactorySuite struct {
 	suite.Suite
+	clock    *lib.FakeClock
+	redis    *miniredis.Miniredis
 	rlConfig []struct {
 		alg    string
 		config map[string]string
 	}
+	redisConfig []struct { // Redis limiters, without the in-memory settings, each one in its own database
+		alg    string
+		config map[string]string
+	}
 }
 
 func (s *testFactorySuite) SetupTest() {
+	s.redis = miniredis.RunT(s.T())
+	s.clock = lib.NewFakeClock(time.Now())
+
 	s.rlConfig = []struct {
 		alg    string
 		config map[string]string
 	}{
-		{interfaces.TokenBucket.String(), map[string]string{"algorithm": interfaces.TokenBucket.String(), "capacity": "10", "refillRate": "1"}},
-		{interfaces.FixedWindow.String(), map[string]string{"algorithm": interfaces.FixedWindow.String(), "capacity": "10", "duration": "5"}},
-		{interfaces.SlidingWindowLog.String(), map[string]string{"algorithm": interfaces.SlidingWindowLog.String(), "capacity": "10", "duration": "5"}},
-		{interfaces.SlidingWindowCounter.String(), map[string]string{"algorithm": interfaces.SlidingWindowCounter.String(), "capacity": "10", "duration": "5", "weight": "1.0"}},
-		// {interfaces.SlidingWindowCounter.String(), map[string]string{"algorithm": interfaces.RedisSlidingWindowCounter.String(), "capacity": "10", "duration": "5", "weight": "1.0"}},
+		{lib.TokenBucket.String(), map[string]string{"algorithm": lib.TokenBucket.String(), "capacity": "10", "refillRate": "1"}},
+		{lib.FixedWindow.String(), map[string]string{"algorithm": lib.FixedWindow.String(), "capacity": "10", "duration": "5s"}},
+		{lib.SlidingWindowLog.String(), map[string]string{"algorithm": lib.SlidingWindowLog.String(), "capacity": "10", "duration": "5s"}},
+		{lib.SlidingWindowCounter.String(), map[string]string{"algorithm": lib.SlidingWindowCounter.String(), "capacity": "10", "duration": "5s", "weight": "1.0"}},
+		{lib.SlidingWindowCounter.String(), map[string]string{"algorithm": lib.SlidingWindowCounter.String(), "capacity": "10", "duration": "5s", "weight": "0.4", "mode": "interpolated"}},
+		{lib.LeakyBucket.String(), map[string]string{"algorithm": lib.LeakyBucket.String(), "capacity": "10", "leakRate": "1"}},
+		{lib.GCRA.String(), map[string]string{"algorithm": lib.GCRA.String(), "capacity": "10", "refillRate": "1"}},
+		{lib.BucketedSlidingWindow.String(), map[string]string{"algorithm": lib.BucketedSlidingWindow.String(), "capacity": "10", "duration": "5s", "buckets": "5"}},
+		// {lib.SlidingWindowCounter.String(), map[string]string{"algorithm": lib.RedisSlidingWindowCounter.String(), "capacity": "10", "duration": "5", "weight": "1.0"}},
+	}
+
+	s.redisConfig = []struct {
+		alg    string
+		config map[string]string
+	}{
+		{lib.RedisGCRA.String(), map[string]string{"algorithm": lib.RedisGCRA.String(), "capacity": "10", "refillRate": "1", "redisURL": "redis://" + s.redis.Addr()}},
+		{lib.RedisSlidingWindowCounter.String(), map[string]string{"algorithm": lib.RedisSlidingWindowCounter.String(), "capacity": "10", "duration": "5s", "weight": "0.4", "mode": "interpolated", "redisURL": "redis://" + s.redis.Addr() + "/1"}},
+		{lib.RedisBucketedSlidingWindow.String(), map[string]string{"algorithm": lib.RedisBucketedSlidingWindow.String(), "capacity": "10", "duration": "5s", "buckets": "5", "redisURL": "redis://" + s.redis.Addr() + "/2"}},
 	}
 }
 
@@ -39,35 +71,73 @@ func (s *testFactorySuite) TestInvalidAlgorithm() {
 	})
 
 	assert.Error(s.T(), err)
+	assert.ErrorIs(s.T(), err, lib.ErrInvalidConfig)
 }
 
 func (s *testFactorySuite) TestMissingAlgorithm() {
 	_, err := lib.NewRateLimiter(map[string]string{})
 
 	assert.Error(s.T(), err)
+	assert.ErrorIs(s.T(), err, lib.ErrInvalidConfig)
+	assert.NotEmpty(s.T(), err.Error())
 }
 
-func (s *testFactorySuite) TestCapacity() {
+func (s *testFactorySuite) TestRateLimitedError() {
+	for _, tt := range s.rlConfig {
+		s.Run(tt.alg, func() {
+			rl, err := lib.NewRateLimiterWithClock(tt.config, s.clock)
+			s.NoError(err)
+
+			ctx := context.Background()
+			capacity, _ := utils.ParseInt(tt.config["capacity"])
+
+			_, err = rl.AllowN(ctx, "user", capacity)
+			s.NoError(err)
+
+			_, err = rl.Allow(ctx, "user")
+			s.ErrorIs(err, lib.ErrRateLimited)
+			s.Equal("Rate limit exceeded", err.Error())
+
+			var rlErr *lib.RateLimitError
+			s.ErrorAs(err, &rlErr)
+			s.Greater(rlErr.RetryAfter, time.Duration(0))
+			s.Equal(capacity, rlErr.Limit)
+			s.Equal(tt.alg, rlErr.Stats.Algorithm)
+			s.Equal(0, rlErr.Stats.Remaining)
 
-	// Set current time to future to prevent bucket from refilling
-	mocks.Now = func() time.Time {
-		return time.Now().Add(time.Second * 5)
+			_, err = rl.AllowN(ctx, "user", -1)
+			s.ErrorIs(err, lib.ErrInvalidTokens)
+		})
 	}
+}
 
-	for _, tt := range s.rlConfig {
+func (s *testFactorySuite) TestBackendUnavailable() {
+	rl, err := lib.NewRateLimiter(map[string]string{"algorithm": lib.RedisSlidingWindowCounter.String(), "capacity": "10", "duration": "5", "weight": "1.0", "redisURL": "redis://" + s.redis.Addr()})
+	s.NoError(err)
+
+	s.redis.Close()
+
+	_, err = rl.Allow(context.Background(), "user")
+	s.ErrorIs(err, lib.ErrBackendUnavailable)
+	s.NotErrorIs(err, lib.ErrRateLimited)
+}
+
+func (s *testFactorySuite) TestCapacity() {
+	// the clock does not move, buckets are never refilled
+	for _, tt := range append(s.rlConfig, s.redisConfig...) {
 		s.Run(tt.alg, func() {
 			// rate limiter created with config
-			rl, err := lib.NewRateLimiter(tt.config)
+			rl, err := lib.NewRateLimiterWithClock(tt.config, s.clock)
 
 			assert.NoError(s.T(), err)
 			assert.NotNil(s.T(), rl)
 
 			// parse expected capacity from config
-			capacity := utils.ParseInt(tt.config["capacity"])
+			capacity, _ := utils.ParseInt(tt.config["capacity"])
 
 			for i := 0; i < capacity; i++ {
 				// allow requests until capacity is reached
-				stats, err := rl.Allow("user")
+				stats, err := rl.Allow(context.Background(), "user")
 
 				assert.NoError(s.T(), err)
 				assert.Equal(s.T(), capacity, stats.Capacity)
@@ -75,33 +145,62 @@ func (s *testFactorySuite) TestCapacity() {
 			}
 
 			// no more capacity, throw error
-			_, err = rl.Allow("user")
+			_, err = rl.Allow(context.Background(), "user")
 			s.Error(err)
 		})
 	}
 }
 
-func (s *testFactorySuite) TestRefilling() {
-	// Set current time to past to allow bucket to refill
-	// timer needs to be before the window duration of the algorithm
-	mocks.Now = func() time.Time {
-		return time.Now().Add(time.Second * 5 * -1)
+func (s *testFactorySuite) TestPeek() {
+	for _, tt := range append(s.rlConfig, s.redisConfig...) {
+		s.Run(tt.alg, func() {
+			rl, err := lib.NewRateLimiterWithClock(tt.config, s.clock)
+			s.NoError(err)
+
+			ctx := context.Background()
+			capacity, _ := utils.ParseInt(tt.config["capacity"])
+
+			// unknown user has the full capacity
+			stats, err := rl.Peek(ctx, "user")
+			s.NoError(err)
+			s.Equal(capacity, stats.Capacity)
+			s.Equal(capacity, stats.Remaining)
+
+			_, err = rl.AllowN(ctx, "user", 3)
+			s.NoError(err)
+
+			// peeking does not consume tokens
+			for i := 0; i < 3; i++ {
+				stats, err = rl.Peek(ctx, "user")
+				s.NoError(err)
+				s.Equal(capacity-3, stats.Remaining)
+			}
+
+			stats, err = rl.Allow(ctx, "user")
+			s.NoError(err)
+			s.Equal(capacity-4, stats.Remaining)
+		})
 	}
+}
 
-	for _, tt := range s.rlConfig {
+func (s *testFactorySuite) TestRefilling() {
+	for _, tt := range append(s.rlConfig, s.redisConfig...) {
 		s.Run(tt.alg, func() {
 			// rate limiter created with config
-			rl, err := lib.NewRateLimiter(tt.config)
+			rl, err := lib.NewRateLimiterWithClock(tt.config, s.clock)
 
 			assert.NoError(s.T(), err)
 			assert.NotNil(s.T(), rl)
 
 			// parse expected capacity from config
-			capacity := utils.ParseInt(tt.config["capacity"])
+			capacity, _ := utils.ParseInt(tt.config["capacity"])
 
 			for i := 0; i < capacity; i++ {
+				// move the clock past twice the window duration of the algorithm to refill the bucket,
+				// the sliding window counters still count the previous window for one duration
+				s.clock.Advance(time.Second*10 + time.Millisecond)
 
-				stats, err := rl.Allow("user")
+				stats, err := rl.Allow(context.Background(), "user")
 
 				assert.NoError(s.T(), err)
 				assert.Equal(s.T(), capacity, stats.Capacity)
@@ -113,6 +212,2230 @@ func (s *testFactorySuite) TestRefilling() {
 	}
 }
 
-func TestRateLimiterSuite(t *testing.T) {
-	suite.Run(t, new(testFactorySuite))
+func (s *testFactorySuite) TestAdministration() {
+	for _, tt := range append(s.rlConfig, s.redisConfig...) {
+		s.Run(tt.alg, func() {
+			rl, err := lib.NewRateLimiterWithClock(tt.config, s.clock)
+			s.NoError(err)
+
+			ctx := context.Background()
+			capacity, _ := utils.ParseInt(tt.config["capacity"])
+
+			_, err = rl.AllowN(ctx, "user", capacity)
+			s.NoError(err)
+
+			// refund gives tokens back
+			stats, err := rl.Refund(ctx, "user", 2)
+			s.NoError(err)
+			s.Equal(2, stats.Remaining)
+
+			_, err = rl.Refund(ctx, "user", -1)
+			s.Error(err)
+
+			// remaining tokens can be overridden
+			stats, err = rl.SetRemaining(ctx, "user", 5)
+			s.NoError(err)
+			s.Equal(5, stats.Remaining)
+
+			stats, err = rl.SetRemaining(ctx, "user", capacity+5)
+			s.NoError(err)
+			s.Equal(capacity, stats.Remaining)
+
+			stats, err = rl.SetRemaining(ctx, "user", 0)
+			s.NoError(err)
+			s.Equal(0, stats.Remaining)
+
+			_, err = rl.Allow(ctx, "user")
+			s.Error(err)
+
+			// reset drops the user state
+			s.NoError(rl.Reset(ctx, "user"))
+
+			stats, err = rl.Peek(ctx, "user")
+			s.NoError(err)
+			s.Equal(capacity, stats.Remaining)
+		})
+	}
+}
+
+func (s *testFactorySuite) TestConcurrentRequests() {
+	for _, tt := range append(s.rlConfig, s.redisConfig...) {
+		s.Run(tt.alg, func() {
+			rl, err := lib.NewRateLimiterWithClock(tt.config, s.clock)
+			s.NoError(err)
+
+			ctx := context.Background()
+			capacity, _ := utils.ParseInt(tt.config["capacity"])
+
+			var wg sync.WaitGroup
+			var allowed atomic.Int32
+
+			for i := 0; i < 50; i++ {
+				wg.Add(1)
+
+				go func(i int) {
+					defer wg.Done()
+
+					for j := 0; j < 10; j++ {
+						// every goroutine competes for the same user
+						if _, err := rl.Allow(ctx, "user"); err == nil {
+							allowed.Add(1)
+						}
+
+						// and uses its own user
+						rl.Allow(ctx, "user-"+strconv.Itoa(i))
+						rl.Peek(ctx, "user-"+strconv.Itoa(i))
+					}
+				}(i)
+			}
+
+			wg.Wait()
+
+			// the clock does not move, exactly the capacity is allowed
+			s.Equal(int32(capacity), allowed.Load())
+		})
+	}
+}
+
+func (s *testFactorySuite) TestConcurrentAdministration() {
+	for _, tt := range append(s.rlConfig, s.redisConfig...) {
+		s.Run(tt.alg, func() {
+			rl, err := lib.NewRateLimiterWithClock(tt.config, s.clock)
+			s.NoError(err)
+
+			ctx := context.Background()
+			var wg sync.WaitGroup
+
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+
+				go func() {
+					defer wg.Done()
+
+					rl.Allow(ctx, "user")
+					rl.Refund(ctx, "user", 1)
+					rl.SetRemaining(ctx, "user", 3)
+					rl.Reset(ctx, "user")
+				}()
+			}
+
+			wg.Wait()
+		})
+	}
+}
+
+func (s *testFactorySuite) TestReserve() {
+	for _, tt := range append(s.rlConfig, s.redisConfig...) {
+		s.Run(tt.alg, func() {
+			rl, err := lib.NewRateLimiterWithClock(tt.config, s.clock)
+			s.NoError(err)
+
+			ctx := context.Background()
+			capacity, _ := utils.ParseInt(tt.config["capacity"])
+
+			// tokens available now
+			now, err := rl.Reserve(ctx, "user", capacity)
+			s.NoError(err)
+			s.True(now.OK())
+			s.Equal(time.Duration(0), now.Delay())
+
+			// tokens available in the future
+			later, err := rl.Reserve(ctx, "user", 1)
+			s.NoError(err)
+			s.True(later.OK())
+			s.Greater(later.Delay(), time.Duration(0))
+
+			_, err = rl.Allow(ctx, "user")
+			s.Error(err)
+
+			// cancelled reservations give the tokens back
+			later.Cancel()
+			now.Cancel()
+			now.Cancel()
+
+			stats, err := rl.Allow(ctx, "user")
+			s.NoError(err)
+			s.Equal(capacity-1, stats.Remaining)
+
+			// more tokens than the capacity can never be reserved
+			_, err = rl.Reserve(ctx, "user", capacity+1)
+			s.Error(err)
+		})
+	}
+}
+
+func (s *testFactorySuite) TestCancelAfterReady() {
+	for _, config := range []map[string]string{
+		{"algorithm": lib.TokenBucket.String(), "capacity": "10", "refillRate": "1"},
+		{"algorithm": lib.GCRA.String(), "capacity": "10", "refillRate": "1"},
+		{"algorithm": lib.RedisGCRA.String(), "capacity": "10", "refillRate": "1", "redisURL": "redis://" + s.redis.Addr()},
+	} {
+		s.Run(config["algorithm"], func() {
+			rl, err := lib.NewRateLimiterWithClock(config, s.clock)
+			s.Require().NoError(err)
+			defer rl.Close()
+
+			ctx := context.Background()
+
+			_, err = rl.AllowN(ctx, "user", 10)
+			s.Require().NoError(err)
+
+			r, err := rl.Reserve(ctx, "user", 1)
+			s.Require().NoError(err)
+			s.Equal(time.Second, r.Delay())
+
+			// the reserved token was spent when it became available, one of the two refilled tokens is left
+			s.clock.Advance(2 * time.Second)
+			r.Cancel()
+
+			stats, err := rl.Peek(ctx, "user")
+			s.NoError(err)
+			s.Equal(1, stats.Remaining)
+		})
+	}
+}
+
+func (s *testFactorySuite) TestFixedWindowReserveAlignment() {
+	rl := lib.NewFixedWindowLimiter(lib.FixedWindowArgs{Capacity: 2, Duration: time.Second, Clock: s.clock})
+	ctx := context.Background()
+	start := s.clock.Now()
+
+	_, err := rl.AllowN(ctx, "user", 2)
+	s.Require().NoError(err)
+
+	// the second window is taken by the reservation
+	r, err := rl.Reserve(ctx, "user", 2)
+	s.Require().NoError(err)
+	s.WithinDuration(start.Add(time.Second), start.Add(r.Delay()), 0)
+
+	// halfway through the second window, the next tokens are in the third one
+	s.clock.Advance(1500 * time.Millisecond)
+
+	var rlErr *lib.RateLimitError
+
+	_, err = rl.Allow(ctx, "user")
+	s.Require().ErrorAs(err, &rlErr)
+	s.Equal(500*time.Millisecond, rlErr.RetryAfter)
+
+	stats, err := rl.Peek(ctx, "user")
+	s.NoError(err)
+	s.WithinDuration(start.Add(2*time.Second), stats.Reset, 0)
+
+	r, err = rl.Reserve(ctx, "user", 1)
+	s.NoError(err)
+	s.Equal(500*time.Millisecond, r.Delay())
+}
+
+func (s *testFactorySuite) TestWait() {
+	for _, tt := range append(s.rlConfig, s.redisConfig...) {
+		s.Run(tt.alg, func() {
+			rl, err := lib.NewRateLimiterWithClock(tt.config, s.clock)
+			s.NoError(err)
+
+			capacity, _ := utils.ParseInt(tt.config["capacity"])
+
+			// capacity available, no wait
+			s.NoError(rl.Wait(context.Background(), "user"))
+
+			_, err = rl.AllowN(context.Background(), "user", capacity-1)
+			s.NoError(err)
+
+			// the next token is available after the deadline
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+
+			s.Error(rl.Wait(ctx, "user"))
+		})
+	}
+
+	s.Run("Wait for refill", func() {
+		rl := lib.NewTokenBucketLimiter(lib.TokenBucketArgs{Capacity: 1, RefillRate: 1, Clock: s.clock})
+
+		s.NoError(rl.Wait(context.Background(), "user"))
+
+		start := s.clock.Now()
+		done := make(chan error)
+
+		go func() {
+			done <- rl.Wait(context.Background(), "user")
+		}()
+
+		// move the clock until the waiting request is released
+		for waiting := true; waiting; {
+			select {
+			case err := <-done:
+				s.NoError(err)
+				waiting = false
+			case <-time.After(time.Millisecond):
+				s.clock.Advance(100 * time.Millisecond)
+			}
+		}
+
+		s.GreaterOrEqual(s.clock.Now().Sub(start), time.Second)
+	})
+}
+
+func (s *testFactorySuite) TestTypedConstructors() {
+	limiters := map[string]lib.RateLimiter{
+		lib.TokenBucket.String():          lib.NewTokenBucketLimiter(lib.TokenBucketArgs{Capacity: 2, RefillRate: 1}),
+		lib.FixedWindow.String():          lib.NewFixedWindowLimiter(lib.FixedWindowArgs{Capacity: 2, Duration: 60}),
+		lib.SlidingWindowLog.String():     lib.NewSlidingWindowLogLimiter(lib.SlidingWindowLogArgs{Capacity: 2, Duration: 60}),
+		lib.SlidingWindowCounter.String(): lib.NewSlidingWindowCounterLimiter(lib.SlidingWindowCounterArgs{Capacity: 2, Duration: 60, Weight: 1.0}),
+	}
+
+	for alg, rl := range limiters {
+		s.Run(alg, func() {
+			var stats lib.Stats
+			stats, err := rl.Allow(context.Background(), "user")
+
+			s.NoError(err)
+			s.Equal(alg, stats.Algorithm)
+			s.Equal(2, stats.Capacity)
+		})
+	}
+}
+
+func (s *testFactorySuite) TestAllowN() {
+	for _, tt := range append(s.rlConfig, s.redisConfig...) {
+		s.Run(tt.alg, func() {
+			rl, err := lib.NewRateLimiterWithClock(tt.config, s.clock)
+			s.NoError(err)
+
+			ctx := context.Background()
+			capacity, _ := utils.ParseInt(tt.config["capacity"])
+
+			stats, err := rl.AllowN(ctx, "user", 3)
+			s.NoError(err)
+			s.Equal(capacity-3, stats.Remaining)
+
+			// request bigger than the remaining tokens is denied and consumes nothing
+			_, err = rl.AllowN(ctx, "user", capacity)
+			s.Error(err)
+
+			stats, err = rl.AllowN(ctx, "user", capacity-3)
+			s.NoError(err)
+			s.Equal(0, stats.Remaining)
+
+			_, err = rl.AllowN(ctx, "user", 1)
+			s.Error(err)
+
+			// invalid number of tokens
+			_, err = rl.AllowN(ctx, "other", -1)
+			s.Error(err)
+		})
+	}
+}
+
+func (s *testFactorySuite) TestCancelledContext() {
+	for _, tt := range append(s.rlConfig, s.redisConfig...) {
+		s.Run(tt.alg, func() {
+			rl, err := lib.NewRateLimiterWithClock(tt.config, s.clock)
+			s.NoError(err)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			// cancelled requests are rejected with the context error
+			_, err = rl.Allow(ctx, "user")
+			s.ErrorIs(err, context.Canceled)
+
+			// and they are not counted
+			stats, err := lib.Allow(rl, "user")
+			s.NoError(err)
+			s.Equal(stats.Capacity-1, stats.Remaining)
+		})
+	}
+}
+
+func (s *testFactorySuite) TestMaxKeys() {
+	for _, tt := range s.rlConfig {
+		s.Run(tt.alg, func() {
+			config := maps.Clone(tt.config)
+			config["maxKeys"] = "5"
+
+			rl, err := lib.NewRateLimiterWithClock(config, s.clock)
+			s.NoError(err)
+			defer rl.Close()
+
+			for i := 0; i < 20; i++ {
+				_, err = lib.Allow(rl, fmt.Sprintf("user-%d", i))
+				s.NoError(err)
+			}
+
+			tracker, ok := rl.(lib.KeyTracker)
+			s.True(ok)
+			s.LessOrEqual(tracker.TrackedKeys(), 5)
+		})
+	}
+}
+
+func (s *testFactorySuite) TestCleanupInterval() {
+	for _, tt := range s.rlConfig {
+		s.Run(tt.alg, func() {
+			config := maps.Clone(tt.config)
+			config["cleanupInterval"] = "10ms"
+
+			rl, err := lib.NewRateLimiterWithClock(config, s.clock)
+			s.NoError(err)
+			defer rl.Close()
+
+			_, err = lib.Allow(rl, "user")
+			s.NoError(err)
+
+			tracker := rl.(lib.KeyTracker)
+			s.Equal(1, tracker.TrackedKeys())
+
+			// users are removed once their state is back to full
+			s.clock.Advance(time.Minute)
+
+			s.Eventually(func() bool {
+				return tracker.TrackedKeys() == 0
+			}, time.Second, 10*time.Millisecond)
+
+			// and start again from the full capacity
+			stats, err := lib.Allow(rl, "user")
+			s.NoError(err)
+			s.Equal(stats.Capacity-1, stats.Remaining)
+		})
+	}
+}
+
+func (s *testFactorySuite) TestInvalidCleanupInterval() {
+	_, err := lib.NewRateLimiter(map[string]string{"algorithm": lib.TokenBucket.String(), "capacity": "10", "refillRate": "1", "cleanupInterval": "soon"})
+
+	s.ErrorIs(err, lib.ErrInvalidConfig)
+}
+
+func (s *testFactorySuite) TestInvalidConfig() {
+	tests := []struct {
+		name   string
+		config map[string]string
+		field  string
+	}{
+		{"capacity is not a number", map[string]string{"algorithm": lib.TokenBucket.String(), "capacity": "abc", "refillRate": "1"}, "capacity"},
+		{"zero capacity", map[string]string{"algorithm": lib.FixedWindow.String(), "capacity": "0", "duration": "5"}, "capacity"},
+		{"negative duration", map[string]string{"algorithm": lib.SlidingWindowLog.String(), "capacity": "10", "duration": "-5"}, "duration"},
+		{"weight out of range", map[string]string{"algorithm": lib.SlidingWindowCounter.String(), "capacity": "10", "duration": "5", "weight": "7.5"}, "weight"},
+		{"missing weight", map[string]string{"algorithm": lib.SlidingWindowCounter.String(), "capacity": "10", "duration": "5"}, "weight"},
+		{"unknown window mode", map[string]string{"algorithm": lib.SlidingWindowCounter.String(), "capacity": "10", "duration": "5", "weight": "1", "mode": "exact"}, "mode"},
+		{"more buckets than nanoseconds", map[string]string{"algorithm": lib.BucketedSlidingWindow.String(), "capacity": "10", "duration": "5ns", "buckets": "10"}, "buckets"},
+		{"unknown rejected policy", map[string]string{"algorithm": lib.SlidingWindowLog.String(), "capacity": "10", "duration": "5", "rejected": "drop"}, "rejected"},
+		{"unknown key", map[string]string{"algorithm": lib.TokenBucket.String(), "capacity": "10", "refillRate": "1", "burst": "5"}, "burst"},
+		{"memory keys on redis", map[string]string{"algorithm": lib.RedisSlidingWindowCounter.String(), "capacity": "10", "duration": "5", "weight": "1", "redisURL": "redis://localhost", "maxKeys": "5"}, "maxKeys"},
+		{"invalid redis url", map[string]string{"algorithm": lib.RedisSlidingWindowCounter.String(), "capacity": "10", "duration": "5", "weight": "1", "redisURL": "localhost"}, "redisURL"},
+		{"negative max keys", map[string]string{"algorithm": lib.TokenBucket.String(), "capacity": "10", "refillRate": "1", "maxKeys": "-1"}, "maxKeys"},
+	}
+
+	for _, tt := range tests {
+		s.Run(tt.name, func() {
+			_, err := lib.NewRateLimiter(tt.config)
+			s.ErrorIs(err, lib.ErrInvalidConfig)
+
+			var rlErr *lib.RateLimitError
+			s.ErrorAs(err, &rlErr)
+			s.Equal(tt.field, rlErr.Field)
+			s.Contains(err.Error(), tt.field)
+		})
+	}
+}
+
+func (s *testFactorySuite) TestTypedConfig() {
+	rl, err := lib.NewRateLimiterFromConfig(lib.Config{
+		Algorithm: lib.TokenBucket,
+		Clock:     s.clock,
+		Args:      lib.TokenBucketArgs{Capacity: 10, RefillRate: 1},
+	})
+	s.NoError(err)
+
+	stats, err := lib.Allow(rl, "user")
+	s.NoError(err)
+	s.Equal(9, stats.Remaining)
+	s.Equal(s.clock.Now(), stats.CurrentTime)
+
+	// the algorithm comes with its arguments
+	rl, err = lib.NewRateLimiterFromConfig(lib.Config{Args: lib.FixedWindowArgs{Capacity: 10, Duration: time.Second}})
+	s.NoError(err)
+
+	stats, err = lib.Allow(rl, "user")
+	s.NoError(err)
+	s.Equal(lib.FixedWindow.String(), stats.Algorithm)
+
+	// the arguments must match the algorithm
+	var rlErr *lib.RateLimitError
+
+	err = lib.Config{Algorithm: lib.FixedWindow, Args: lib.TokenBucketArgs{Capacity: 10}}.Validate()
+	s.ErrorIs(err, lib.ErrInvalidConfig)
+	s.Require().ErrorAs(err, &rlErr)
+	s.Equal("algorithm", rlErr.Field)
+
+	err = lib.Config{Algorithm: lib.TokenBucket}.Validate()
+	s.ErrorIs(err, lib.ErrInvalidConfig)
+
+	// a parsed string config holds the typed arguments of its algorithm
+	c, err := lib.ParseConfig(map[string]string{"algorithm": lib.GCRA.String(), "capacity": "5", "refillRate": "2/s"})
+	s.NoError(err)
+	s.Equal(lib.GCRAArgs{Capacity: 5, RefillRate: 2, RefillPeriod: time.Second}, c.Args)
+}
+
+func (s *testFactorySuite) TestPolicyLimiters() {
+	p, err := lib.ParsePolicy([]byte(`
+backends:
+  shared:
+    redisURL: redis://`+s.redis.Addr()+`
+limits:
+  - {name: global, algorithm: redis-sliding-window-counter, backend: shared, params: {capacity: 10, duration: 5, weight: 1}}
+  - {name: api, algorithm: token-bucket, params: {capacity: 5, refillRate: 1}}
+`), "yaml")
+	s.Require().NoError(err)
+
+	limiters, err := lib.NewPolicyLimiters(p, s.clock)
+	s.Require().NoError(err)
+	s.Len(limiters, 2)
+
+	for name, rl := range limiters {
+		stats, err := lib.Allow(rl, "user")
+		s.NoError(err, name)
+		s.Equal(stats.Capacity-1, stats.Remaining, name)
+		s.NoError(rl.Close())
+	}
+}
+
+func (s *testFactorySuite) TestPolicySharedRedisBackend() {
+	p, err := lib.ParsePolicy([]byte(`
+backends:
+  shared:
+    redisURL: redis://`+s.redis.Addr()+`
+limits:
+  - {name: burst, algorithm: redis-gcra, backend: shared, params: {capacity: 2, refillRate: 1}}
+  - {name: sustained, algorithm: redis-gcra, backend: shared, params: {capacity: 10, refillRate: 1}}
+  - {name: window, algorithm: redis-bucketed-sliding-window, backend: shared, params: {capacity: 5, duration: 1m, buckets: 6}}
+`), "yaml")
+	s.Require().NoError(err)
+
+	limiters, err := lib.NewPolicyLimiters(p, s.clock)
+	s.Require().NoError(err)
+
+	for _, rl := range limiters {
+		defer rl.Close()
+	}
+
+	ctx := context.Background()
+
+	// the burst limit is exhausted, the limits sharing its Redis server are not
+	_, err = limiters["burst"].AllowN(ctx, "user", 2)
+	s.Require().NoError(err)
+
+	_, err = limiters["burst"].Allow(ctx, "user")
+	s.ErrorIs(err, lib.ErrRateLimited)
+
+	for name, capacity := range map[string]int{"sustained": 10, "window": 5} {
+		stats, err := limiters[name].Allow(ctx, "user")
+		s.NoError(err, name)
+		s.Equal(capacity-1, stats.Remaining, name)
+	}
+
+	stats, err := limiters["burst"].Peek(ctx, "user")
+	s.NoError(err)
+	s.Equal(0, stats.Remaining)
+
+	// each limit keeps its users under its name and algorithm
+	s.ElementsMatch([]string{"burst:redis-gcra:user", "sustained:redis-gcra:user", "window:redis-bucketed-sliding-window:user"}, s.redis.Keys())
+}
+
+func (s *testFactorySuite) TestRegisterAlgorithm() {
+	// a quota that is never refilled, built on top of the token bucket
+	spec := lib.AlgorithmSpec{
+		Name:        "test-quota",
+		Description: "Fixed quota",
+		Fields: []lib.ConfigField{
+			{Name: "quota", Type: lib.IntField, Required: true, Default: "100", Usage: "The number of requests allowed"},
+			{Name: "refill", Type: lib.RateField, Usage: "The requests given back per period, e.g. 1/h, never refilled when empty"},
+		},
+		Factory: func(config map[string]string, clock lib.Clock) (lib.RateLimiter, error) {
+			quota, _ := utils.ParseInt(config["quota"])
+			args := lib.TokenBucketArgs{Capacity: quota, Clock: clock}
+
+			if config["refill"] != "" {
+				args.RefillRate, args.RefillPeriod, _ = utils.ParseRate(config["refill"])
+			}
+
+			if err := args.Validate(); err != nil {
+				return nil, err
+			}
+
+			return lib.NewTokenBucketLimiter(args), nil
+		},
+	}
+
+	s.Require().NoError(lib.RegisterAlgorithm(spec))
+	s.ErrorIs(lib.RegisterAlgorithm(spec), lib.ErrInvalidConfig)
+
+	registered, ok := lib.LookupAlgorithm("Test-Quota")
+	s.True(ok)
+	s.Equal("test-quota", registered.Command)
+	names := []string{}
+
+	for _, spec := range lib.Algorithms() {
+		names = append(names, spec.Name)
+	}
+
+	s.Contains(names, "test-quota")
+	s.Contains(names, lib.TokenBucket.String())
+
+	alg, ok := lib.ParseAlgorithm("test-quota")
+	s.True(ok)
+	s.Equal("test-quota", alg.String())
+
+	rl, err := lib.NewRateLimiterWithClock(map[string]string{"algorithm": "test-quota", "quota": "2"}, s.clock)
+	s.Require().NoError(err)
+
+	_, err = rl.AllowN(context.Background(), "user", 2)
+	s.NoError(err)
+
+	// never refilled
+	s.clock.Advance(time.Hour)
+	_, err = lib.Allow(rl, "user")
+	s.ErrorIs(err, lib.ErrRateLimited)
+
+	// the config is checked against the fields of the algorithm
+	_, err = lib.NewRateLimiter(map[string]string{"algorithm": "test-quota", "quota": "2", "capacity": "10"})
+	s.ErrorIs(err, lib.ErrInvalidConfig)
+
+	_, err = lib.NewRateLimiter(map[string]string{"algorithm": "test-quota", "quota": "many"})
+	s.ErrorIs(err, lib.ErrInvalidConfig)
+
+	_, err = lib.NewRateLimiter(map[string]string{"algorithm": "test-quota", "quota": "2", "refill": "often"})
+	s.ErrorIs(err, lib.ErrInvalidConfig)
+
+	// rate fields take a number per duration
+	rl, err = lib.NewRateLimiterWithClock(map[string]string{"algorithm": "test-quota", "quota": "2", "refill": "1/100ms"}, s.clock)
+	s.Require().NoError(err)
+
+	_, err = rl.AllowN(context.Background(), "user", 2)
+	s.NoError(err)
+
+	s.clock.Advance(100 * time.Millisecond)
+	_, err = lib.Allow(rl, "user")
+	s.NoError(err)
+
+	// and can be used by policies
+	p, err := lib.ParsePolicy([]byte(`{"limits": [{"name": "quota", "algorithm": "test-quota", "params": {"quota": 5}}]}`), "json")
+	s.NoError(err)
+	s.Equal("test-quota", p.Limits[0].Algorithm)
+}
+
+func (s *testFactorySuite) TestMillisecondWindows() {
+	configs := []map[string]string{
+		{"algorithm": lib.FixedWindow.String(), "capacity": "5", "duration": "100ms"},
+		{"algorithm": lib.SlidingWindowLog.String(), "capacity": "5", "duration": "100ms"},
+		{"algorithm": lib.SlidingWindowCounter.String(), "capacity": "5", "duration": "100ms", "weight": "1"},
+		{"algorithm": lib.RedisSlidingWindowCounter.String(), "capacity": "5", "duration": "100ms", "weight": "1", "redisURL": "redis://" + s.redis.Addr()},
+	}
+
+	for _, config := range configs {
+		s.Run(config["algorithm"], func() {
+			rl, err := lib.NewRateLimiterWithClock(config, s.clock)
+			s.Require().NoError(err)
+			defer rl.Close()
+
+			ctx := context.Background()
+
+			// 5 requests per 100ms
+			_, err = rl.AllowN(ctx, "user", 5)
+			s.NoError(err)
+
+			_, err = rl.Allow(ctx, "user")
+
+			var rlErr *lib.RateLimitError
+			s.Require().ErrorAs(err, &rlErr)
+			s.Greater(rlErr.RetryAfter, time.Duration(0))
+			s.LessOrEqual(rlErr.RetryAfter, 100*time.Millisecond)
+
+			// not refilled before the end of the window
+			s.clock.Advance(50 * time.Millisecond)
+
+			stats, err := rl.Peek(ctx, "user")
+			s.NoError(err)
+			s.Equal(0, stats.Remaining)
+
+			s.clock.Advance(51 * time.Millisecond)
+
+			stats, err = rl.Allow(ctx, "user")
+			s.NoError(err)
+			s.Equal(4, stats.Remaining)
+		})
+	}
+}
+
+func (s *testFactorySuite) TestTokenBucketFractionalRefill() {
+	// half a token per second
+	rl, err := lib.NewRateLimiterWithClock(map[string]string{"algorithm": lib.TokenBucket.String(), "capacity": "1", "refillRate": "1/2s"}, s.clock)
+	s.Require().NoError(err)
+
+	ctx := context.Background()
+
+	_, err = rl.Allow(ctx, "user")
+	s.NoError(err)
+
+	// the retry after is exact
+	_, err = rl.Allow(ctx, "user")
+
+	var rlErr *lib.RateLimitError
+	s.Require().ErrorAs(err, &rlErr)
+	s.Equal(2*time.Second, rlErr.RetryAfter)
+	s.Equal(s.clock.Now().Add(2*time.Second), rlErr.Stats.Reset)
+
+	// partial refills are kept between requests
+	for i := 0; i < 3; i++ {
+		s.clock.Advance(500 * time.Millisecond)
+
+		_, err = rl.Allow(ctx, "user")
+		s.ErrorIs(err, lib.ErrRateLimited)
+	}
+
+	s.clock.Advance(500 * time.Millisecond)
+
+	_, err = rl.Allow(ctx, "user")
+	s.NoError(err)
+}
+
+func (s *testFactorySuite) TestLongRunRefillRate() {
+	tests := []struct {
+		name     string
+		config   map[string]string
+		interval time.Duration // time between two requests of the client
+		rate     float64       // expected tokens per second
+	}{
+		{"calls every 0.9s at 1/s", map[string]string{"capacity": "2", "refillRate": "1"}, 900 * time.Millisecond, 1},
+		{"calls every 10ms at 0.5/s", map[string]string{"capacity": "5", "refillRate": "0.5"}, 10 * time.Millisecond, 0.5},
+		{"calls every 7ms at 5/100ms", map[string]string{"capacity": "5", "refillRate": "5/100ms"}, 7 * time.Millisecond, 50},
+		{"calls every 300ms at 7/3s", map[string]string{"capacity": "3", "refillRate": "7", "refillPeriod": "3s"}, 300 * time.Millisecond, 7.0 / 3},
+	}
+
+	for _, alg := range []lib.Algorithm{lib.TokenBucket, lib.GCRA} {
+		for _, tt := range tests {
+			s.Run(alg.String()+"/"+tt.name, func() {
+				config := maps.Clone(tt.config)
+				config["algorithm"] = alg.String()
+
+				rl, err := lib.NewRateLimiterWithClock(config, s.clock)
+				s.Require().NoError(err)
+
+				// a client calling faster than the rate gets the rate, plus the initial capacity. No partial refill is lost
+				elapsed := time.Duration(0)
+				allowed := 0
+
+				for elapsed < 1000*time.Second {
+					if _, err := lib.Allow(rl, "user"); err == nil {
+						allowed++
+					}
+
+					s.clock.Advance(tt.interval)
+					elapsed += tt.interval
+				}
+
+				capacity, _ := utils.ParseInt(tt.config["capacity"])
+				expected := tt.rate*elapsed.Seconds() + float64(capacity)
+
+				s.InDelta(expected, float64(allowed), expected*0.001+1)
+			})
+		}
+	}
+}
+
+func (s *testFactorySuite) TestGCRA() {
+	for _, config := range []map[string]string{
+		{"algorithm": lib.GCRA.String(), "capacity": "2", "refillRate": "1/100ms"},
+		{"algorithm": lib.RedisGCRA.String(), "capacity": "2", "refillRate": "1/100ms", "redisURL": "redis://" + s.redis.Addr()},
+	} {
+		s.Run(config["algorithm"], func() {
+			rl, err := lib.NewRateLimiterWithClock(config, s.clock)
+			s.Require().NoError(err)
+			defer rl.Close()
+
+			ctx := context.Background()
+
+			// the reset is the time the bucket is full again
+			stats, err := rl.AllowN(ctx, "user", 2)
+			s.NoError(err)
+			s.Equal(config["algorithm"], stats.Algorithm)
+			s.Equal(0, stats.Remaining)
+			s.Equal(s.clock.Now().Add(200*time.Millisecond), stats.Reset)
+
+			// the retry after is exact, even between two refills
+			var rlErr *lib.RateLimitError
+
+			_, err = rl.Allow(ctx, "user")
+			s.Require().ErrorAs(err, &rlErr)
+			s.Equal(100*time.Millisecond, rlErr.RetryAfter)
+
+			s.clock.Advance(30 * time.Millisecond)
+
+			_, err = rl.AllowN(ctx, "user", 2)
+			s.Require().ErrorAs(err, &rlErr)
+			s.Equal(170*time.Millisecond, rlErr.RetryAfter)
+
+			s.clock.Advance(70 * time.Millisecond)
+
+			stats, err = rl.Allow(ctx, "user")
+			s.NoError(err)
+			s.Equal(0, stats.Remaining)
+
+			// back to full after the whole capacity is refilled
+			s.clock.Advance(200 * time.Millisecond)
+
+			stats, err = rl.Peek(ctx, "user")
+			s.NoError(err)
+			s.Equal(2, stats.Remaining)
+			s.Equal(s.clock.Now(), stats.Reset)
+		})
+	}
+}
+
+func (s *testFactorySuite) TestRedisGCRAState() {
+	rl := lib.NewRedisGCRALimiter(lib.RedisGCRAArgs{RedisURL: "redis://" + s.redis.Addr(), Capacity: 2, RefillRate: 1, RefillPeriod: 100 * time.Millisecond, Clock: s.clock})
+	defer rl.Close()
+
+	stats, err := rl.AllowN(context.Background(), "user", 2)
+	s.Require().NoError(err)
+
+	// the script stores the TAT only, to the nanosecond, and expires it
+	s.Equal(strconv.FormatInt(stats.Reset.Unix(), 10), s.redis.HGet("redis-gcra:user", "sec"))
+	s.Equal(strconv.Itoa(stats.Reset.Nanosecond()), s.redis.HGet("redis-gcra:user", "nsec"))
+
+	fields, err := s.redis.HKeys("redis-gcra:user")
+	s.NoError(err)
+	s.Equal([]string{"nsec", "sec"}, fields)
+	s.Equal(400*time.Millisecond, s.redis.TTL("redis-gcra:user"))
+}
+
+func (s *testFactorySuite) TestRedisGCRAReservedTTL() {
+	rl := lib.NewRedisGCRALimiter(lib.RedisGCRAArgs{RedisURL: "redis://" + s.redis.Addr(), Capacity: 2, RefillRate: 1, Clock: s.clock})
+	defer rl.Close()
+
+	ctx := context.Background()
+
+	// the reservations push the TAT 10 seconds ahead, the key lives until then plus the burst
+	for i := 0; i < 10; i++ {
+		_, err := rl.Reserve(ctx, "user", 1)
+		s.Require().NoError(err)
+	}
+
+	s.Equal(12*time.Second, s.redis.TTL("redis-gcra:user"))
+
+	s.clock.Advance(5 * time.Second)
+	s.redis.FastForward(5 * time.Second)
+
+	_, err := rl.Allow(ctx, "user")
+	s.ErrorIs(err, lib.ErrRateLimited)
+
+	// a sub-millisecond interval still keeps the key
+	rl = lib.NewRedisGCRALimiter(lib.RedisGCRAArgs{RedisURL: "redis://" + s.redis.Addr(), KeyPrefix: "fast", Capacity: 1, RefillRate: 10000, Clock: s.clock})
+	defer rl.Close()
+
+	_, err = rl.Allow(ctx, "user")
+	s.NoError(err)
+	s.Equal(time.Millisecond, s.redis.TTL("fast:redis-gcra:user"))
+}
+
+func (s *testFactorySuite) TestMultiLimiter() {
+	burst := lib.NewTokenBucketLimiter(lib.TokenBucketArgs{Capacity: 2, RefillRate: 2, RefillPeriod: 100 * time.Millisecond, Clock: s.clock})
+	window := lib.NewFixedWindowLimiter(lib.FixedWindowArgs{Capacity: 5, Duration: time.Second, Clock: s.clock})
+
+	rl, err := lib.NewMultiLimiter(lib.MultiLimiterArgs{
+		Limits: []lib.NamedLimiter{{Name: "burst", Limiter: burst}, {Name: "window", Limiter: window}},
+		Clock:  s.clock,
+	})
+	s.Require().NoError(err)
+
+	ctx := context.Background()
+
+	// the stats are the ones of the most restrictive limit
+	stats, err := rl.AllowN(ctx, "user", 2)
+	s.NoError(err)
+	s.Equal(0, stats.Remaining)
+	s.Equal(2, stats.Capacity)
+
+	// the burst limit denies, the window limit keeps its tokens
+	_, err = rl.Allow(ctx, "user")
+
+	var rlErr *lib.RateLimitError
+	s.Require().ErrorAs(err, &rlErr)
+	s.ErrorIs(err, lib.ErrRateLimited)
+	s.Equal("burst", rlErr.LimitName)
+	s.Equal(50*time.Millisecond, rlErr.RetryAfter)
+
+	stats, err = window.Peek(ctx, "user")
+	s.NoError(err)
+	s.Equal(3, stats.Remaining)
+
+	s.clock.Advance(100 * time.Millisecond)
+
+	stats, err = rl.Allow(ctx, "user")
+	s.NoError(err)
+	s.Equal(1, stats.Remaining)
+
+	stats, err = rl.Allow(ctx, "user")
+	s.NoError(err)
+	s.Equal(0, stats.Remaining)
+
+	// the window limit denies, the burst limit keeps its tokens
+	s.clock.Advance(100 * time.Millisecond)
+
+	_, err = rl.AllowN(ctx, "user", 2)
+	s.Require().ErrorAs(err, &rlErr)
+	s.Equal("window", rlErr.LimitName)
+	s.Equal(5, rlErr.Limit)
+
+	stats, err = burst.Peek(ctx, "user")
+	s.NoError(err)
+	s.Equal(2, stats.Remaining)
+
+	stats, err = rl.Peek(ctx, "user")
+	s.NoError(err)
+	s.Equal(1, stats.Remaining)
+	s.Equal(5, stats.Capacity)
+
+	// administration applies to every limit
+	s.NoError(rl.Reset(ctx, "user"))
+
+	stats, err = rl.Peek(ctx, "user")
+	s.NoError(err)
+	s.Equal(2, stats.Remaining)
+
+	// a reservation holds the tokens of every limit until it is cancelled
+	r, err := rl.Reserve(ctx, "user", 2)
+	s.NoError(err)
+	s.True(r.OK())
+
+	stats, err = window.Peek(ctx, "user")
+	s.NoError(err)
+	s.Equal(3, stats.Remaining)
+
+	r.Cancel()
+
+	stats, err = window.Peek(ctx, "user")
+	s.NoError(err)
+	s.Equal(5, stats.Remaining)
+
+	s.NoError(rl.Close())
+}
+
+func (s *testFactorySuite) TestMultiLimiterRedis() {
+	global := lib.NewRedisSlidingWindowCounterLimiter(lib.RedisSlidingWindowCounterArgs{
+		RedisURL: "redis://" + s.redis.Addr(), Capacity: 3, Duration: time.Second, Weight: 1, Clock: s.clock,
+	})
+	local := lib.NewTokenBucketLimiter(lib.TokenBucketArgs{Capacity: 10, RefillRate: 1, Clock: s.clock})
+
+	rl, err := lib.NewMultiLimiter(lib.MultiLimiterArgs{
+		Limits: []lib.NamedLimiter{{Name: "local", Limiter: local}, {Name: "global", Limiter: global}},
+		Clock:  s.clock,
+	})
+	s.Require().NoError(err)
+	defer rl.Close()
+
+	ctx := context.Background()
+
+	_, err = rl.AllowN(ctx, "user", 3)
+	s.NoError(err)
+
+	_, err = rl.Allow(ctx, "user")
+
+	var rlErr *lib.RateLimitError
+	s.Require().ErrorAs(err, &rlErr)
+	s.Equal("global", rlErr.LimitName)
+
+	// the in-memory token is given back
+	stats, err := local.Peek(ctx, "user")
+	s.NoError(err)
+	s.Equal(7, stats.Remaining)
+
+	// backend errors are returned as they are
+	s.redis.Close()
+
+	_, err = rl.Allow(ctx, "user")
+	s.ErrorIs(err, lib.ErrBackendUnavailable)
+
+	stats, err = local.Peek(ctx, "user")
+	s.NoError(err)
+	s.Equal(7, stats.Remaining)
+}
+
+func (s *testFactorySuite) TestConcurrentMultiLimiter() {
+	burst := lib.NewTokenBucketLimiter(lib.TokenBucketArgs{Capacity: 20, RefillRate: 1, Clock: s.clock})
+	window := lib.NewSlidingWindowLogLimiter(lib.SlidingWindowLogArgs{Capacity: 7, Duration: time.Minute, Clock: s.clock})
+
+	rl, err := lib.NewMultiLimiter(lib.MultiLimiterArgs{
+		Limits: []lib.NamedLimiter{{Name: "burst", Limiter: burst}, {Name: "window", Limiter: window}},
+	})
+	s.Require().NoError(err)
+
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	var allowed atomic.Int32
+
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 10; j++ {
+				if _, err := rl.Allow(ctx, "user"); err == nil {
+					allowed.Add(1)
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	// denied requests consume nothing from the burst limit
+	s.Equal(int32(7), allowed.Load())
+
+	stats, err := burst.Peek(ctx, "user")
+	s.NoError(err)
+	s.Equal(13, stats.Remaining)
+}
+
+func (s *testFactorySuite) TestInvalidMultiLimiter() {
+	limiter := lib.NewTokenBucketLimiter(lib.TokenBucketArgs{Capacity: 1, RefillRate: 1})
+
+	tests := []struct {
+		name   string
+		limits []lib.NamedLimiter
+	}{
+		{"no limits", nil},
+		{"missing name", []lib.NamedLimiter{{Limiter: limiter}}},
+		{"duplicate name", []lib.NamedLimiter{{Name: "a", Limiter: limiter}, {Name: "a", Limiter: limiter}}},
+		{"missing limiter", []lib.NamedLimiter{{Name: "a"}}},
+	}
+
+	for _, tt := range tests {
+		s.Run(tt.name, func() {
+			_, err := lib.NewMultiLimiter(lib.MultiLimiterArgs{Limits: tt.limits})
+			s.ErrorIs(err, lib.ErrInvalidConfig)
+		})
+	}
+}
+
+func (s *testFactorySuite) TestHierarchicalLimits() {
+	server := lib.NewFixedWindowLimiter(lib.FixedWindowArgs{Capacity: 5, Duration: time.Minute, Clock: s.clock})
+	tenant := lib.NewFixedWindowLimiter(lib.FixedWindowArgs{Capacity: 3, Duration: time.Minute, Clock: s.clock})
+	user := lib.NewFixedWindowLimiter(lib.FixedWindowArgs{Capacity: 2, Duration: time.Minute, Clock: s.clock})
+
+	rl, err := lib.NewMultiLimiter(lib.MultiLimiterArgs{
+		Limits: []lib.NamedLimiter{
+			{Name: "server", Limiter: server, Key: lib.GlobalKey},
+			{Name: "tenant", Limiter: tenant, Key: lib.ParentKey},
+			{Name: "user", Limiter: user},
+		},
+		Clock: s.clock,
+	})
+	s.Require().NoError(err)
+
+	ctx := context.Background()
+	var rlErr *lib.RateLimitError
+
+	// every user of a tenant has its own limit
+	_, err = rl.AllowN(ctx, "acme/alice", 2)
+	s.NoError(err)
+
+	_, err = rl.Allow(ctx, "acme/alice")
+	s.Require().ErrorAs(err, &rlErr)
+	s.Equal("user", rlErr.LimitName)
+
+	// the tenant caps its users together
+	stats, err := rl.Allow(ctx, "acme/bob")
+	s.NoError(err)
+	s.Equal(0, stats.Remaining)
+	s.Equal(3, stats.Capacity)
+
+	_, err = rl.Allow(ctx, "acme/carol")
+	s.Require().ErrorAs(err, &rlErr)
+	s.Equal("tenant", rlErr.LimitName)
+
+	// and the server caps every tenant
+	_, err = rl.AllowN(ctx, "globex/dave", 2)
+	s.NoError(err)
+
+	_, err = rl.Allow(ctx, "initech/erin")
+	s.Require().ErrorAs(err, &rlErr)
+	s.Equal("server", rlErr.LimitName)
+
+	// denied requests consumed nothing
+	stats, err = tenant.Peek(ctx, "initech")
+	s.NoError(err)
+	s.Equal(3, stats.Remaining)
+
+	// a refund gives the tokens back to every level, a reset only drops the user level
+	_, err = rl.Refund(ctx, "acme/bob", 1)
+	s.NoError(err)
+
+	s.NoError(rl.Reset(ctx, "acme/alice"))
+
+	stats, err = user.Peek(ctx, "acme/alice")
+	s.NoError(err)
+	s.Equal(2, stats.Remaining)
+
+	stats, err = tenant.Peek(ctx, "acme")
+	s.NoError(err)
+	s.Equal(1, stats.Remaining)
+
+	stats, err = server.Peek(ctx, lib.GlobalKey(""))
+	s.NoError(err)
+	s.Equal(1, stats.Remaining)
+}
+
+func (s *testFactorySuite) TestLeakyBucketMeter() {
+	rl, err := lib.NewRateLimiterWithClock(map[string]string{"algorithm": lib.LeakyBucket.String(), "capacity": "3", "leakRate": "1/100ms", "mode": "meter"}, s.clock)
+	s.Require().NoError(err)
+
+	ctx := context.Background()
+
+	// bursts up to the capacity
+	stats, err := rl.AllowN(ctx, "user", 3)
+	s.NoError(err)
+	s.Equal(0, stats.Remaining)
+	s.Equal(s.clock.Now().Add(300*time.Millisecond), stats.Reset)
+
+	_, err = rl.Allow(ctx, "user")
+
+	var rlErr *lib.RateLimitError
+	s.Require().ErrorAs(err, &rlErr)
+	s.Equal(100*time.Millisecond, rlErr.RetryAfter)
+
+	// then holds to the leak rate
+	for i := 0; i < 5; i++ {
+		s.clock.Advance(100 * time.Millisecond)
+
+		_, err = rl.Allow(ctx, "user")
+		s.NoError(err)
+
+		_, err = rl.Allow(ctx, "user")
+		s.ErrorIs(err, lib.ErrRateLimited)
+	}
+}
+
+func (s *testFactorySuite) TestLeakyBucketQueue() {
+	rl := lib.NewLeakyBucketLimiter(lib.LeakyBucketArgs{Capacity: 2, LeakRate: 1, LeakPeriod: 100 * time.Millisecond, Mode: lib.LeakyBucketQueue, Clock: s.clock})
+	ctx := context.Background()
+
+	// a request on an idle queue is released right away
+	stats, err := rl.Allow(ctx, "user")
+	s.NoError(err)
+	s.Equal(2, stats.Remaining)
+
+	// the next ones wait for their release, one every 100ms
+	first, err := rl.Reserve(ctx, "user", 1)
+	s.NoError(err)
+	s.True(first.OK())
+	s.Equal(100*time.Millisecond, first.Delay())
+
+	second, err := rl.Reserve(ctx, "user", 1)
+	s.NoError(err)
+	s.True(second.OK())
+	s.Equal(200*time.Millisecond, second.Delay())
+	s.Equal(0, second.Stats().Remaining)
+
+	// the queue is full
+	_, err = rl.Allow(ctx, "user")
+
+	var rlErr *lib.RateLimitError
+	s.Require().ErrorAs(err, &rlErr)
+	s.Equal(100*time.Millisecond, rlErr.RetryAfter)
+
+	full, err := rl.Reserve(ctx, "user", 1)
+	s.NoError(err)
+	s.False(full.OK())
+	s.Equal(100*time.Millisecond, full.Delay())
+
+	// the last request leaves the queue
+	second.Cancel()
+
+	stats, err = rl.Peek(ctx, "user")
+	s.NoError(err)
+	s.Equal(1, stats.Remaining)
+
+	// Allow blocks until the release of the request
+	start := s.clock.Now()
+	done := make(chan error)
+
+	go func() {
+		_, err := rl.Allow(ctx, "user")
+		done <- err
+	}()
+
+	for waiting := true; waiting; {
+		select {
+		case err := <-done:
+			s.NoError(err)
+			waiting = false
+		case <-time.After(time.Millisecond):
+			s.clock.Advance(10 * time.Millisecond)
+		}
+	}
+
+	s.GreaterOrEqual(s.clock.Now().Sub(start), 200*time.Millisecond)
+
+	// a request whose context is done leaves the queue
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+
+	_, err = rl.Allow(cancelled, "user")
+	s.ErrorIs(err, context.Canceled)
+}
+
+func (s *testFactorySuite) TestLeakyBucketQueueOutflow() {
+	rl := lib.NewLeakyBucketLimiter(lib.LeakyBucketArgs{Capacity: 5, LeakRate: 10, Mode: lib.LeakyBucketQueue, Clock: s.clock})
+	ctx := context.Background()
+
+	// a burst is spread at the leak rate, the rest of the burst is declined
+	var releases []time.Duration
+
+	for i := 0; i < 8; i++ {
+		r, err := rl.Reserve(ctx, "user", 1)
+		s.NoError(err)
+
+		if r.OK() {
+			releases = append(releases, r.Delay())
+		}
+	}
+
+	s.Equal([]time.Duration{0, 100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond, 400 * time.Millisecond, 500 * time.Millisecond}, releases)
+}
+
+func (s *testFactorySuite) TestInvalidLeakyBucket() {
+	tests := []map[string]string{
+		{"algorithm": lib.LeakyBucket.String(), "capacity": "10", "leakRate": "0"},
+		{"algorithm": lib.LeakyBucket.String(), "capacity": "10", "leakRate": "1", "mode": "fifo"},
+		{"algorithm": lib.LeakyBucket.String(), "capacity": "10", "leakRate": "1/s", "leakPeriod": "1s"},
+	}
+
+	for _, config := range tests {
+		_, err := lib.NewRateLimiter(config)
+		s.ErrorIs(err, lib.ErrInvalidConfig)
+	}
+}
+
+func (s *testFactorySuite) concurrencyLimiters(maxPerKey int, maxTotal int, queueTimeout time.Duration) map[string]lib.ConcurrencyLimiter {
+	memory, err := lib.NewConcurrencyLimiter(lib.ConcurrencyArgs{MaxPerKey: maxPerKey, MaxTotal: maxTotal, QueueTimeout: queueTimeout, Clock: s.clock})
+	s.Require().NoError(err)
+
+	redis, err := lib.NewRedisConcurrencyLimiter(lib.RedisConcurrencyArgs{
+		RedisURL: "redis://" + s.redis.Addr(), MaxPerKey: maxPerKey, MaxTotal: maxTotal, QueueTimeout: queueTimeout, Clock: s.clock,
+	})
+	s.Require().NoError(err)
+
+	s.T().Cleanup(func() {
+		memory.Close()
+		redis.Close()
+	})
+
+	return map[string]lib.ConcurrencyLimiter{"memory": memory, "redis": redis}
+}
+
+func (s *testFactorySuite) TestConcurrencyLimiter() {
+	ctx := context.Background()
+
+	for name, cl := range s.concurrencyLimiters(2, 3, 0) {
+		s.Run(name, func() {
+			releaseA, err := cl.Acquire(ctx, "a")
+			s.NoError(err)
+
+			_, err = cl.Acquire(ctx, "a")
+			s.NoError(err)
+
+			// the key is full
+			_, err = cl.Acquire(ctx, "a")
+
+			var rlErr *lib.RateLimitError
+			s.Require().ErrorAs(err, &rlErr)
+			s.ErrorIs(err, lib.ErrRateLimited)
+			s.Equal("per-key", rlErr.LimitName)
+			s.Equal(2, rlErr.Limit)
+			s.Equal(0, rlErr.Stats.Remaining)
+
+			_, err = cl.Acquire(ctx, "b")
+			s.NoError(err)
+
+			// every key is full
+			_, err = cl.Acquire(ctx, "c")
+			s.Require().ErrorAs(err, &rlErr)
+			s.Equal("total", rlErr.LimitName)
+			s.Equal(3, rlErr.Limit)
+
+			perKey, total, err := cl.InFlight(ctx, "a")
+			s.NoError(err)
+			s.Equal(2, perKey)
+			s.Equal(3, total)
+
+			// a slot is only given back once
+			releaseA()
+			releaseA()
+
+			perKey, total, err = cl.InFlight(ctx, "a")
+			s.NoError(err)
+			s.Equal(1, perKey)
+			s.Equal(2, total)
+
+			_, err = cl.Acquire(ctx, "c")
+			s.NoError(err)
+		})
+	}
+}
+
+func (s *testFactorySuite) TestConcurrencyLimiterQueue() {
+	ctx := context.Background()
+
+	for name, cl := range s.concurrencyLimiters(0, 1, time.Second) {
+		s.Run(name, func() {
+			release, err := cl.Acquire(ctx, "a")
+			s.Require().NoError(err)
+
+			acquire := func() (func(), error) {
+				type result struct {
+					release func()
+					err     error
+				}
+
+				done := make(chan result)
+
+				go func() {
+					release, err := cl.Acquire(ctx, "b")
+					done <- result{release, err}
+				}()
+
+				// the clock moves until the waiter gives up or takes the slot
+				for {
+					select {
+					case r := <-done:
+						return r.release, r.err
+					case <-time.After(time.Millisecond):
+						s.clock.Advance(10 * time.Millisecond)
+					}
+				}
+			}
+
+			// the waiter gets the slot once it is released
+			time.AfterFunc(20*time.Millisecond, release)
+
+			start := s.clock.Now()
+			release, err = acquire()
+			s.Require().NoError(err)
+			s.Less(s.clock.Now().Sub(start), time.Second)
+
+			// the waiter gives up after the queue timeout
+			start = s.clock.Now()
+			_, err = acquire()
+			s.ErrorIs(err, lib.ErrRateLimited)
+			s.GreaterOrEqual(s.clock.Now().Sub(start), time.Second)
+
+			// a waiter whose context is done gives up
+			cancelled, cancel := context.WithCancel(ctx)
+			cancel()
+
+			_, err = cl.Acquire(cancelled, "b")
+			s.ErrorIs(err, context.Canceled)
+
+			release()
+		})
+	}
+}
+
+func (s *testFactorySuite) TestRedisConcurrencyLeases() {
+	ctx := context.Background()
+	args := lib.RedisConcurrencyArgs{RedisURL: "redis://" + s.redis.Addr(), MaxPerKey: 1, LeaseTTL: time.Second, Clock: s.clock}
+
+	// an instance crashes while holding a slot, it stops renewing its lease
+	crashed, err := lib.NewRedisConcurrencyLimiter(args)
+	s.Require().NoError(err)
+
+	_, err = crashed.Acquire(ctx, "a")
+	s.Require().NoError(err)
+	s.NoError(crashed.Close())
+
+	cl, err := lib.NewRedisConcurrencyLimiter(args)
+	s.Require().NoError(err)
+	defer cl.Close()
+
+	_, err = cl.Acquire(ctx, "a")
+	s.ErrorIs(err, lib.ErrRateLimited)
+
+	// the slot is free once the lease expires
+	s.clock.Advance(time.Second + time.Millisecond)
+
+	release, err := cl.Acquire(ctx, "a")
+	s.Require().NoError(err)
+
+	// a lease is renewed while the request is in flight
+	s.clock.Advance(time.Hour)
+
+	s.Eventually(func() bool {
+		perKey, _, err := cl.InFlight(ctx, "a")
+		return err == nil && perKey == 1
+	}, time.Second, 10*time.Millisecond)
+
+	release()
+
+	perKey, total, err := cl.InFlight(ctx, "a")
+	s.NoError(err)
+	s.Equal(0, perKey)
+	s.Equal(0, total)
+
+	// redis failures are backend errors
+	s.redis.Close()
+
+	_, err = cl.Acquire(ctx, "a")
+	s.ErrorIs(err, lib.ErrBackendUnavailable)
+}
+
+func (s *testFactorySuite) TestRedisConcurrencyKeyPrefix() {
+	ctx := context.Background()
+
+	newLimiter := func(keyPrefix string) lib.ConcurrencyLimiter {
+		cl, err := lib.NewRedisConcurrencyLimiter(lib.RedisConcurrencyArgs{RedisURL: "redis://" + s.redis.Addr(), KeyPrefix: keyPrefix, MaxTotal: 1, Clock: s.clock})
+		s.Require().NoError(err)
+		s.T().Cleanup(func() { cl.Close() })
+
+		return cl
+	}
+
+	// servers sharing a prefix share their limits, other prefixes do not see their leases
+	_, err := newLimiter("api").Acquire(ctx, "user")
+	s.Require().NoError(err)
+
+	_, err = newLimiter("api").Acquire(ctx, "user")
+	s.ErrorIs(err, lib.ErrRateLimited)
+
+	_, err = newLimiter("admin").Acquire(ctx, "user")
+	s.NoError(err)
+
+	_, err = newLimiter("").Acquire(ctx, "user")
+	s.NoError(err)
+
+	s.ElementsMatch([]string{"api:inflight:user", "api:inflight", "admin:inflight:user", "admin:inflight", "inflight:user", "inflight"}, s.redis.Keys())
+}
+
+func (s *testFactorySuite) TestConcurrentConcurrencyLimiter() {
+	cl, err := lib.NewConcurrencyLimiter(lib.ConcurrencyArgs{MaxPerKey: 3})
+	s.Require().NoError(err)
+
+	var inFlight, peak atomic.Int32
+	var wg sync.WaitGroup
+
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			release, err := cl.Acquire(context.Background(), "user")
+
+			if err != nil {
+				return
+			}
+
+			defer release()
+
+			n := inFlight.Add(1)
+
+			for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+			}
+
+			time.Sleep(time.Millisecond)
+			inFlight.Add(-1)
+		}()
+	}
+
+	wg.Wait()
+
+	s.LessOrEqual(peak.Load(), int32(3))
+	s.Positive(peak.Load())
+}
+
+func (s *testFactorySuite) TestInvalidConcurrencyLimiter() {
+	_, err := lib.NewConcurrencyLimiter(lib.ConcurrencyArgs{})
+	s.ErrorIs(err, lib.ErrInvalidConfig)
+
+	_, err = lib.NewConcurrencyLimiter(lib.ConcurrencyArgs{MaxPerKey: -1, MaxTotal: 10})
+	s.ErrorIs(err, lib.ErrInvalidConfig)
+
+	_, err = lib.NewConcurrencyLimiter(lib.ConcurrencyArgs{MaxTotal: 10, QueueTimeout: -time.Second})
+	s.ErrorIs(err, lib.ErrInvalidConfig)
+
+	_, err = lib.NewRedisConcurrencyLimiter(lib.RedisConcurrencyArgs{RedisURL: "localhost:6379", MaxTotal: 10})
+
+	var rlErr *lib.RateLimitError
+	s.Require().ErrorAs(err, &rlErr)
+	s.Equal("redisURL", rlErr.Field)
+}
+
+func (s *testFactorySuite) TestAdaptiveAIMD() {
+	al, err := lib.NewAdaptiveLimiter(lib.AdaptiveArgs{InitialLimit: 4, MinLimit: 2, MaxLimit: 6, LatencyThreshold: 100 * time.Millisecond, Clock: s.clock})
+	s.Require().NoError(err)
+
+	ctx := context.Background()
+	var done []func(failed bool)
+
+	for i := 0; i < 4; i++ {
+		d, err := al.AcquireTracked(ctx, "user")
+		s.Require().NoError(err)
+		done = append(done, d)
+	}
+
+	// the limit is reached
+	_, err = al.Acquire(ctx, "user")
+
+	var rlErr *lib.RateLimitError
+	s.Require().ErrorAs(err, &rlErr)
+	s.ErrorIs(err, lib.ErrRateLimited)
+	s.Equal(string(lib.AdaptiveAIMD), rlErr.Stats.Algorithm)
+	s.Equal(4, rlErr.Limit)
+
+	// fast requests grow the limit by one while it is in use, up to the maximum
+	s.clock.Advance(10 * time.Millisecond)
+	done[0](false)
+	done[0](false)
+	done[1](false)
+	done[2](false)
+
+	stats := al.Stats()
+	s.Equal(6, stats.Limit)
+	s.Equal(1, stats.InFlight)
+	s.Equal(10*time.Millisecond, stats.Latency)
+
+	// a failure backs off
+	done[3](true)
+	s.Equal(5, al.Stats().Limit)
+
+	// so does a request slower than the threshold
+	d, err := al.AcquireTracked(ctx, "user")
+	s.Require().NoError(err)
+
+	s.clock.Advance(200 * time.Millisecond)
+	d(false)
+	s.Equal(4, al.Stats().Limit)
+
+	// the limit never goes below the minimum
+	for i := 0; i < 10; i++ {
+		d, err := al.AcquireTracked(ctx, "user")
+		s.Require().NoError(err)
+		d(true)
+	}
+
+	s.Equal(2, al.Stats().Limit)
+}
+
+func (s *testFactorySuite) TestAdaptiveGradient() {
+	al, err := lib.NewAdaptiveLimiter(lib.AdaptiveArgs{Algorithm: lib.AdaptiveGradient, InitialLimit: 10, MaxLimit: 100, Clock: s.clock})
+	s.Require().NoError(err)
+
+	ctx := context.Background()
+
+	// runs as many requests as the limit allows, each one taking the latency
+	round := func(latency time.Duration) int {
+		var done []func(failed bool)
+
+		for limit := al.Stats().Limit; len(done) < limit; {
+			d, err := al.AcquireTracked(ctx, "user")
+			s.Require().NoError(err)
+			done = append(done, d)
+		}
+
+		s.clock.Advance(latency)
+
+		for _, d := range done {
+			d(false)
+		}
+
+		return al.Stats().Limit
+	}
+
+	// a steady latency grows the limit
+	var limit int
+
+	for i := 0; i < 5; i++ {
+		limit = round(10 * time.Millisecond)
+	}
+
+	s.Greater(limit, 10)
+	s.Equal(10*time.Millisecond, al.Stats().BaselineLatency)
+
+	// the backend slows down, the limit shrinks
+	s.Less(round(50*time.Millisecond), limit)
+
+	// failures shrink it too
+	before := al.Stats().Limit
+
+	for i := 0; i < 5; i++ {
+		d, err := al.AcquireTracked(ctx, "user")
+		s.Require().NoError(err)
+		d(true)
+	}
+
+	s.Less(al.Stats().Limit, before)
+}
+
+func (s *testFactorySuite) TestInvalidAdaptiveLimiter() {
+	tests := []lib.AdaptiveArgs{
+		{},
+		{MaxLimit: 10, Algorithm: "vegas"},
+		{MaxLimit: 10, MinLimit: 20},
+		{MaxLimit: 10, InitialLimit: 20},
+		{MaxLimit: 10, BackoffRatio: 1.5},
+		{MaxLimit: 10, Tolerance: 0.5},
+		{MaxLimit: 10, Smoothing: 2},
+		{MaxLimit: 10, LatencyThreshold: -time.Second},
+	}
+
+	for _, args := range tests {
+		_, err := lib.NewAdaptiveLimiter(args)
+		s.ErrorIs(err, lib.ErrInvalidConfig)
+	}
+}
+
+func (s *testFactorySuite) TestInterpolatedSlidingWindow() {
+	limiters := map[string]lib.RateLimiter{
+		"memory": lib.NewSlidingWindowCounterLimiter(lib.SlidingWindowCounterArgs{
+			Capacity: 10, Duration: time.Second, Mode: lib.SlidingWindowInterpolated, Clock: s.clock,
+		}),
+		"redis": lib.NewRedisSlidingWindowCounterLimiter(lib.RedisSlidingWindowCounterArgs{
+			RedisURL: "redis://" + s.redis.Addr(), Capacity: 10, Duration: time.Second, Mode: lib.SlidingWindowInterpolated, Clock: s.clock,
+		}),
+	}
+
+	ctx := context.Background()
+
+	for name, rl := range limiters {
+		s.Run(name, func() {
+			// windows are aligned to multiples of the duration
+			start := time.Unix(1_700_000_000, 0)
+			s.clock.Set(start.Add(300 * time.Millisecond))
+
+			stats, err := rl.AllowN(ctx, "user", 10)
+			s.Require().NoError(err)
+			s.Equal(0, stats.Remaining)
+			s.WithinDuration(start.Add(2*time.Second), stats.Reset, 0)
+
+			// the previous window must be 90% behind the sliding window to leave room for one token
+			_, err = rl.Allow(ctx, "user")
+
+			var rlErr *lib.RateLimitError
+			s.Require().ErrorAs(err, &rlErr)
+			s.Equal(800*time.Millisecond, rlErr.RetryAfter)
+
+			s.clock.Set(start.Add(1100 * time.Millisecond))
+
+			_, err = rl.Allow(ctx, "user")
+			s.NoError(err)
+
+			// 50% of the previous window is covered: 5 + 1 tokens used
+			s.clock.Set(start.Add(1500 * time.Millisecond))
+
+			stats, err = rl.Peek(ctx, "user")
+			s.NoError(err)
+			s.Equal(4, stats.Remaining)
+			s.WithinDuration(start.Add(3*time.Second), stats.Reset, 0)
+
+			// 5 tokens fit once only 40% of the previous window is covered
+			r, err := rl.Reserve(ctx, "user", 5)
+			s.NoError(err)
+			s.True(r.OK())
+			s.Equal(100*time.Millisecond, r.Delay())
+
+			// the reserved tokens count from now, one more token fits when 30% is covered
+			_, err = rl.Allow(ctx, "user")
+			s.Require().ErrorAs(err, &rlErr)
+			s.Equal(200*time.Millisecond, rlErr.RetryAfter)
+
+			r.Cancel()
+
+			_, err = rl.AllowN(ctx, "user", 4)
+			s.NoError(err)
+		})
+	}
+}
+
+func (s *testFactorySuite) TestInterpolatedSlidingWindowAccuracy() {
+	// the same requests go to the sliding window log, exact, and to the interpolated counter, for several traffic rates
+	for _, rate := range []float64{80, 120, 200, 500} {
+		s.Run(fmt.Sprintf("%.0f/s", rate), func() {
+			start := time.Unix(1_700_000_000, 0)
+			clock := lib.NewFakeClock(start)
+
+			exact := lib.NewSlidingWindowLogLimiter(lib.SlidingWindowLogArgs{Capacity: 100, Duration: time.Second, Clock: clock})
+			counter := lib.NewSlidingWindowCounterLimiter(lib.SlidingWindowCounterArgs{
+				Capacity: 100, Duration: time.Second, Mode: lib.SlidingWindowInterpolated, Clock: clock,
+			})
+
+			// random arrivals at the given rate for 30 seconds
+			random := rand.New(rand.NewSource(1))
+			var exactAllowed, counterAllowed int
+
+			for clock.Now().Before(start.Add(30 * time.Second)) {
+				clock.Advance(time.Duration(random.ExpFloat64() / rate * float64(time.Second)))
+
+				if _, err := exact.Allow(context.Background(), "user"); err == nil {
+					exactAllowed++
+				}
+
+				if _, err := counter.Allow(context.Background(), "user"); err == nil {
+					counterAllowed++
+				}
+			}
+
+			s.InEpsilon(exactAllowed, counterAllowed, 0.02)
+		})
+	}
+}
+
+func (s *testFactorySuite) TestBucketedSlidingWindow() {
+	for _, config := range []map[string]string{
+		{"algorithm": lib.BucketedSlidingWindow.String(), "capacity": "4", "duration": "1s", "buckets": "4"},
+		{"algorithm": lib.RedisBucketedSlidingWindow.String(), "capacity": "4", "duration": "1s", "buckets": "4", "redisURL": "redis://" + s.redis.Addr()},
+	} {
+		s.Run(config["algorithm"], func() {
+			rl, err := lib.NewRateLimiterWithClock(config, s.clock)
+			s.Require().NoError(err)
+			defer rl.Close()
+
+			ctx := context.Background()
+
+			// buckets of 250ms are aligned to multiples of their width
+			start := time.Unix(1_700_000_000, 0)
+			s.clock.Set(start.Add(100 * time.Millisecond))
+
+			stats, err := rl.AllowN(ctx, "user", 2)
+			s.Require().NoError(err)
+			s.Equal(config["algorithm"], stats.Algorithm)
+			s.Equal(2, stats.Remaining)
+			s.WithinDuration(start.Add(time.Second), stats.Reset, 0)
+
+			s.clock.Set(start.Add(600 * time.Millisecond))
+
+			stats, err = rl.AllowN(ctx, "user", 2)
+			s.NoError(err)
+			s.Equal(0, stats.Remaining)
+			s.WithinDuration(start.Add(1500*time.Millisecond), stats.Reset, 0)
+
+			// the first bucket leaves the window when the fifth one starts
+			var rlErr *lib.RateLimitError
+
+			_, err = rl.Allow(ctx, "user")
+			s.Require().ErrorAs(err, &rlErr)
+			s.Equal(400*time.Millisecond, rlErr.RetryAfter)
+
+			s.clock.Set(start.Add(time.Second))
+
+			stats, err = rl.Peek(ctx, "user")
+			s.NoError(err)
+			s.Equal(2, stats.Remaining)
+
+			// 3 requests fit once the third bucket has left the window as well
+			r, err := rl.Reserve(ctx, "user", 3)
+			s.NoError(err)
+			s.True(r.OK())
+			s.Equal(500*time.Millisecond, r.Delay())
+
+			// the reserved requests count from now
+			_, err = rl.Allow(ctx, "user")
+			s.Require().ErrorAs(err, &rlErr)
+			s.Equal(500*time.Millisecond, rlErr.RetryAfter)
+
+			r.Cancel()
+
+			_, err = rl.AllowN(ctx, "user", 2)
+			s.NoError(err)
+
+			// the reserved bucket is counted once it is reached
+			s.clock.Set(start.Add(1500 * time.Millisecond))
+
+			r, err = rl.Reserve(ctx, "user", 3)
+			s.NoError(err)
+			s.Equal(500*time.Millisecond, r.Delay())
+
+			s.clock.Set(start.Add(2 * time.Second))
+
+			stats, err = rl.Peek(ctx, "user")
+			s.NoError(err)
+			s.Equal(1, stats.Remaining)
+			s.WithinDuration(start.Add(3*time.Second), stats.Reset, 0)
+		})
+	}
+}
+
+func (s *testFactorySuite) TestBucketedSlidingWindowPeek() {
+	rl := lib.NewBucketedSlidingWindowLimiter(lib.BucketedSlidingWindowArgs{Capacity: 4, Duration: time.Second, Buckets: 4, Clock: s.clock})
+	defer rl.Close()
+
+	ctx := context.Background()
+	start := time.Unix(1_700_000_000, 0)
+	s.clock.Set(start)
+
+	_, err := rl.AllowN(ctx, "user", 2)
+	s.Require().NoError(err)
+
+	stats, err := rl.Peek(ctx, "user")
+	s.NoError(err)
+	s.Equal(2, stats.Remaining)
+
+	s.clock.Set(start.Add(2 * time.Second))
+
+	stats, err = rl.Peek(ctx, "user")
+	s.NoError(err)
+	s.Equal(4, stats.Remaining)
+
+	// the peek did not move the window, the requests are still counted when the clock goes back
+	s.clock.Set(start)
+
+	stats, err = rl.Allow(ctx, "user")
+	s.NoError(err)
+	s.Equal(1, stats.Remaining)
+}
+
+func (s *testFactorySuite) TestBucketedSlidingWindowReservedTTL() {
+	for _, config := range []map[string]string{
+		{"algorithm": lib.BucketedSlidingWindow.String(), "capacity": "2", "duration": "1s", "buckets": "2"},
+		{"algorithm": lib.RedisBucketedSlidingWindow.String(), "capacity": "2", "duration": "1s", "buckets": "2", "redisURL": "redis://" + s.redis.Addr()},
+	} {
+		s.Run(config["algorithm"], func() {
+			rl, err := lib.NewRateLimiterWithClock(config, s.clock)
+			s.Require().NoError(err)
+			defer rl.Close()
+
+			ctx := context.Background()
+			s.clock.Set(time.Unix(1_700_000_000, 0))
+
+			// the chained reservations are ready up to 4 seconds ahead, further than two windows
+			var r *lib.Reservation
+
+			for i := 0; i < 10; i++ {
+				r, err = rl.Reserve(ctx, "user", 1)
+				s.Require().NoError(err)
+			}
+
+			s.Equal(4*time.Second, r.Delay())
+
+			s.clock.Advance(2500 * time.Millisecond)
+			s.redis.FastForward(2500 * time.Millisecond)
+
+			_, err = rl.Allow(ctx, "user")
+			s.ErrorIs(err, lib.ErrRateLimited)
+		})
+	}
+}
+
+func (s *testFactorySuite) TestBucketedSlidingWindowPrecision() {
+	// the same bursts of requests go to bucketed windows with more and more buckets
+	start := time.Unix(1_700_000_000, 0)
+	clock := lib.NewFakeClock(start)
+
+	buckets := []int{1, 10, 100}
+	limiters := make([]lib.RateLimiter, len(buckets))
+	allowed := make([][]time.Time, len(buckets))
+
+	for i, n := range buckets {
+		limiters[i] = lib.NewBucketedSlidingWindowLimiter(lib.BucketedSlidingWindowArgs{Capacity: 100, Duration: time.Second, Buckets: n, Clock: clock})
+	}
+
+	// bursts of random arrivals at 400 requests per second, with random pauses between them
+	random := rand.New(rand.NewSource(1))
+
+	for clock.Now().Before(start.Add(60 * time.Second)) {
+		burst := clock.Now().Add(time.Duration(random.Int63n(int64(time.Second))))
+
+		for clock.Now().Before(burst) {
+			clock.Advance(time.Duration(random.ExpFloat64() / 400 * float64(time.Second)))
+
+			for i, rl := range limiters {
+				if _, err := rl.Allow(context.Background(), "user"); err == nil {
+					allowed[i] = append(allowed[i], clock.Now())
+				}
+			}
+		}
+
+		clock.Advance(time.Duration(random.Int63n(int64(time.Second))))
+	}
+
+	// most requests allowed in any window of one second
+	peaks := make([]int, len(buckets))
+
+	for i, times := range allowed {
+		first := 0
+
+		for last, t := range times {
+			for t.Sub(times[first]) >= time.Second {
+				first++
+			}
+
+			peaks[i] = max(peaks[i], last-first+1)
+		}
+	}
+
+	// requests leave the window up to one bucket early. A single bucket, a fixed window, lets up to twice
+	// the capacity through across its boundary, more buckets get closer to the capacity
+	s.Greater(peaks[0], 150)
+
+	for i := 1; i < len(buckets); i++ {
+		s.Less(peaks[i], peaks[i-1])
+	}
+
+	s.LessOrEqual(peaks[len(buckets)-1], 110)
+}
+
+func (s *testFactorySuite) TestSlidingWindowLogRejected() {
+	tests := []struct {
+		rejected lib.RejectedPolicy
+		allowed  int
+	}{
+		// the retries get through as soon as the first requests leave the window
+		{lib.RejectedIgnored, 6},
+		// every retry is logged, the client stays limited while it retries faster than the limit
+		{lib.RejectedCounted, 0},
+	}
+
+	ctx := context.Background()
+
+	for _, tt := range tests {
+		s.Run(string(tt.rejected), func() {
+			rl := lib.NewSlidingWindowLogLimiter(lib.SlidingWindowLogArgs{Capacity: 3, Duration: time.Second, Rejected: tt.rejected, Clock: s.clock})
+
+			_, err := rl.AllowN(ctx, "user", 3)
+			s.Require().NoError(err)
+
+			// retry every 100ms for 3 seconds
+			allowed := 0
+
+			for i := 0; i < 30; i++ {
+				s.clock.Advance(100 * time.Millisecond)
+
+				if _, err := rl.Allow(ctx, "user"); err == nil {
+					allowed++
+				}
+			}
+
+			s.Equal(tt.allowed, allowed)
+
+			// once the client stops retrying, the window empties
+			s.clock.Advance(time.Second + time.Millisecond)
+
+			_, err = rl.AllowN(ctx, "user", 3)
+			s.NoError(err)
+		})
+	}
+}
+
+func (s *testFactorySuite) TestMultiLimiterRejected() {
+	ctx := context.Background()
+
+	// retry every 70ms for 3 seconds after a full window, returns how many retries got through.
+	// The retries never land exactly when a request leaves the window
+	retries := func(rl lib.RateLimiter) int {
+		_, err := rl.AllowN(ctx, "user", 3)
+		s.Require().NoError(err)
+
+		allowed := 0
+
+		for i := 0; i < 43; i++ {
+			s.clock.Advance(70 * time.Millisecond)
+
+			if _, err := rl.Allow(ctx, "user"); err == nil {
+				allowed++
+			}
+		}
+
+		// once the client stops retrying, the window empties
+		s.clock.Advance(time.Second + time.Millisecond)
+
+		_, err = rl.AllowN(ctx, "user", 3)
+		s.NoError(err)
+
+		return allowed
+	}
+
+	for _, rejected := range []lib.RejectedPolicy{lib.RejectedIgnored, lib.RejectedCounted} {
+		s.Run(string(rejected), func() {
+			newWindow := func() lib.RateLimiter {
+				return lib.NewSlidingWindowLogLimiter(lib.SlidingWindowLogArgs{Capacity: 3, Duration: time.Second, Rejected: rejected, Clock: s.clock})
+			}
+
+			alone := newWindow()
+			defer alone.Close()
+
+			burst := lib.NewTokenBucketLimiter(lib.TokenBucketArgs{Capacity: 100, RefillRate: 100, Clock: s.clock})
+
+			rl, err := lib.NewMultiLimiter(lib.MultiLimiterArgs{
+				Limits: []lib.NamedLimiter{{Name: "burst", Limiter: burst}, {Name: "window", Limiter: newWindow()}},
+				Clock:  s.clock,
+			})
+			s.Require().NoError(err)
+			defer rl.Close()
+
+			// the window denies the retries through the multi limiter as it does on its own
+			allowed := retries(alone)
+			s.Equal(allowed, retries(rl))
+
+			if rejected == lib.RejectedCounted {
+				s.Zero(allowed)
+			} else {
+				s.Positive(allowed)
+			}
+		})
+	}
+}
+
+func (s *testFactorySuite) TestSlidingWindowLogReserveOrder() {
+	rl := lib.NewSlidingWindowLogLimiter(lib.SlidingWindowLogArgs{Capacity: 2, Duration: time.Second, Rejected: lib.RejectedCounted, Clock: s.clock})
+	ctx := context.Background()
+
+	_, err := rl.AllowN(ctx, "user", 2)
+	s.Require().NoError(err)
+
+	// the reservation is logged one second ahead
+	r, err := rl.Reserve(ctx, "user", 1)
+	s.Require().NoError(err)
+	s.Equal(time.Second, r.Delay())
+
+	// the declined retry is logged before the reservation, it leaves the window first
+	s.clock.Advance(100 * time.Millisecond)
+
+	var rlErr *lib.RateLimitError
+
+	_, err = rl.Allow(ctx, "user")
+	s.Require().ErrorAs(err, &rlErr)
+	s.Equal(0, rlErr.Stats.Remaining)
+	s.Equal(time.Second, rlErr.RetryAfter)
+
+	// only the reservation is left in the window
+	s.clock.Advance(time.Second + 50*time.Millisecond)
+
+	stats, err := rl.Allow(ctx, "user")
+	s.NoError(err)
+	s.Equal(0, stats.Remaining)
+}
+
+func (s *testFactorySuite) TestSnapshotRestore() {
+	ctx := context.Background()
+
+	// the token bucket, fixed window, sliding window log and both sliding window counters
+	for _, config := range s.rlConfig[:5] {
+		s.Run(config.alg, func() {
+			rl, err := lib.NewRateLimiterWithClock(config.config, s.clock)
+			s.Require().NoError(err)
+			defer rl.Close()
+
+			_, err = rl.AllowN(ctx, "user", 4)
+			s.Require().NoError(err)
+
+			want, err := rl.Peek(ctx, "user")
+			s.Require().NoError(err)
+
+			var buf bytes.Buffer
+			s.Require().NoError(rl.(lib.Snapshotter).Snapshot(&buf))
+			snapshot := buf.Bytes()
+
+			// a new limiter, e.g. after a restart, gets the state of the user back
+			restored, err := lib.NewRateLimiterWithClock(config.config, s.clock)
+			s.Require().NoError(err)
+			defer restored.Close()
+
+			s.NoError(restored.(lib.Snapshotter).Restore(bytes.NewReader(snapshot)))
+			s.Equal(1, restored.(lib.KeyTracker).TrackedKeys())
+
+			stats, err := restored.Peek(ctx, "user")
+			s.NoError(err)
+			s.Equal(want.Remaining, stats.Remaining)
+
+			// users back to full while the process was down are discarded
+			s.clock.Advance(time.Minute)
+
+			stale, err := lib.NewRateLimiterWithClock(config.config, s.clock)
+			s.Require().NoError(err)
+			defer stale.Close()
+
+			s.NoError(stale.(lib.Snapshotter).Restore(bytes.NewReader(snapshot)))
+			s.Equal(0, stale.(lib.KeyTracker).TrackedKeys())
+
+			// and they are not written to the next snapshot
+			buf.Reset()
+			s.NoError(rl.(lib.Snapshotter).Snapshot(&buf))
+			s.NotContains(buf.String(), `"user"`)
+		})
+	}
+}
+
+func (s *testFactorySuite) TestInvalidSnapshot() {
+	tb := lib.NewTokenBucketLimiter(lib.TokenBucketArgs{Capacity: 10, RefillRate: 1, Clock: s.clock})
+	defer tb.Close()
+
+	fw := lib.NewFixedWindowLimiter(lib.FixedWindowArgs{Capacity: 10, Duration: time.Second, Clock: s.clock})
+	defer fw.Close()
+
+	var buf bytes.Buffer
+	s.Require().NoError(tb.(lib.Snapshotter).Snapshot(&buf))
+
+	// a snapshot of another algorithm
+	err := fw.(lib.Snapshotter).Restore(&buf)
+	s.ErrorIs(err, lib.ErrInvalidSnapshot)
+
+	// another format version
+	err = tb.(lib.Snapshotter).Restore(strings.NewReader(`{"Version":2,"Algorithm":"token-bucket","Users":{}}`))
+	s.ErrorIs(err, lib.ErrInvalidSnapshot)
+
+	err = tb.(lib.Snapshotter).Restore(strings.NewReader("not json"))
+	s.ErrorIs(err, lib.ErrInvalidSnapshot)
+
+	// the Redis limiters keep their state in Redis
+	redis := lib.NewRedisGCRALimiter(lib.RedisGCRAArgs{RedisURL: "redis://" + s.redis.Addr(), Capacity: 10, RefillRate: 1})
+	defer redis.Close()
+
+	_, ok := redis.(lib.Snapshotter)
+	s.False(ok)
+}
+
+func (s *testFactorySuite) TestSnapshotFile() {
+	ctx := context.Background()
+	path := filepath.Join(s.T().TempDir(), "state.json")
+
+	newGroup := func() (lib.Snapshotter, lib.RateLimiter, lib.RateLimiter) {
+		tb := lib.NewTokenBucketLimiter(lib.TokenBucketArgs{Capacity: 10, RefillRate: 1, Clock: s.clock})
+		sw := lib.NewSlidingWindowLogLimiter(lib.SlidingWindowLogArgs{Capacity: 10, Duration: time.Minute, Clock: s.clock})
+
+		return lib.NewSnapshotGroup(map[string]lib.Snapshotter{"tb": tb.(lib.Snapshotter), "sw": sw.(lib.Snapshotter)}, nil), tb, sw
+	}
+
+	// a missing file is a first start
+	group, tb, sw := newGroup()
+	s.NoError(lib.LoadSnapshot(group, path))
+
+	_, err := tb.AllowN(ctx, "user", 10)
+	s.Require().NoError(err)
+	_, err = sw.AllowN(ctx, "user", 3)
+	s.Require().NoError(err)
+
+	// the last snapshot is saved on stop
+	stop := lib.StartSnapshots(group, path, time.Hour, nil)
+	s.NoError(stop())
+	tb.Close()
+	sw.Close()
+
+	group, tb, sw = newGroup()
+	defer tb.Close()
+	defer sw.Close()
+
+	s.NoError(lib.LoadSnapshot(group, path))
+
+	_, err = tb.Allow(ctx, "user")
+	s.ErrorIs(err, lib.ErrRateLimited)
+
+	stats, err := sw.Peek(ctx, "user")
+	s.NoError(err)
+	s.Equal(7, stats.Remaining)
+}
+
+func (s *testFactorySuite) TestSnapshotGroupSkip() {
+	ctx := context.Background()
+
+	tb := lib.NewTokenBucketLimiter(lib.TokenBucketArgs{Capacity: 10, RefillRate: 1, Clock: s.clock})
+	defer tb.Close()
+
+	sw := lib.NewSlidingWindowLogLimiter(lib.SlidingWindowLogArgs{Capacity: 10, Duration: time.Minute, Clock: s.clock})
+	defer sw.Close()
+
+	_, err := tb.AllowN(ctx, "user", 10)
+	s.Require().NoError(err)
+	_, err = sw.AllowN(ctx, "user", 3)
+	s.Require().NoError(err)
+
+	var buf bytes.Buffer
+	s.Require().NoError(lib.NewSnapshotGroup(map[string]lib.Snapshotter{"a": tb.(lib.Snapshotter), "b": sw.(lib.Snapshotter)}, nil).Snapshot(&buf))
+
+	// the algorithm of the first limit changed, it starts empty and the second one is still restored
+	fw := lib.NewFixedWindowLimiter(lib.FixedWindowArgs{Capacity: 10, Duration: time.Minute, Clock: s.clock})
+	defer fw.Close()
+
+	restored := lib.NewSlidingWindowLogLimiter(lib.SlidingWindowLogArgs{Capacity: 10, Duration: time.Minute, Clock: s.clock})
+	defer restored.Close()
+
+	var skipped []error
+
+	group := lib.NewSnapshotGroup(map[string]lib.Snapshotter{"a": fw.(lib.Snapshotter), "b": restored.(lib.Snapshotter)}, func(err error) {
+		skipped = append(skipped, err)
+	})
+
+	s.NoError(group.Restore(&buf))
+	s.Require().Len(skipped, 1)
+	s.ErrorIs(skipped[0], lib.ErrInvalidSnapshot)
+	s.Contains(skipped[0].Error(), `limit "a"`)
+
+	stats, err := fw.Peek(ctx, "user")
+	s.NoError(err)
+	s.Equal(10, stats.Remaining)
+
+	stats, err = restored.Peek(ctx, "user")
+	s.NoError(err)
+	s.Equal(7, stats.Remaining)
+
+	// a snapshot of another format version restores nothing
+	skipped = nil
+	s.NoError(group.Restore(strings.NewReader(`{"Version":2,"Limits":{}}`)))
+	s.Require().Len(skipped, 1)
+	s.ErrorIs(skipped[0], lib.ErrInvalidSnapshot)
+
+	// a file that cannot be read fails
+	s.ErrorIs(group.Restore(strings.NewReader("not json")), lib.ErrInvalidSnapshot)
+}
+
+func TestRateLimiterSuite(t *testing.T) {
+	suite.Run(t, new(testFactorySuite))
+}
+
+// BenchmarkSlidingWindowLogMemory reports the memory held by the log of each key once its window is full
+func BenchmarkSlidingWindowLogMemory(b *testing.B) {
+	for _, capacity := range []int{10, 100, 1000} {
+		b.Run(strconv.Itoa(capacity), func(b *testing.B) {
+			clock := lib.NewFakeClock(time.Now())
+			rl := lib.NewSlidingWindowLogLimiter(lib.SlidingWindowLogArgs{Capacity: capacity, Duration: time.Hour, Clock: clock})
+			ctx := context.Background()
+
+			var before, after runtime.MemStats
+
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				_, _ = rl.AllowN(ctx, strconv.Itoa(i), capacity)
+			}
+
+			b.StopTimer()
+
+			runtime.GC()
+			runtime.ReadMemStats(&after)
+
+			b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/float64(b.N), "B/key")
+			runtime.KeepAlive(rl)
+		})
+	}
+}
+
+// BenchmarkSlidingWindowLogRetries measures a client retrying against a full window
+func BenchmarkSlidingWindowLogRetries(b *testing.B) {
+	for _, rejected := range []lib.RejectedPolicy{lib.RejectedIgnored, lib.RejectedCounted} {
+		b.Run(string(rejected), func(b *testing.B) {
+			clock := lib.NewFakeClock(time.Now())
+			rl := lib.NewSlidingWindowLogLimiter(lib.SlidingWindowLogArgs{Capacity: 100, Duration: time.Second, Rejected: rejected, Clock: clock})
+			ctx := context.Background()
+
+			b.ReportAllocs()
+
+			for i := 0; i < b.N; i++ {
+				clock.Advance(time.Millisecond)
+				_, _ = rl.Allow(ctx, "user")
+			}
+		})
+	}
 }
@@ -0,0 +1,115 @@
+package lib
+
+import (
+	"time"
+
+	"github.com/carantes/go-rate-limiter/lib/internal/interfaces"
+	"github.com/carantes/go-rate-limiter/lib/internal/mocks"
+)
+
+// RateLimiter is the interface implemented by every rate limit algorithm.
+// Callers can provide their own implementation and use it anywhere a RateLimiter is expected.
+type RateLimiter = interfaces.RateLimiter
+
+// ConcurrencyLimiter limits how many requests a key has in flight at once, see NewConcurrencyLimiter
+type ConcurrencyLimiter = interfaces.ConcurrencyLimiter
+
+// AdaptiveLimiter is a concurrency limiter whose limit follows the latency and the failures of the requests, see NewAdaptiveLimiter
+type AdaptiveLimiter = interfaces.AdaptiveLimiter
+
+// AdaptiveStats represents the current limit of an adaptive limiter and the latencies it is based on
+type AdaptiveStats = interfaces.AdaptiveLimiterStats
+
+// KeyTracker is implemented by the in-memory rate limiters, use a type assertion to read how many users they hold
+type KeyTracker = interfaces.KeyTracker
+
+// Snapshotter is implemented by the in-memory token bucket, fixed window, sliding window log and sliding window counter
+// rate limiters, use a type assertion to save their users across restarts, see SaveSnapshot and LoadSnapshot
+type Snapshotter = interfaces.Snapshotter
+
+// Stats represents the rate limit stats of a specific user after a request
+type Stats = interfaces.RateLimiterStats
+
+// Reservation holds tokens reserved ahead of time with RateLimiter.Reserve
+type Reservation = interfaces.Reservation
+
+// RateLimitError is the error returned by the rate limiters.
+// Denied requests carry the retry-after duration, the limit and the stats at the time of the denial
+type RateLimitError = interfaces.RateLimitError
+
+// Sentinel errors, use errors.Is to find out why a rate limiter failed
+var (
+	ErrRateLimited        = interfaces.ErrRateLimited
+	ErrInvalidConfig      = interfaces.ErrInvalidConfig
+	ErrInvalidTokens      = interfaces.ErrInvalidTokens
+	ErrBackendUnavailable = interfaces.ErrBackendUnavailable
+	ErrInvalidSnapshot    = interfaces.ErrInvalidSnapshot
+)
+
+// Clock is the source of time of a rate limiter, see the Clock field of the algorithm arguments
+type Clock = interfaces.Clock
+
+// SystemClock reads the time from the operating system, it is used when no clock is given
+var SystemClock = interfaces.SystemClock
+
+// FakeClock is a controllable clock for tests, time only moves with Advance and Set
+type FakeClock = mocks.Clock
+
+// NewFakeClock creates a fake clock stopped at the given time
+func NewFakeClock(now time.Time) *FakeClock {
+	return mocks.NewClock(now)
+}
+
+// Algorithm is the name of a registered rate limit algorithm
+type Algorithm = interfaces.Algorithm
+
+const (
+	TokenBucket                = interfaces.TokenBucket
+	FixedWindow                = interfaces.FixedWindow
+	SlidingWindowLog           = interfaces.SlidingWindowLog
+	SlidingWindowCounter       = interfaces.SlidingWindowCounter
+	RedisSlidingWindowCounter  = interfaces.RedisSlidingWindowCounter
+	LeakyBucket                = interfaces.LeakyBucket
+	GCRA                       = interfaces.GCRA
+	RedisGCRA                  = interfaces.RedisGCRA
+	BucketedSlidingWindow      = interfaces.BucketedSlidingWindow
+	RedisBucketedSlidingWindow = interfaces.RedisBucketedSlidingWindow
+)
+
+// ParseAlgorithm returns the registered algorithm matching the given name (e.g. "token-bucket")
+func ParseAlgorithm(s string) (Algorithm, bool) {
+	return interfaces.ParseAlgorithm(s)
+}
+
+// AlgorithmSpec describes a rate limit algorithm: its name, the fields of its string config and its factory
+type AlgorithmSpec = interfaces.AlgorithmSpec
+
+// ConfigField describes one key of the string config of an algorithm
+type ConfigField = interfaces.ConfigField
+
+// FieldType is the type of the value of a config field
+type FieldType = interfaces.FieldType
+
+const (
+	IntField      = interfaces.IntField
+	FloatField    = interfaces.FloatField
+	StringField   = interfaces.StringField
+	DurationField = interfaces.DurationField
+	RateField     = interfaces.RateField
+)
+
+// RegisterAlgorithm adds an algorithm to the registry. It can then be used by NewRateLimiter, policy files and the CLI.
+// Names are case insensitive and must be unique, the built-in algorithms are already registered
+func RegisterAlgorithm(spec AlgorithmSpec) error {
+	return interfaces.RegisterAlgorithm(spec)
+}
+
+// LookupAlgorithm returns the registered algorithm with the given name
+func LookupAlgorithm(name string) (AlgorithmSpec, bool) {
+	return interfaces.LookupAlgorithm(name)
+}
+
+// Algorithms returns every registered algorithm sorted by name
+func Algorithms() []AlgorithmSpec {
+	return interfaces.Algorithms()
+}